@@ -0,0 +1,189 @@
+package app
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// authorizedAdmin returns true if the request carries the admin token.
+// Admin endpoints are disabled when no token is configured.
+func (a *App) authorizedAdmin(r *http.Request) bool {
+	if a.adminToken == "" {
+		return false
+	}
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return ok && subtle.ConstantTimeCompare([]byte(token), []byte(a.adminToken)) == 1
+}
+
+// handleErase is the HTTP handler for the POST /admin/erase endpoint.
+// It erases the events of the users in the usr query parameter, a comma-separated list,
+// from the property given in the property query parameter, or else from all properties.
+// Dry runs respond with the number of events that would be removed,
+// other erasures run in the background & respond immediately. Their outcome
+// is in the audit log, & they are cancelled, leaving the file as it was, on shutdown.
+// Results of the property's reports are cleared, as they may hold the events removed.
+func (a *App) handleErase(w http.ResponseWriter, r *http.Request) {
+	if !a.authorizedAdmin(r) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	q := r.URL.Query()
+	usrs, err := ParseUsrs(q.Get("usr"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	properties := make([]*property, 0, len(a.properties))
+	if name := q.Get("property"); name != "" {
+		p, exists := a.properties[name]
+		if !exists {
+			http.Error(w, fmt.Sprintf("property %s not found", name), http.StatusNotFound)
+			return
+		}
+		properties = append(properties, p)
+	} else {
+		for _, name := range a.propertyNames {
+			properties = append(properties, a.properties[name])
+		}
+	}
+	dryRun := q.Get("dryRun") == "true"
+	ref := q.Get("ref")
+	requestedBy := "admin " + r.RemoteAddr
+	if addr, ok := clientAddr(r); ok {
+		requestedBy = "admin " + addr.String()
+	}
+	erase := func(p *property) (*EraseResult, error) {
+		p.rewriteMu.Lock()
+		defer p.rewriteMu.Unlock()
+		res, err := Erase(&EraseCfg{
+			Ctx:         a.ctx,
+			Filename:    p.filename,
+			Usrs:        usrs,
+			DryRun:      dryRun,
+			Ref:         ref,
+			RequestedBy: requestedBy,
+			Layout:      a.blockLayout,
+			Codec:       a.blockCodec,
+			lock:        &p.fileMu,
+			pending:     p.block,
+		})
+		if err != nil || dryRun || res.EventsRemoved == 0 {
+			return res, err
+		}
+		p.rebuildRollup()
+		p.queries.clear()
+		if err := p.reportRunner.ClearResults(); err != nil {
+			return res, fmt.Errorf("erased events, but failed to clear results: %w", err)
+		}
+		return res, nil
+	}
+
+	if !dryRun {
+		a.erasures.Add(1)
+		go func() {
+			defer a.erasures.Done()
+			for _, p := range properties {
+				res, err := erase(p)
+				if err != nil {
+					fmt.Printf("\nfailed to erase events from property %s: %v\n", p.name, err)
+					continue
+				}
+				fmt.Printf("\nerased %d events from property %s\n", res.EventsRemoved, p.name)
+			}
+		}()
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
+
+	results := make(map[string]*EraseResult, len(properties))
+	for _, p := range properties {
+		res, err := erase(p)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		results[p.name] = res
+	}
+	w.Header().Set("Content-Type", "application/json")
+	data, err := json.MarshalIndent(results, "", "  ")
+	if err != nil {
+		panic(err)
+	}
+	w.Write(data)
+}
+
+// ParseUsrs parses a comma-separated list of user ids.
+func ParseUsrs(s string) ([]uint32, error) {
+	usrs := make([]uint32, 0)
+	for _, usrStr := range strings.Split(s, ",") {
+		usrStr = strings.TrimSpace(usrStr)
+		if usrStr == "" {
+			continue
+		}
+		usr, err := strconv.ParseUint(usrStr, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("err to parse uint32 user id %q: %w", usrStr, err)
+		}
+		usrs = append(usrs, uint32(usr))
+	}
+	if len(usrs) == 0 {
+		return nil, fmt.Errorf("no user ids given")
+	}
+	return usrs, nil
+}
+
+// maxImportBytes limits the size of the body of an import, which is spooled to disk
+const maxImportBytes = 1 << 30
+
+// handleImport is the HTTP handler for the POST /admin/import endpoint.
+// It imports the events in the request body into the property given
+// in the property query parameter, or else into the primary property.
+// The format query parameter is ndjson (default) or zoe.
+func (a *App) handleImport(w http.ResponseWriter, r *http.Request) {
+	if !a.authorizedAdmin(r) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	p, err := a.resolveProperty(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = "ndjson"
+	}
+	p.rewriteMu.Lock()
+	defer p.rewriteMu.Unlock()
+	res, err := Import(&ImportCfg{
+		Filename:  p.filename,
+		Src:       http.MaxBytesReader(w, r.Body, maxImportBytes),
+		Format:    format,
+		BlockSize: a.blockSize,
+		Layout:    a.blockLayout,
+		Codec:     a.blockCodec,
+		EvTypes:   a.evTypes,
+		lock:      &p.fileMu,
+	})
+	if err != nil {
+		status := http.StatusBadRequest
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			status = http.StatusRequestEntityTooLarge
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+	p.rebuildRollup()
+	w.Header().Set("Content-Type", "application/json")
+	data, err := json.MarshalIndent(res, "", "  ")
+	if err != nil {
+		panic(err)
+	}
+	w.Write(data)
+}
@@ -9,39 +9,62 @@ import (
 	"sync"
 	"time"
 
+	"github.com/swissinfo-ch/zoe/bot"
+	"github.com/swissinfo-ch/zoe/codec"
 	"github.com/swissinfo-ch/zoe/ev"
-	"github.com/swissinfo-ch/zoe/report"
+	"github.com/swissinfo-ch/zoe/geo"
 	"golang.org/x/time/rate"
 )
 
 type App struct {
 	ctx   context.Context
+	done  chan struct{} // closed after shutdown
 	laddr string
 	// PROOF clients stored in memory
 	clients        map[string]*client // writer:addr or reader:addr
 	clientMu       sync.Mutex
-	events         chan *ev.Ev
-	filename       string
-	reportRunner   *report.Runner
-	reportNames    []string
+	properties     map[string]*property
+	propertyNames  []string // in order of configuration, the first is the primary
 	commit         string
 	blockSize      int
+	blockLayout    ev.Layout
+	blockCodec     codec.Codec
 	rateLimitEvery time.Duration
 	rateLimitBurst int
 	numCPU         int
-	allowedOrigins []string
+	botFilter      *bot.Filter
+	dropBots       bool
+	geoDB          *geo.DB
+	evTypes        *ev.Registry
+	defaultConsent ev.Consent
+	salt           dailySalt
+	adminToken     string
+	exportToken    string
+	exportEvery    time.Duration
+	exportBurst    int
+	exportClients  map[string]*client // export limiters by client address, guarded by clientMu
+	exportSlots    chan struct{}
+	erasures       sync.WaitGroup // erasures running in the background
 }
 
 type AppCfg struct {
 	Ctx            context.Context
 	Laddr          string
-	Filename       string
+	Properties     []*PropertyCfg // at least one, the first is the primary property
 	BlockSize      int
-	ReportRunner   *report.Runner
-	ReportNames    []string
+	BlockLayout    ev.Layout   // layout of the blocks written, blocks of any layout are read
+	BlockCodec     codec.Codec // codec of the blocks written, blocks of any codec are read
 	RateLimitEvery time.Duration
 	RateLimitBurst int
-	AllowedOrigins []string
+	BotFilter      *bot.Filter  // optional, classifies events as bot traffic
+	DropBots       bool         // drop bot events instead of storing them flagged
+	GeoDB          *geo.DB      // optional, resolves the country of the client
+	EvTypes        *ev.Registry // optional, custom event types accepted at ingestion
+	DefaultConsent ev.Consent   // consent level of requests without CONSENT header
+	AdminToken     string       // bearer token of admin endpoints, disabled if empty
+	ExportToken    string       // bearer token of the export endpoint, disabled if empty
+	ExportEvery    time.Duration
+	ExportBurst    int // exports per client, refilled one every ExportEvery
 }
 
 type client struct {
@@ -53,26 +76,55 @@ type client struct {
 func NewApp(cfg *AppCfg) *App {
 	a := &App{
 		ctx:            cfg.Ctx,
+		done:           make(chan struct{}),
 		laddr:          cfg.Laddr,
-		filename:       cfg.Filename,
 		clients:        make(map[string]*client),
 		clientMu:       sync.Mutex{},
-		events:         make(chan *ev.Ev, 100),
-		reportRunner:   cfg.ReportRunner,
-		reportNames:    cfg.ReportNames,
+		properties:     make(map[string]*property, len(cfg.Properties)),
+		propertyNames:  make([]string, 0, len(cfg.Properties)),
 		blockSize:      cfg.BlockSize,
+		blockLayout:    cfg.BlockLayout,
+		blockCodec:     cfg.BlockCodec,
 		rateLimitEvery: cfg.RateLimitEvery,
 		rateLimitBurst: cfg.RateLimitBurst,
 		numCPU:         runtime.NumCPU(),
-		allowedOrigins: cfg.AllowedOrigins,
+		botFilter:      cfg.BotFilter,
+		dropBots:       cfg.DropBots,
+		geoDB:          cfg.GeoDB,
+		evTypes:        cfg.EvTypes,
+		defaultConsent: cfg.DefaultConsent,
+		adminToken:     cfg.AdminToken,
+		exportToken:    cfg.ExportToken,
+		exportEvery:    cfg.ExportEvery,
+		exportBurst:    cfg.ExportBurst,
+		exportClients:  make(map[string]*client),
+		exportSlots:    make(chan struct{}, maxConcurrentExports),
 	}
 	commit, err := os.ReadFile("commit")
 	if err != nil {
 		panic(fmt.Sprintf("failed to read commit file: %v", err))
 	}
 	a.commit = string(commit)
+	for _, pcfg := range cfg.Properties {
+		a.properties[pcfg.Name] = &property{
+			name:           pcfg.Name,
+			filename:       pcfg.Filename,
+			events:         make(chan *ev.Ev, 100),
+			reportRunner:   pcfg.ReportRunner,
+			reportNames:    pcfg.ReportNames,
+			allowedOrigins: pcfg.AllowedOrigins,
+			rollup:         pcfg.Rollup,
+			rollupReports:  pcfg.RollupReports,
+			block: &ev.Block{
+				Evs: make([]*ev.Ev, 0, cfg.BlockSize),
+			},
+		}
+		a.propertyNames = append(a.propertyNames, pcfg.Name)
+	}
 	go a.cleanupVisitors()
-	go a.writeEvents()
+	for _, p := range a.properties {
+		go a.writeEvents(p)
+	}
 	go a.serve()
 	return a
 }
@@ -103,15 +155,28 @@ func (a *App) handleRequest(w http.ResponseWriter, r *http.Request) {
 			a.handleRoot(w, r)
 		case "/r":
 			a.handleGetReportResult(w, r)
+		case "/r/history":
+			a.handleGetReportHistory(w, r)
+		case "/r/diff":
+			a.handleGetReportDiff(w, r)
 		case "/js":
 			a.handleGetJS(w, r)
 		case "/status":
 			a.handleGetStatus(w, r)
+		case "/export":
+			a.handleExport(w, r)
 		default:
 			http.ServeFile(w, r, "assets"+r.URL.Path)
 		}
 	case "POST":
-		a.handlePost(w, r)
+		switch r.URL.Path {
+		case "/admin/erase":
+			a.handleErase(w, r)
+		case "/admin/import":
+			a.handleImport(w, r)
+		default:
+			a.handlePost(w, r)
+		}
 	}
 }
 
@@ -138,14 +203,12 @@ func (a *App) rateLimitMiddleware(next http.Handler) http.Handler {
 func (a *App) corsMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		origin := r.Header.Get("Origin")
-		for _, o := range a.allowedOrigins {
-			if o == origin {
-				w.Header().Set("Access-Control-Allow-Origin", origin)
-				break
-			}
+		if p, err := a.resolveProperty(r); err == nil && p.allowsOrigin(origin) {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
 		}
-		w.Header().Set("Access-Control-Allow-Headers", "X_TYPE,X_USR,X_SESS,X_CID,X_SCROLLED,X_PAGE_SECONDS")
+		w.Header().Set("Access-Control-Allow-Headers", "X_TYPE,X_USR,X_SESS,X_CID,X_SCROLLED,X_PAGE_SECONDS,REFERRER,PAGE,VALUE,PROPERTY,CONSENT")
 		w.Header().Set("Access-Control-Allow-Methods", "GET,POST,OPTIONS")
+		w.Header().Set("Access-Control-Expose-Headers", "X-Report-Stale,X-Report-Generated-At,X-Report-Event-Count")
 		if r.Method == "OPTIONS" {
 			w.WriteHeader(http.StatusOK)
 			return
@@ -174,7 +237,26 @@ func (a *App) getRateLimiter(r *http.Request) *rate.Limiter {
 	return v.limiter
 }
 
-// cleanupVisitors removes clients that have not been seen for 10 seconds.
+// getExportLimiter returns the export rate limiter of the client of a request.
+func (a *App) getExportLimiter(r *http.Request) *rate.Limiter {
+	key := r.RemoteAddr
+	if addr, ok := clientAddr(r); ok {
+		key = addr.String()
+	}
+	a.clientMu.Lock()
+	defer a.clientMu.Unlock()
+	v, exists := a.exportClients[key]
+	if !exists {
+		limiter := rate.NewLimiter(rate.Every(a.exportEvery), a.exportBurst)
+		a.exportClients[key] = &client{limiter, time.Now()}
+		return limiter
+	}
+	v.lastSeen = time.Now()
+	return v.limiter
+}
+
+// cleanupVisitors removes clients that have not been seen for 10 seconds,
+// & export clients once their limiter is full again, as a new one would be.
 func (a *App) cleanupVisitors() {
 	for {
 		select {
@@ -188,6 +270,11 @@ func (a *App) cleanupVisitors() {
 					delete(a.clients, key)
 				}
 			}
+			for key, client := range a.exportClients {
+				if client.limiter.Tokens() >= float64(client.limiter.Burst()) {
+					delete(a.exportClients, key)
+				}
+			}
 			a.clientMu.Unlock()
 		}
 	}
@@ -203,4 +290,19 @@ func (a *App) shutdown(server *http.Server) {
 		panic(fmt.Sprintf("server shutdown failed: %v", err))
 	}
 	fmt.Println("server shutdown gracefully")
+	// Stop the report runners, & wait for them to stop reading the files
+	for _, name := range a.propertyNames {
+		runner := a.properties[name].reportRunner
+		runner.Stop()
+		runner.Wait()
+	}
+	fmt.Println("report runners stopped")
+	// erasures are cancelled with the app's context
+	a.erasures.Wait()
+	close(a.done)
+}
+
+// Wait blocks until the app has shut down, once its context is done.
+func (a *App) Wait() {
+	<-a.done
 }
@@ -0,0 +1,107 @@
+package app
+
+import (
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strings"
+
+	"github.com/swissinfo-ch/zoe/ev"
+)
+
+var searchHosts = []string{
+	"google.", "bing.", "duckduckgo.", "yahoo.", "ecosia.",
+	"qwant.", "baidu.", "yandex.", "startpage.", "search.brave.",
+}
+
+var socialHosts = []string{
+	"facebook.", "instagram.", "linkedin.", "lnkd.in", "t.co",
+	"twitter.", "x.com", "reddit.", "youtube.", "tiktok.",
+	"pinterest.", "whatsapp.", "telegram.", "threads.net",
+}
+
+// classifyReferrer derives the traffic source from the referrer
+// of the page & the UTM parameters of the page url.
+// UTM parameters take precedence, as they are set deliberately.
+func classifyReferrer(referrer, page string) ev.Referrer {
+	pageURL, _ := url.Parse(page)
+	if pageURL != nil {
+		q := pageURL.Query()
+		medium := strings.ToLower(q.Get("utm_medium"))
+		source := strings.ToLower(q.Get("utm_source"))
+		switch {
+		case medium == "email" || medium == "newsletter" || strings.Contains(source, "newsletter"):
+			return ev.Referrer_NEWSLETTER
+		case medium == "social" || medium == "social-media" || medium == "sm":
+			return ev.Referrer_SOCIAL
+		case medium == "cpc" || medium == "ppc" || medium == "paidsearch":
+			return ev.Referrer_SEARCH
+		}
+	}
+	if referrer == "" {
+		return ev.Referrer_DIRECT
+	}
+	refURL, err := url.Parse(referrer)
+	if err != nil || refURL.Hostname() == "" {
+		return ev.Referrer_DIRECT
+	}
+	refHost := strings.TrimPrefix(strings.ToLower(refURL.Hostname()), "www.")
+	if pageURL != nil && refHost == strings.TrimPrefix(strings.ToLower(pageURL.Hostname()), "www.") {
+		return ev.Referrer_INTERNAL
+	}
+	if hostMatches(refHost, searchHosts) {
+		return ev.Referrer_SEARCH
+	}
+	if hostMatches(refHost, socialHosts) {
+		return ev.Referrer_SOCIAL
+	}
+	return ev.Referrer_EXTERNAL
+}
+
+// hostMatches returns true if host matches any of the given names.
+// Names ending with a dot match any top-level domain, eg. "google."
+// matches news.google.ch, other names match the domain & its subdomains.
+func hostMatches(host string, names []string) bool {
+	for _, name := range names {
+		if strings.HasSuffix(name, ".") {
+			if strings.HasPrefix(host, name) || strings.Contains(host, "."+name) {
+				return true
+			}
+			continue
+		}
+		if host == name || strings.HasSuffix(host, "."+name) {
+			return true
+		}
+	}
+	return false
+}
+
+// classifyDevice derives the device class from the User-Agent.
+func classifyDevice(userAgent string) ev.Device {
+	ua := strings.ToLower(userAgent)
+	switch {
+	case strings.Contains(ua, "ipad") || strings.Contains(ua, "tablet") ||
+		(strings.Contains(ua, "android") && !strings.Contains(ua, "mobile")):
+		return ev.Device_TABLET
+	case strings.Contains(ua, "mobi") || strings.Contains(ua, "iphone") ||
+		strings.Contains(ua, "ipod") || strings.Contains(ua, "windows phone"):
+		return ev.Device_MOBILE
+	}
+	return ev.Device_DESKTOP
+}
+
+// clientAddr returns the address of the client,
+// preferring the header set by the Fly proxy.
+func clientAddr(r *http.Request) (netip.Addr, bool) {
+	host := r.Header.Get("Fly-Client-IP")
+	if host == "" {
+		var err error
+		host, _, err = net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			host = r.RemoteAddr
+		}
+	}
+	addr, err := netip.ParseAddr(host)
+	return addr, err == nil
+}
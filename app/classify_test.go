@@ -0,0 +1,102 @@
+package app
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/swissinfo-ch/zoe/ev"
+)
+
+func TestClassifyReferrer(t *testing.T) {
+	page := "https://www.swissinfo.ch/eng/politics/article"
+	tests := []struct {
+		name     string
+		referrer string
+		page     string
+		want     ev.Referrer
+	}{
+		{"empty", "", page, ev.Referrer_DIRECT},
+		{"malformed", "::not a url", page, ev.Referrer_DIRECT},
+		{"without a host", "/eng/politics", page, ev.Referrer_DIRECT},
+		{"internal", "https://www.swissinfo.ch/eng", page, ev.Referrer_INTERNAL},
+		{"internal without www", "https://swissinfo.ch/eng", page, ev.Referrer_INTERNAL},
+		{"internal upper-case", "https://WWW.SwissInfo.ch/eng", page, ev.Referrer_INTERNAL},
+		{"subdomain is external", "https://blog.swissinfo.ch/", page, ev.Referrer_EXTERNAL},
+		{"external", "https://www.nzz.ch/schweiz", page, ev.Referrer_EXTERNAL},
+		{"external without a page", "https://www.nzz.ch/schweiz", "", ev.Referrer_EXTERNAL},
+		{"malformed page", "https://www.nzz.ch/schweiz", "::not a url", ev.Referrer_EXTERNAL},
+		{"search", "https://www.google.com/", page, ev.Referrer_SEARCH},
+		{"search of a country", "https://www.google.ch/", page, ev.Referrer_SEARCH},
+		{"search subdomain", "https://news.google.ch/", page, ev.Referrer_SEARCH},
+		{"search engines", "https://duckduckgo.com/", page, ev.Referrer_SEARCH},
+		{"brave search", "https://search.brave.com/search?q=swissinfo", page, ev.Referrer_SEARCH},
+		{"not search", "https://notgoogle.com/", page, ev.Referrer_EXTERNAL},
+		{"not brave search", "https://brave.com/", page, ev.Referrer_EXTERNAL},
+		{"social", "https://www.facebook.com/", page, ev.Referrer_SOCIAL},
+		{"social mobile", "https://m.facebook.com/", page, ev.Referrer_SOCIAL},
+		{"social short links", "https://t.co/abc", page, ev.Referrer_SOCIAL},
+		{"social domain", "https://x.com/swissinfo_en", page, ev.Referrer_SOCIAL},
+		{"not social", "https://myreddit.com/", page, ev.Referrer_EXTERNAL},
+		{"not social short links", "https://microsoft.co/", page, ev.Referrer_EXTERNAL},
+		{"utm newsletter", "https://www.google.com/", page + "?utm_medium=email", ev.Referrer_NEWSLETTER},
+		{"utm newsletter source", "", page + "?utm_source=weekly-newsletter", ev.Referrer_NEWSLETTER},
+		{"utm social", "", page + "?utm_medium=Social", ev.Referrer_SOCIAL},
+		{"utm paid search", "https://www.swissinfo.ch/", page + "?utm_medium=cpc", ev.Referrer_SEARCH},
+		{"other utm", "https://www.nzz.ch/", page + "?utm_medium=display", ev.Referrer_EXTERNAL},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := classifyReferrer(tt.referrer, tt.page); got != tt.want {
+				t.Errorf("classifyReferrer(%q, %q) = %v, want %v", tt.referrer, tt.page, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestClassifyDevice(t *testing.T) {
+	tests := []struct {
+		userAgent string
+		want      ev.Device
+	}{
+		{"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Safari/537.36", ev.Device_DESKTOP},
+		{"Mozilla/5.0 (Macintosh; Intel Mac OS X 14.2; rv:121.0) Gecko/20100101 Firefox/121.0", ev.Device_DESKTOP},
+		{"Mozilla/5.0 (X11; Linux x86_64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Safari/537.36", ev.Device_DESKTOP},
+		{"Mozilla/5.0 (iPhone; CPU iPhone OS 17_2 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.2 Mobile/15E148 Safari/604.1", ev.Device_MOBILE},
+		{"Mozilla/5.0 (Linux; Android 14; Pixel 8) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.6099.144 Mobile Safari/537.36", ev.Device_MOBILE},
+		{"Mozilla/5.0 (Android 14; Mobile; rv:121.0) Gecko/121.0 Firefox/121.0", ev.Device_MOBILE},
+		{"Mozilla/5.0 (iPad; CPU OS 17_2 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.2 Mobile/15E148 Safari/604.1", ev.Device_TABLET},
+		{"Mozilla/5.0 (Linux; Android 13; SM-X710) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Safari/537.36", ev.Device_TABLET},
+		{"Mozilla/5.0 (Android 14; Tablet; rv:121.0) Gecko/121.0 Firefox/121.0", ev.Device_TABLET},
+		{"", ev.Device_DESKTOP},
+	}
+	for _, tt := range tests {
+		if got := classifyDevice(tt.userAgent); got != tt.want {
+			t.Errorf("classifyDevice(%q) = %v, want %v", tt.userAgent, got, tt.want)
+		}
+	}
+}
+
+func TestClientAddr(t *testing.T) {
+	tests := []struct {
+		remoteAddr string
+		flyIP      string
+		want       string
+	}{
+		{"192.0.2.1:1234", "", "192.0.2.1"},
+		{"[2001:db8::1]:1234", "", "2001:db8::1"},
+		{"192.0.2.1:1234", "198.51.100.7", "198.51.100.7"},
+		{"192.0.2.1", "", "192.0.2.1"},
+		{"192.0.2.1:1234", "not an ip", ""},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = tt.remoteAddr
+		if tt.flyIP != "" {
+			r.Header.Set("Fly-Client-IP", tt.flyIP)
+		}
+		addr, ok := clientAddr(r)
+		if got := addr.String(); ok != (tt.want != "") || ok && got != tt.want {
+			t.Errorf("clientAddr(%s, %q) = %s, %v, want %q", tt.remoteAddr, tt.flyIP, got, ok, tt.want)
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package app
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/swissinfo-ch/zoe/ev"
+)
+
+// dailySalt is a random salt that is replaced every UTC day.
+// It is only kept in memory, so yesterday's hashes can't be recomputed.
+type dailySalt struct {
+	mu   sync.Mutex
+	day  string
+	salt []byte
+}
+
+// ParseConsent parses a consent level, one of none, anonymous or full.
+func ParseConsent(s string) (ev.Consent, error) {
+	consent, ok := ev.Consent_value[strings.ToUpper(s)]
+	if !ok {
+		return ev.Consent_FULL, fmt.Errorf("invalid consent %q, must be one of none, anonymous or full", s)
+	}
+	return ev.Consent(consent), nil
+}
+
+// requestConsent returns the consent level of a request, from the CONSENT header.
+// DNT & Sec-GPC are honoured by limiting consent to anonymous.
+func (a *App) requestConsent(r *http.Request) (ev.Consent, error) {
+	consent := a.defaultConsent
+	if header := r.Header.Get("CONSENT"); header != "" {
+		var err error
+		consent, err = ParseConsent(header)
+		if err != nil {
+			return consent, err
+		}
+	}
+	if consent == ev.Consent_FULL && (r.Header.Get("DNT") == "1" || r.Header.Get("Sec-GPC") == "1") {
+		consent = ev.Consent_ANONYMOUS
+	}
+	return consent, nil
+}
+
+// applyConsent removes what the reader did not consent to from the event.
+func (a *App) applyConsent(e *ev.Ev, consent ev.Consent) {
+	e.Consent = consent
+	switch consent {
+	case ev.Consent_ANONYMOUS:
+		e.Usr = a.salt.hash(e.Sess, time.Now())
+	case ev.Consent_NONE:
+		e.Usr = 0
+		e.Sess = 0
+	}
+}
+
+// hash returns a salted hash of the value, using the salt of the day of t.
+func (s *dailySalt) hash(value uint32, t time.Time) uint32 {
+	s.mu.Lock()
+	day := t.UTC().Format(time.DateOnly)
+	if day != s.day {
+		s.salt = make([]byte, 32)
+		if _, err := rand.Read(s.salt); err != nil {
+			panic(fmt.Sprintf("failed to generate salt: %v", err))
+		}
+		s.day = day
+	}
+	mac := hmac.New(sha256.New, s.salt)
+	s.mu.Unlock()
+	valueBytes := make([]byte, 4)
+	binary.BigEndian.PutUint32(valueBytes, value)
+	mac.Write(valueBytes)
+	return binary.BigEndian.Uint32(mac.Sum(nil))
+}
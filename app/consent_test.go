@@ -0,0 +1,108 @@
+package app
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/swissinfo-ch/zoe/ev"
+)
+
+func TestDailySalt(t *testing.T) {
+	s := &dailySalt{}
+	beforeMidnight := time.Date(2026, 10, 19, 23, 59, 59, 0, time.UTC)
+	midnight := beforeMidnight.Add(time.Second)
+	h := s.hash(42, beforeMidnight)
+	if s.hash(42, beforeMidnight.Add(-23*time.Hour)) != h {
+		t.Error("hash changed within a UTC day")
+	}
+	// the local day in Zurich starts before the UTC day
+	zurich := time.FixedZone("CEST", 2*60*60)
+	if s.hash(42, time.Date(2026, 10, 20, 0, 30, 0, 0, zurich)) != h {
+		t.Error("hash changed at local midnight")
+	}
+	if s.hash(43, beforeMidnight) == h {
+		t.Error("hashes of different values are equal")
+	}
+	next := s.hash(42, midnight)
+	if next == h {
+		t.Error("hash did not change at UTC midnight")
+	}
+	if s.hash(42, midnight.Add(time.Hour)) != next {
+		t.Error("hash changed within the next UTC day")
+	}
+	// the salt of yesterday is not kept
+	if s.hash(42, beforeMidnight) == h {
+		t.Error("hash of yesterday was recomputed")
+	}
+	if (&dailySalt{}).hash(42, midnight) == next {
+		t.Error("salts of different instances are equal")
+	}
+}
+
+func TestRequestConsent(t *testing.T) {
+	tests := []struct {
+		name           string
+		defaultConsent ev.Consent
+		headers        map[string]string
+		want           ev.Consent
+		invalid        bool
+	}{
+		{"default", ev.Consent_FULL, nil, ev.Consent_FULL, false},
+		{"default anonymous", ev.Consent_ANONYMOUS, nil, ev.Consent_ANONYMOUS, false},
+		{"header", ev.Consent_FULL, map[string]string{"CONSENT": "none"}, ev.Consent_NONE, false},
+		{"header upper-case", ev.Consent_NONE, map[string]string{"CONSENT": "FULL"}, ev.Consent_FULL, false},
+		{"invalid header", ev.Consent_FULL, map[string]string{"CONSENT": "yes"}, ev.Consent_FULL, true},
+		{"DNT", ev.Consent_FULL, map[string]string{"DNT": "1"}, ev.Consent_ANONYMOUS, false},
+		{"DNT over full consent", ev.Consent_NONE, map[string]string{"CONSENT": "full", "DNT": "1"}, ev.Consent_ANONYMOUS, false},
+		{"DNT 0", ev.Consent_FULL, map[string]string{"DNT": "0"}, ev.Consent_FULL, false},
+		{"GPC", ev.Consent_FULL, map[string]string{"Sec-GPC": "1"}, ev.Consent_ANONYMOUS, false},
+		{"GPC over full consent", ev.Consent_FULL, map[string]string{"CONSENT": "full", "Sec-GPC": "1"}, ev.Consent_ANONYMOUS, false},
+		{"DNT & none", ev.Consent_FULL, map[string]string{"CONSENT": "none", "DNT": "1"}, ev.Consent_NONE, false},
+		{"GPC & default none", ev.Consent_NONE, map[string]string{"Sec-GPC": "1"}, ev.Consent_NONE, false},
+		{"DNT & anonymous", ev.Consent_FULL, map[string]string{"CONSENT": "anonymous", "DNT": "1"}, ev.Consent_ANONYMOUS, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := &App{defaultConsent: tt.defaultConsent}
+			r := httptest.NewRequest("POST", "/", nil)
+			for key, value := range tt.headers {
+				r.Header.Set(key, value)
+			}
+			got, err := a.requestConsent(r)
+			if tt.invalid {
+				if err == nil {
+					t.Error("got no error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestApplyConsent(t *testing.T) {
+	a := &App{}
+	anonymous := a.salt.hash(2, time.Now())
+	tests := []struct {
+		consent   ev.Consent
+		usr, sess uint32
+	}{
+		{ev.Consent_FULL, 1, 2},
+		{ev.Consent_ANONYMOUS, anonymous, 2},
+		{ev.Consent_NONE, 0, 0},
+	}
+	for _, tt := range tests {
+		e := &ev.Ev{EvType: ev.EvType_LOAD, Usr: 1, Sess: 2, Cid: 3}
+		a.applyConsent(e, tt.consent)
+		if e.Usr != tt.usr || e.Sess != tt.sess || e.Cid != 3 || e.Consent != tt.consent {
+			t.Errorf("%v: got usr %d, sess %d, cid %d & consent %v, want %d, %d, 3 & %v",
+				tt.consent, e.Usr, e.Sess, e.Cid, e.Consent, tt.usr, tt.sess, tt.consent)
+		}
+	}
+}
@@ -0,0 +1,218 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/swissinfo-ch/zoe/codec"
+	"github.com/swissinfo-ch/zoe/ev"
+	"github.com/swissinfo-ch/zoe/report"
+)
+
+type EraseCfg struct {
+	Ctx         context.Context // optional, cancels the erasure before the file is replaced
+	Filename    string
+	Usrs        []uint32
+	DryRun      bool        // only count the events that would be removed
+	Layout      ev.Layout   // layout of the blocks rewritten
+	Codec       codec.Codec // codec of the blocks rewritten, gzip if nil
+	Ref         string      // reference of the request, eg. a ticket id, for the audit log
+	RequestedBy string      // who requested the erasure, for the audit log
+	lock        sync.Locker // held by the writer while appending a block, nil when offline
+	pending     *ev.Block   // events not yet written, guarded by lock
+}
+
+// EraseResult is a JSON-serializable summary of an erasure.
+type EraseResult struct {
+	Filename        string `json:"filename"`
+	EventsRemoved   int    `json:"eventsRemoved"`
+	BlocksRewritten int    `json:"blocksRewritten"`
+	DryRun          bool   `json:"dryRun"`
+}
+
+// erasureAudit is an entry of the audit log. User ids are not logged.
+type erasureAudit struct {
+	Time        string `json:"time"`
+	Ref         string `json:"ref,omitempty"`
+	RequestedBy string `json:"requestedBy"`
+	Usrs        int    `json:"usrs"` // number of user ids
+	Error       string `json:"error,omitempty"`
+	*EraseResult
+}
+
+// Erase removes all events of the given users from an events file.
+// Only blocks containing their events are rewritten, the others are copied as they are.
+// Erasures are logged to the file's audit log, named <filename>.erasures,
+// including those that failed, which leave the file as it was.
+func Erase(cfg *EraseCfg) (*EraseResult, error) {
+	ctx := cfg.Ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	usrs := make(map[uint32]bool, len(cfg.Usrs))
+	for _, usr := range cfg.Usrs {
+		usrs[usr] = true
+	}
+	keep := func(e *ev.Ev) bool {
+		return !usrs[e.Usr]
+	}
+	lock := cfg.lock
+	if lock == nil {
+		lock = &sync.Mutex{}
+	}
+	c := cfg.Codec
+	if c == nil {
+		c = codec.Gzip
+	}
+	res := &EraseResult{
+		Filename: cfg.Filename,
+		DryRun:   cfg.DryRun,
+	}
+
+	if cfg.DryRun {
+		if err := countErasure(cfg.Filename, keep, res); err != nil {
+			return nil, err
+		}
+		lock.Lock()
+		if cfg.pending != nil {
+			for _, e := range cfg.pending.Evs {
+				if !keep(e) {
+					res.EventsRemoved++
+				}
+			}
+		}
+		lock.Unlock()
+		return res, nil
+	}
+
+	err := rewriteFile(cfg.Filename, lock, func(src io.ReaderAt, start, end int64, dst io.Writer, final bool) error {
+		refs, err := blockRefs(src, start, end)
+		if err != nil {
+			return err
+		}
+		for _, ref := range refs {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			raw, err := readRawBlock(src, ref)
+			if err != nil {
+				return err
+			}
+			block, err := raw.Decode()
+			if err != nil {
+				return err
+			}
+			kept := filterEvs(block.Evs, keep)
+			if len(kept) == len(block.Evs) {
+				if err := writeRawBlock(raw, dst); err != nil {
+					return err
+				}
+				continue
+			}
+			res.EventsRemoved += len(block.Evs) - len(kept)
+			res.BlocksRewritten++
+			if len(kept) == 0 {
+				continue
+			}
+			if _, err := writeBlock(&ev.Block{Evs: kept}, cfg.Layout, c, dst); err != nil {
+				return err
+			}
+		}
+		if final && cfg.pending != nil {
+			kept := filterEvs(cfg.pending.Evs, keep)
+			res.EventsRemoved += len(cfg.pending.Evs) - len(kept)
+			cfg.pending.Evs = kept
+		}
+		return nil
+	})
+	if err != nil {
+		err = fmt.Errorf("failed to erase events: %w", err)
+		// nothing was removed, as the file was not replaced
+		failed := &EraseResult{Filename: cfg.Filename}
+		if auditErr := auditErasure(cfg, failed, err); auditErr != nil {
+			return nil, errors.Join(err, auditErr)
+		}
+		return nil, err
+	}
+
+	if err := auditErasure(cfg, res, nil); err != nil {
+		return res, err
+	}
+	return res, nil
+}
+
+// countErasure counts the events that would be removed.
+func countErasure(filename string, keep func(*ev.Ev) bool, res *EraseResult) error {
+	file, err := os.Open(filename)
+	if err != nil {
+		return fmt.Errorf("failed to open file for reading: %w", err)
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to stat file: %w", err)
+	}
+	br := report.NewBlockReader(file, info.Size())
+	for {
+		raw, err := br.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		block, err := raw.Decode()
+		if err != nil {
+			return err
+		}
+		removed := len(block.Evs) - len(filterEvs(block.Evs, keep))
+		if removed > 0 {
+			res.EventsRemoved += removed
+			res.BlocksRewritten++
+		}
+	}
+}
+
+// filterEvs returns a new slice of the events to keep.
+func filterEvs(evs []*ev.Ev, keep func(*ev.Ev) bool) []*ev.Ev {
+	kept := make([]*ev.Ev, 0, len(evs))
+	for _, e := range evs {
+		if keep(e) {
+			kept = append(kept, e)
+		}
+	}
+	return kept
+}
+
+// auditErasure appends an entry to the audit log of the file, with the error of a failed erasure.
+func auditErasure(cfg *EraseCfg, res *EraseResult, erasureErr error) error {
+	file, err := os.OpenFile(cfg.Filename+".erasures", os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open audit log: %w", err)
+	}
+	defer file.Close()
+	entry := &erasureAudit{
+		Time:        time.Now().UTC().Format(time.RFC3339),
+		Ref:         cfg.Ref,
+		RequestedBy: cfg.RequestedBy,
+		Usrs:        len(cfg.Usrs),
+		EraseResult: res,
+	}
+	if erasureErr != nil {
+		entry.Error = erasureErr.Error()
+	}
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("failed to marshal audit log entry: %w", err)
+	}
+	if _, err := file.Write(append(data, '\n')); err != nil {
+		return fmt.Errorf("failed to write audit log: %w", err)
+	}
+	return nil
+}
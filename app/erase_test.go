@@ -0,0 +1,289 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/swissinfo-ch/zoe/codec"
+	"github.com/swissinfo-ch/zoe/ev"
+	"github.com/swissinfo-ch/zoe/report"
+)
+
+// testEvs returns events of the given users, a second apart from start
+func testEvs(start uint32, usrs ...uint32) []*ev.Ev {
+	evs := make([]*ev.Ev, 0, len(usrs))
+	for i, usr := range usrs {
+		evs = append(evs, &ev.Ev{
+			Time:   start + uint32(i),
+			EvType: ev.EvType_LOAD,
+			Usr:    usr,
+			Cid:    uint32(i % 3),
+		})
+	}
+	return evs
+}
+
+// writeTestFile writes blocks of events & their index, as the writer does
+func writeTestFile(t *testing.T, filename string, blocks ...[]*ev.Ev) {
+	t.Helper()
+	for i, evs := range blocks {
+		layout := ev.LayoutRow
+		if i%2 == 1 {
+			layout = ev.LayoutColumnar
+		}
+		entry, err := appendBlock(filename, &ev.Block{Evs: evs}, layout, codec.Gzip)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := report.AppendIndex(filename, entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// readTestFile returns the events of a file, oldest first
+func readTestFile(t *testing.T, filename string) []*ev.Ev {
+	t.Helper()
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blocks := make([][]*ev.Ev, 0)
+	br := report.NewBlockReader(bytes.NewReader(data), int64(len(data)))
+	for {
+		raw, err := br.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		block, err := raw.Decode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		blocks = append(blocks, block.Evs)
+	}
+	evs := make([]*ev.Ev, 0)
+	for i := len(blocks) - 1; i >= 0; i-- {
+		evs = append(evs, blocks[i]...)
+	}
+	return evs
+}
+
+// checkIndex fails unless the index of a file has an entry for each of its blocks
+func checkIndex(t *testing.T, filename string, blocks int) {
+	t.Helper()
+	file, err := os.Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	scanned, err := report.ScanIndex(file, 0, info.Size())
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := report.ReadIndex(filename, file, info.Size())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(scanned) != blocks {
+		t.Fatalf("file has %d blocks, want %d", len(scanned), blocks)
+	}
+	if !reflect.DeepEqual(entries, scanned) {
+		t.Fatalf("index %+v does not match the file %+v", entries, scanned)
+	}
+}
+
+func usrsOf(evs []*ev.Ev) []uint32 {
+	usrs := make([]uint32, 0, len(evs))
+	for _, e := range evs {
+		usrs = append(usrs, e.Usr)
+	}
+	return usrs
+}
+
+func TestEraseDryRun(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "events")
+	writeTestFile(t, filename,
+		testEvs(100, 1, 2, 3, 1),
+		testEvs(200, 2, 3, 4),
+		testEvs(300, 1, 1, 1))
+	before, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pending := &ev.Block{Evs: testEvs(400, 1, 5)}
+	res, err := Erase(&EraseCfg{
+		Filename: filename,
+		Usrs:     []uint32{1},
+		DryRun:   true,
+		lock:     &sync.Mutex{},
+		pending:  pending,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.EventsRemoved != 6 || res.BlocksRewritten != 2 || !res.DryRun {
+		t.Errorf("got %+v, want 6 events of 2 blocks", res)
+	}
+	after, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(before, after) {
+		t.Error("dry run modified the file")
+	}
+	if len(pending.Evs) != 2 {
+		t.Errorf("dry run modified the pending block: %v", usrsOf(pending.Evs))
+	}
+	if _, err := os.Stat(filename + ".erasures"); !os.IsNotExist(err) {
+		t.Errorf("dry run was audited: %v", err)
+	}
+}
+
+func TestErase(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "events")
+	writeTestFile(t, filename,
+		testEvs(100, 1, 2, 3, 1),
+		testEvs(200, 2, 3, 4),
+		testEvs(300, 1, 1, 1),
+		testEvs(400, 5, 1))
+	pending := &ev.Block{Evs: testEvs(500, 1, 6, 1)}
+	res, err := Erase(&EraseCfg{
+		Filename:    filename,
+		Usrs:        []uint32{1},
+		Ref:         "ticket-1",
+		RequestedBy: "test",
+		Layout:      ev.LayoutColumnar,
+		Codec:       codec.Zstd,
+		lock:        &sync.Mutex{},
+		pending:     pending,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.EventsRemoved != 8 || res.BlocksRewritten != 3 {
+		t.Errorf("got %+v, want 8 events of 3 blocks", res)
+	}
+	got := usrsOf(readTestFile(t, filename))
+	want := []uint32{2, 3, 2, 3, 4, 5}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("file has events of %v, want %v", got, want)
+	}
+	if got := usrsOf(pending.Evs); !reflect.DeepEqual(got, []uint32{6}) {
+		t.Errorf("pending block has events of %v, want [6]", got)
+	}
+	// the block erased entirely is dropped
+	checkIndex(t, filename, 3)
+
+	data, err := os.ReadFile(filename + ".erasures")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Count(data, []byte{'\n'}) != 1 {
+		t.Fatalf("audit log has %q, want one entry", data)
+	}
+	audit := &erasureAudit{}
+	if err := json.Unmarshal(data, audit); err != nil {
+		t.Fatal(err)
+	}
+	if audit.Ref != "ticket-1" || audit.RequestedBy != "test" || audit.Usrs != 1 ||
+		audit.EventsRemoved != 8 || audit.Error != "" {
+		t.Errorf("unexpected audit entry %s", data)
+	}
+}
+
+func TestEraseCancelled(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "events")
+	writeTestFile(t, filename, testEvs(100, 1, 2), testEvs(200, 1, 3))
+	before, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = Erase(&EraseCfg{
+		Ctx:      ctx,
+		Filename: filename,
+		Usrs:     []uint32{1},
+	})
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("got error %v, want %v", err, context.Canceled)
+	}
+	after, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(before, after) {
+		t.Error("cancelled erasure modified the file")
+	}
+	data, err := os.ReadFile(filename + ".erasures")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), `"error":"failed to erase events: context canceled"`) ||
+		!strings.Contains(string(data), `"eventsRemoved":0`) {
+		t.Errorf("audit log has %s, want the failure", data)
+	}
+}
+
+// TestRewriteFileAppended rewrites a file while a block is appended,
+// so that the final call gets the appended block, & the index is rebuilt.
+func TestRewriteFileAppended(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "events")
+	writeTestFile(t, filename, testEvs(100, 1, 2), testEvs(200, 3, 4), testEvs(300, 5))
+	calls := 0
+	err := rewriteFile(filename, &sync.Mutex{}, func(src io.ReaderAt, start, end int64, dst io.Writer, final bool) error {
+		calls++
+		if final != (calls == 2) {
+			t.Errorf("call %d has final %v", calls, final)
+		}
+		refs, err := blockRefs(src, start, end)
+		if err != nil {
+			return err
+		}
+		if !final {
+			// drop the oldest block, so that the offsets of the others change
+			refs = refs[1:]
+			writeTestFile(t, filename, testEvs(400, 6, 7))
+		}
+		for _, ref := range refs {
+			raw, err := readRawBlock(src, ref)
+			if err != nil {
+				return err
+			}
+			if err := writeRawBlock(raw, dst); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if calls != 2 {
+		t.Errorf("write was called %d times, want 2", calls)
+	}
+	got := usrsOf(readTestFile(t, filename))
+	if want := []uint32{3, 4, 5, 6, 7}; !reflect.DeepEqual(got, want) {
+		t.Errorf("file has events of %v, want %v", got, want)
+	}
+	checkIndex(t, filename, 3)
+	if _, err := os.Stat(filename + ".rewrite"); !os.IsNotExist(err) {
+		t.Errorf("temporary file was not removed: %v", err)
+	}
+}
@@ -0,0 +1,257 @@
+package app
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/swissinfo-ch/zoe/ev"
+	"github.com/swissinfo-ch/zoe/report"
+)
+
+// maxConcurrentExports limits the number of exports streaming at once
+const maxConcurrentExports = 2
+
+// ExportFilter selects the events of an export or a dump.
+type ExportFilter struct {
+	from    uint32 // inclusive
+	to      uint32 // exclusive
+	types   map[string]bool
+	cids    map[uint32]bool
+	evTypes *ev.Registry
+}
+
+// ErrStopWalk is returned by the func of WalkEvents to stop the walk without error.
+var ErrStopWalk = errors.New("stop walk")
+
+// handleExport is the HTTP handler for the GET /export endpoint.
+// It streams the events of a property, newest first, from the blocks on disk.
+// Events not yet written to a block are not exported.
+func (a *App) handleExport(w http.ResponseWriter, r *http.Request) {
+	if !a.authorizedExport(r) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if !a.getExportLimiter(r).Allow() {
+		http.Error(w, "too many exports, try again later", http.StatusTooManyRequests)
+		return
+	}
+	select {
+	case a.exportSlots <- struct{}{}:
+		defer func() { <-a.exportSlots }()
+	default:
+		http.Error(w, "too many concurrent exports, try again later", http.StatusTooManyRequests)
+		return
+	}
+	p, err := a.resolveProperty(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	q := r.URL.Query()
+	filter, err := ParseExportFilter(q, a.evTypes)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	format := q.Get("format")
+	if format == "" {
+		format = "ndjson"
+	}
+	if format != "ndjson" && format != "csv" {
+		http.Error(w, "invalid format, must be one of ndjson or csv", http.StatusBadRequest)
+		return
+	}
+
+	file, err := os.Open(p.filename)
+	if err != nil {
+		http.Error(w, "failed to open events file", http.StatusInternalServerError)
+		return
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		http.Error(w, "failed to stat events file", http.StatusInternalServerError)
+		return
+	}
+
+	bw := bufio.NewWriter(w)
+	var writeEv func(*ev.Ev) error
+	flush := bw.Flush
+	switch format {
+	case "ndjson":
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		enc := json.NewEncoder(bw)
+		writeEv = func(e *ev.Ev) error {
+			return enc.Encode(NewRecord(e, a.evTypes))
+		}
+	case "csv":
+		w.Header().Set("Content-Type", "text/csv")
+		cw := csv.NewWriter(bw)
+		if err := cw.Write(csvHeader); err != nil {
+			return
+		}
+		writeEv = func(e *ev.Ev) error {
+			return cw.Write(NewRecord(e, a.evTypes).CSV())
+		}
+		// rows are flushed per block, like the NDJSON lines
+		flush = func() error {
+			cw.Flush()
+			if err := cw.Error(); err != nil {
+				return err
+			}
+			return bw.Flush()
+		}
+	}
+	flusher, _ := w.(http.Flusher)
+
+	err = WalkEvents(p.filename, file, info.Size(), filter, func(evs []*ev.Ev) error {
+		// stop when the client disconnects
+		if err := r.Context().Err(); err != nil {
+			return err
+		}
+		for _, e := range evs {
+			if err := writeEv(e); err != nil {
+				return err
+			}
+		}
+		if err := flush(); err != nil {
+			return err
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+		return nil
+	})
+	if err != nil && r.Context().Err() == nil {
+		// headers are sent, so the error can only end the stream
+		fmt.Println("\nexport stopped:", err)
+	}
+	if err != nil && !errors.Is(err, report.ErrCorrupt) {
+		return
+	}
+	flush()
+}
+
+// authorizedExport returns true if the request carries the export token.
+// The export endpoint is disabled when no token is configured.
+func (a *App) authorizedExport(r *http.Request) bool {
+	if a.exportToken == "" {
+		return false
+	}
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return ok && subtle.ConstantTimeCompare([]byte(token), []byte(a.exportToken)) == 1
+}
+
+// ParseExportFilter parses the from, to, type & cid query parameters.
+// Times are Unix timestamps or RFC3339, types & cids are comma-separated lists,
+// & types are case-insensitive, like the TYPE header.
+func ParseExportFilter(q url.Values, evTypes *ev.Registry) (*ExportFilter, error) {
+	f := &ExportFilter{
+		to:      ^uint32(0),
+		evTypes: evTypes,
+	}
+	if s := q.Get("from"); s != "" {
+		t, err := parseEvTime(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid from: %w", err)
+		}
+		f.from = t
+	}
+	if s := q.Get("to"); s != "" {
+		t, err := parseEvTime(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid to: %w", err)
+		}
+		f.to = t
+	}
+	if s := q.Get("type"); s != "" {
+		f.types = make(map[string]bool)
+		for _, name := range strings.Split(s, ",") {
+			name = strings.ToUpper(strings.TrimSpace(name))
+			_, builtin := ev.EvType_value[name]
+			_, custom := evTypes.ID(name)
+			if !builtin && !custom {
+				return nil, fmt.Errorf("invalid type %s", name)
+			}
+			f.types[name] = true
+		}
+	}
+	if s := q.Get("cid"); s != "" {
+		f.cids = make(map[uint32]bool)
+		for _, cidStr := range strings.Split(s, ",") {
+			cid, err := strconv.ParseUint(cidStr, 10, 32)
+			if err != nil {
+				return nil, fmt.Errorf("err to parse uint32 cid %q: %w", cidStr, err)
+			}
+			f.cids[uint32(cid)] = true
+		}
+	}
+	return f, nil
+}
+
+// Match returns true if the event is selected by the filter.
+func (f *ExportFilter) Match(e *ev.Ev) bool {
+	if e.Time < f.from || e.Time >= f.to {
+		return false
+	}
+	if f.cids != nil && !f.cids[e.Cid] {
+		return false
+	}
+	if f.types != nil && !f.types[f.evTypes.TypeName(e)] {
+		return false
+	}
+	return true
+}
+
+// WalkEvents calls fn with the events of each block of an events file that match
+// the filter, possibly none, newest first, from the newest block in the range of the filter,
+// found in the index of the file. As blocks are ordered by time, the walk stops
+// at the first block older than the filter, or when fn returns ErrStopWalk.
+func WalkEvents(filename string, file io.ReaderAt, size int64, f *ExportFilter, fn func(evs []*ev.Ev) error) error {
+	index, err := report.ReadIndex(filename, file, size)
+	if err != nil {
+		return err
+	}
+	start, end := report.SeekRange(index, size, f.from, f.to)
+	br := report.NewBlockRangeReader(file, start, end)
+	matched := make([]*ev.Ev, 0)
+	for {
+		raw, err := br.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		block, err := raw.Decode()
+		if err != nil {
+			return err
+		}
+		evs := block.GetEvs()
+		if len(evs) > 0 && evs[len(evs)-1].Time < f.from {
+			// blocks are ordered by time, so all older blocks are out of range
+			return nil
+		}
+		matched = matched[:0]
+		for i := len(evs) - 1; i >= 0; i-- {
+			if f.Match(evs[i]) {
+				matched = append(matched, evs[i])
+			}
+		}
+		if err := fn(matched); err == ErrStopWalk {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+}
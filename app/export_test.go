@@ -0,0 +1,143 @@
+package app
+
+import (
+	"encoding/csv"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/swissinfo-ch/zoe/ev"
+	"github.com/swissinfo-ch/zoe/report"
+)
+
+// walkTestFile walks the events of a file, returning their users & the blocks walked
+func walkTestFile(t *testing.T, filename string, query string) ([]uint32, int) {
+	t.Helper()
+	q, err := url.ParseQuery(query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	filter, err := ParseExportFilter(q, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file, err := os.Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	usrs, blocks := make([]uint32, 0), 0
+	err = WalkEvents(filename, file, info.Size(), filter, func(evs []*ev.Ev) error {
+		blocks++
+		usrs = append(usrs, usrsOf(evs)...)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return usrs, blocks
+}
+
+func TestWalkEvents(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "events")
+	writeTestFile(t, filename,
+		testEvs(100, 1, 2, 3),
+		testEvs(200, 4, 5, 6),
+		testEvs(300, 7, 8, 9),
+		testEvs(400, 10, 11, 12))
+	tests := []struct {
+		query  string
+		usrs   []uint32
+		blocks int
+	}{
+		{"", []uint32{12, 11, 10, 9, 8, 7, 6, 5, 4, 3, 2, 1}, 4},
+		{"from=201&to=302", []uint32{8, 7, 6, 5}, 2},
+		{"from=300", []uint32{12, 11, 10, 9, 8, 7}, 2},
+		{"to=200", []uint32{3, 2, 1}, 1},
+		{"from=150&to=199", []uint32{}, 0},
+		{"from=500", []uint32{}, 0},
+		{"from=100&to=400&cid=0", []uint32{7, 4, 1}, 3},
+	}
+	for _, tt := range tests {
+		usrs, blocks := walkTestFile(t, filename, tt.query)
+		if !reflect.DeepEqual(usrs, tt.usrs) || blocks != tt.blocks {
+			t.Errorf("%q walked %v in %d blocks, want %v in %d", tt.query, usrs, blocks, tt.usrs, tt.blocks)
+		}
+	}
+
+	// without an index, or with one that is stale, the file is scanned from its end
+	if err := os.Remove(report.IndexFilename(filename)); err != nil {
+		t.Fatal(err)
+	}
+	if usrs, blocks := walkTestFile(t, filename, "from=201&to=302"); !reflect.DeepEqual(usrs, []uint32{8, 7, 6, 5}) || blocks != 3 {
+		t.Errorf("walked %v in %d blocks without an index, want [8 7 6 5] in 3", usrs, blocks)
+	}
+	if err := os.WriteFile(report.IndexFilename(filename), []byte("stale"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if usrs, _ := walkTestFile(t, filename, "from=201&to=302"); !reflect.DeepEqual(usrs, []uint32{8, 7, 6, 5}) {
+		t.Errorf("walked %v with a stale index, want [8 7 6 5]", usrs)
+	}
+}
+
+func TestHandleExport(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "events")
+	writeTestFile(t, filename, testEvs(100, 1, 2, 3), testEvs(200, 4, 5, 6))
+	p := &property{name: "default", filename: filename}
+	a := &App{
+		properties:    map[string]*property{p.name: p},
+		propertyNames: []string{p.name},
+		exportToken:   "token",
+		exportEvery:   time.Hour,
+		exportBurst:   2,
+		exportClients: make(map[string]*client),
+		exportSlots:   make(chan struct{}, maxConcurrentExports),
+	}
+	export := func(query, clientIP string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "/export?"+query, nil)
+		r.Header.Set("Authorization", "Bearer token")
+		r.Header.Set("Fly-Client-IP", clientIP)
+		w := httptest.NewRecorder()
+		a.handleRequest(w, r)
+		return w
+	}
+
+	w := export("format=csv&from=102&to=205", "192.0.2.1")
+	if w.Code != 200 {
+		t.Fatalf("got %d: %s", w.Code, w.Body)
+	}
+	rows, err := csv.NewReader(strings.NewReader(w.Body.String())).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 5 || !reflect.DeepEqual(rows[0], csvHeader) {
+		t.Fatalf("got rows %v, want the header & 4 events", rows)
+	}
+	usrs := make([]string, 0)
+	for _, row := range rows[1:] {
+		usrs = append(usrs, row[2])
+	}
+	if want := []string{"6", "5", "4", "3"}; !reflect.DeepEqual(usrs, want) {
+		t.Errorf("exported users %v, want %v", usrs, want)
+	}
+
+	// exports are limited per client
+	if w := export("", "192.0.2.1"); w.Code != 200 {
+		t.Errorf("second export got %d, want 200", w.Code)
+	}
+	if w := export("", "192.0.2.1"); w.Code != 429 {
+		t.Errorf("third export got %d, want 429", w.Code)
+	}
+	if w := export("", "192.0.2.2"); w.Code != 200 {
+		t.Errorf("export of another client got %d, want 200", w.Code)
+	}
+}
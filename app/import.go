@@ -0,0 +1,436 @@
+package app
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/swissinfo-ch/zoe/codec"
+	"github.com/swissinfo-ch/zoe/ev"
+	"github.com/swissinfo-ch/zoe/report"
+)
+
+// ImportCfg configures an import of events into an events file.
+type ImportCfg struct {
+	Filename  string
+	Src       io.Reader    // events to import, read as a stream unless it is a regular file
+	Format    string       // ndjson, as exported by /export, or zoe, an events file
+	BlockSize int          // number of events per block written
+	Layout    ev.Layout    // layout of the blocks written
+	Codec     codec.Codec  // codec of the blocks written, gzip if nil
+	EvTypes   *ev.Registry // custom event types accepted, may be nil
+	lock      sync.Locker  // held by the writer while appending a block, nil when offline
+}
+
+// ImportResult is a JSON-serializable summary of an import.
+type ImportResult struct {
+	Filename       string `json:"filename"`
+	EventsImported int    `json:"eventsImported"`
+	BlocksWritten  int    `json:"blocksWritten"`
+	BlocksCopied   int    `json:"blocksCopied"`
+}
+
+// ErrUnordered is returned for imports of events that are not ordered by time.
+var ErrUnordered = errors.New("events must be ordered by time, oldest or newest first")
+
+// Import imports events, keeping their original time.
+// Reports rely on blocks being ordered by time, so imported events
+// are merged into the blocks they overlap with. Blocks before are copied
+// as they are, so importing recent events only rewrites the end of the file.
+// Events are validated & spooled to a temporary file in blocks before the merge,
+// so an import of any size is merged a block at a time, & nothing is imported
+// if an event is invalid.
+func Import(cfg *ImportCfg) (*ImportResult, error) {
+	c := cfg.Codec
+	if c == nil {
+		c = codec.Gzip
+	}
+	res := &ImportResult{
+		Filename: cfg.Filename,
+	}
+	src, cleanup, err := spoolImport(cfg, c, res)
+	if err != nil {
+		return nil, err
+	}
+	defer cleanup()
+	if res.EventsImported == 0 {
+		return res, nil
+	}
+	lock := cfg.lock
+	if lock == nil {
+		lock = &sync.Mutex{}
+	}
+	// importing into a new file is allowed
+	file, err := os.OpenFile(cfg.Filename, os.O_CREATE|os.O_RDONLY, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create file: %w", err)
+	}
+	file.Close()
+	m := &blockMerger{
+		src:       src,
+		blockSize: cfg.BlockSize,
+		layout:    cfg.Layout,
+		codec:     c,
+		res:       res,
+	}
+	err = rewriteFile(cfg.Filename, lock, func(src io.ReaderAt, start, end int64, dst io.Writer, final bool) error {
+		refs, err := blockRefs(src, start, end)
+		if err != nil {
+			return err
+		}
+		for _, ref := range refs {
+			raw, err := readRawBlock(src, ref)
+			if err != nil {
+				return err
+			}
+			if err := m.merge(raw, dst); err != nil {
+				return err
+			}
+		}
+		if final {
+			return m.flush(dst)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to import events: %w", err)
+	}
+	return res, nil
+}
+
+// spoolImport validates the events to import & returns them as blocks, oldest first.
+// NDJSON is spooled to a temporary file, in blocks of the events as they come.
+// Events files are read in place if they are regular files, or else spooled as they are.
+// The cleanup func removes the temporary file.
+func spoolImport(cfg *ImportCfg, c codec.Codec, res *ImportResult) (*importSource, func(), error) {
+	if cfg.Format != "ndjson" && cfg.Format != "zoe" {
+		return nil, nil, fmt.Errorf("invalid format %s, must be one of ndjson or zoe", cfg.Format)
+	}
+	cleanup := func() {}
+	if f, ok := cfg.Src.(*os.File); ok && cfg.Format == "zoe" {
+		if info, err := f.Stat(); err == nil && info.Mode().IsRegular() {
+			return readImportBlocks(f, info.Size(), cfg.EvTypes, res, cleanup)
+		}
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(cfg.Filename), filepath.Base(cfg.Filename)+".import-*")
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create temporary file: %w", err)
+	}
+	cleanup = func() {
+		tmp.Close()
+		os.Remove(tmp.Name())
+	}
+	if cfg.Format == "zoe" {
+		size, err := io.Copy(tmp, cfg.Src)
+		if err != nil {
+			cleanup()
+			return nil, nil, fmt.Errorf("failed to read events file: %w", err)
+		}
+		return readImportBlocks(tmp, size, cfg.EvTypes, res, cleanup)
+	}
+	src, err := spoolNDJSON(cfg, c, tmp, res)
+	if err != nil {
+		cleanup()
+		return nil, nil, err
+	}
+	return src, cleanup, nil
+}
+
+// spoolNDJSON decodes & validates NDJSON records, writing them to tmp in blocks.
+// Records must be ordered by time, either way, so that the blocks are too.
+func spoolNDJSON(cfg *ImportCfg, c codec.Codec, tmp *os.File, res *ImportResult) (*importSource, error) {
+	now := uint32(time.Now().Unix())
+	bw := bufio.NewWriter(tmp)
+	dec := json.NewDecoder(cfg.Src)
+	buf := make([]*ev.Ev, 0, cfg.BlockSize)
+	order := 0 // 1 when oldest first, -1 when newest first
+	var prev uint32
+	for {
+		rec := &Record{}
+		err := dec.Decode(rec)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode event %d: %w", res.EventsImported+1, err)
+		}
+		e, err := rec.Ev()
+		if err == nil {
+			err = validateEv(e, cfg.EvTypes, now)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid event %d: %w", res.EventsImported+1, err)
+		}
+		if res.EventsImported > 0 && e.Time != prev {
+			o := 1
+			if e.Time < prev {
+				o = -1
+			}
+			if order != 0 && o != order {
+				return nil, fmt.Errorf("event %d: %w", res.EventsImported+1, ErrUnordered)
+			}
+			order = o
+		}
+		prev = e.Time
+		res.EventsImported++
+		buf = append(buf, e)
+		if len(buf) == cfg.BlockSize {
+			if _, err := writeBlock(&ev.Block{Evs: buf}, cfg.Layout, c, bw); err != nil {
+				return nil, err
+			}
+			buf = buf[:0]
+		}
+	}
+	if len(buf) > 0 {
+		if _, err := writeBlock(&ev.Block{Evs: buf}, cfg.Layout, c, bw); err != nil {
+			return nil, err
+		}
+	}
+	if err := bw.Flush(); err != nil {
+		return nil, fmt.Errorf("failed to write temporary file: %w", err)
+	}
+	size, err := tmp.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return nil, fmt.Errorf("failed to seek temporary file: %w", err)
+	}
+	refs, err := blockRefs(tmp, 0, size)
+	if err != nil {
+		return nil, err
+	}
+	if order < 0 {
+		for i, j := 0, len(refs)-1; i < j; i, j = i+1, j-1 {
+			refs[i], refs[j] = refs[j], refs[i]
+		}
+	}
+	return &importSource{file: tmp, refs: refs}, nil
+}
+
+// readImportBlocks validates the events of an events file, a block at a time.
+// Blocks must be ordered by time, as they are in files written by the app.
+func readImportBlocks(file *os.File, size int64, evTypes *ev.Registry, res *ImportResult, cleanup func()) (*importSource, func(), error) {
+	refs, err := blockRefs(file, 0, size)
+	if err != nil {
+		cleanup()
+		return nil, nil, err
+	}
+	now := uint32(time.Now().Unix())
+	var prevMax uint32
+	for _, ref := range refs {
+		block, err := decodeBlockRef(file, ref)
+		if err != nil {
+			cleanup()
+			return nil, nil, err
+		}
+		blockMax := prevMax
+		for _, e := range block.Evs {
+			if err := validateEv(e, evTypes, now); err != nil {
+				cleanup()
+				return nil, nil, fmt.Errorf("invalid event %d: %w", res.EventsImported+1, err)
+			}
+			if e.Time < prevMax {
+				cleanup()
+				return nil, nil, fmt.Errorf("event %d: %w", res.EventsImported+1, ErrUnordered)
+			}
+			blockMax = max(blockMax, e.Time)
+			res.EventsImported++
+		}
+		prevMax = blockMax
+	}
+	return &importSource{file: file, refs: refs}, cleanup, nil
+}
+
+// decodeBlockRef reads & decodes the block at ref.
+func decodeBlockRef(file io.ReaderAt, ref blockRef) (*ev.Block, error) {
+	raw, err := readRawBlock(file, ref)
+	if err != nil {
+		return nil, err
+	}
+	return raw.Decode()
+}
+
+// importSource yields the events to import oldest first, decoding a block at a time.
+type importSource struct {
+	file io.ReaderAt
+	refs []blockRef // not yet decoded, ordered by time
+	evs  []*ev.Ev   // of the last block decoded, not yet merged, sorted by time
+}
+
+// peek returns the oldest event not yet merged, nil if there are none left.
+func (s *importSource) peek() (*ev.Ev, error) {
+	for len(s.evs) == 0 && len(s.refs) > 0 {
+		block, err := decodeBlockRef(s.file, s.refs[0])
+		if err != nil {
+			return nil, err
+		}
+		s.refs = s.refs[1:]
+		s.evs = block.Evs
+		sort.SliceStable(s.evs, func(i, j int) bool {
+			return s.evs[i].Time < s.evs[j].Time
+		})
+	}
+	if len(s.evs) == 0 {
+		return nil, nil
+	}
+	return s.evs[0], nil
+}
+
+// until appends the events not yet merged up to maxTime to dst.
+func (s *importSource) until(dst []*ev.Ev, maxTime uint32) ([]*ev.Ev, error) {
+	for {
+		e, err := s.peek()
+		if err != nil {
+			return nil, err
+		}
+		if e == nil || e.Time > maxTime {
+			return dst, nil
+		}
+		n := sort.Search(len(s.evs), func(i int) bool {
+			return s.evs[i].Time > maxTime
+		})
+		dst = append(dst, s.evs[:n]...)
+		s.evs = s.evs[n:]
+	}
+}
+
+// blockMerger merges sorted imported events into a sequence of blocks.
+type blockMerger struct {
+	src       *importSource
+	buf       []*ev.Ev // merged events, not yet written
+	blockSize int
+	layout    ev.Layout
+	codec     codec.Codec
+	res       *ImportResult
+}
+
+// merge writes the block, merged with the imported events it overlaps with.
+func (m *blockMerger) merge(raw *report.RawBlock, dst io.Writer) error {
+	next, err := m.src.peek()
+	if err != nil {
+		return err
+	}
+	if next == nil && len(m.buf) == 0 {
+		m.res.BlocksCopied++
+		return writeRawBlock(raw, dst)
+	}
+	block, err := raw.Decode()
+	if err != nil {
+		return err
+	}
+	maxTime := uint32(0)
+	for _, e := range block.Evs {
+		maxTime = max(maxTime, e.Time)
+	}
+	if len(m.buf) == 0 && (next == nil || maxTime <= next.Time) {
+		// the block is older than all imported events
+		m.res.BlocksCopied++
+		return writeRawBlock(raw, dst)
+	}
+	// merge the imported events up to the newest of the block
+	imported, err := m.src.until(nil, maxTime)
+	if err != nil {
+		return err
+	}
+	m.buf = mergeEvs(m.buf, block.Evs, imported)
+	if err := m.writeFull(dst); err != nil {
+		return err
+	}
+	if next, err = m.src.peek(); err != nil {
+		return err
+	}
+	if next == nil && len(m.buf) > 0 {
+		// the rest of the file is copied, so write what is left as a smaller block
+		if err := m.writeBlock(m.buf, dst); err != nil {
+			return err
+		}
+		m.buf = nil
+	}
+	return nil
+}
+
+// flush writes the events left, newer than all blocks.
+func (m *blockMerger) flush(dst io.Writer) error {
+	for {
+		next, err := m.src.peek()
+		if err != nil {
+			return err
+		}
+		if next == nil {
+			break
+		}
+		m.buf = append(m.buf, m.src.evs...)
+		m.src.evs = nil
+		if err := m.writeFull(dst); err != nil {
+			return err
+		}
+	}
+	if len(m.buf) > 0 {
+		if err := m.writeBlock(m.buf, dst); err != nil {
+			return err
+		}
+		m.buf = nil
+	}
+	return nil
+}
+
+// writeFull writes the merged events in full blocks, keeping the rest.
+func (m *blockMerger) writeFull(dst io.Writer) error {
+	for len(m.buf) >= m.blockSize {
+		if err := m.writeBlock(m.buf[:m.blockSize], dst); err != nil {
+			return err
+		}
+		m.buf = m.buf[m.blockSize:]
+	}
+	return nil
+}
+
+func (m *blockMerger) writeBlock(evs []*ev.Ev, dst io.Writer) error {
+	m.res.BlocksWritten++
+	_, err := writeBlock(&ev.Block{Evs: evs}, m.layout, m.codec, dst)
+	return err
+}
+
+// mergeEvs appends the merge of two sorted slices to dst.
+// On equal times, events of a come first.
+func mergeEvs(dst, a, b []*ev.Ev) []*ev.Ev {
+	for len(a) > 0 && len(b) > 0 {
+		if b[0].Time < a[0].Time {
+			dst = append(dst, b[0])
+			b = b[1:]
+		} else {
+			dst = append(dst, a[0])
+			a = a[1:]
+		}
+	}
+	dst = append(dst, a...)
+	return append(dst, b...)
+}
+
+// validateEv returns an error if the event could not have been ingested.
+func validateEv(e *ev.Ev, evTypes *ev.Registry, now uint32) error {
+	if e.Time == 0 {
+		return fmt.Errorf("missing time")
+	}
+	if e.Time > now {
+		return fmt.Errorf("time %d is in the future", e.Time)
+	}
+	switch e.EvType {
+	case ev.EvType_LOAD, ev.EvType_UNLOAD, ev.EvType_TIME:
+	case ev.EvType_CUSTOM:
+		if e.CustomType == nil {
+			return fmt.Errorf("missing customType")
+		}
+		if _, ok := evTypes.ID(evTypes.TypeName(e)); !ok {
+			return fmt.Errorf("custom type %d is not registered", *e.CustomType)
+		}
+	default:
+		return fmt.Errorf("invalid evType %d", e.EvType)
+	}
+	return nil
+}
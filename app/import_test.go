@@ -0,0 +1,225 @@
+package app
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/swissinfo-ch/zoe/codec"
+	"github.com/swissinfo-ch/zoe/ev"
+	"github.com/swissinfo-ch/zoe/report"
+)
+
+// timesOf returns the times of events
+func timesOf(evs []*ev.Ev) []uint32 {
+	times := make([]uint32, 0, len(evs))
+	for _, e := range evs {
+		times = append(times, e.Time)
+	}
+	return times
+}
+
+// ndjson returns the records of events, one per line
+func ndjson(t *testing.T, evs []*ev.Ev) []byte {
+	t.Helper()
+	buf := &bytes.Buffer{}
+	enc := json.NewEncoder(buf)
+	for _, e := range evs {
+		if err := enc.Encode(NewRecord(e, nil)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return buf.Bytes()
+}
+
+// importEvs returns loads of users 1000 & up, at the given times
+func importEvs(times ...uint32) []*ev.Ev {
+	evs := make([]*ev.Ev, 0, len(times))
+	for i, time := range times {
+		evs = append(evs, &ev.Ev{Time: time, EvType: ev.EvType_LOAD, Usr: 1000 + uint32(i)})
+	}
+	return evs
+}
+
+// writeImportTestFile writes blocks of [100, 103], [200, 202] & [300, 302],
+// in row & columnar layouts, with gzip & zstd
+func writeImportTestFile(t *testing.T, filename string) {
+	t.Helper()
+	writeTestFile(t, filename, testEvs(100, 1, 2, 3, 4), testEvs(200, 5, 6, 7))
+	entry, err := appendBlock(filename, &ev.Block{Evs: testEvs(300, 8, 9, 10)}, ev.LayoutRow, codec.Zstd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := report.AppendIndex(filename, entry); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMergeEvs(t *testing.T) {
+	tests := []struct {
+		name       string
+		dst, a, b  []*ev.Ev
+		wantTimes  []uint32
+		wantUsrsAt map[int]uint32 // index -> usr, for events of equal times
+	}{
+		{"empty", nil, nil, nil, []uint32{}, nil},
+		{"only a", nil, testEvs(1, 1, 2), nil, []uint32{1, 2}, nil},
+		{"only b", nil, nil, importEvs(1, 2), []uint32{1, 2}, nil},
+		{"interleaved", nil, testEvs(2, 1, 2, 3), importEvs(1, 3, 5),
+			[]uint32{1, 2, 3, 3, 4, 5}, map[int]uint32{2: 2, 3: 1001}},
+		{"a before b", nil, testEvs(1, 1, 2), importEvs(5, 6), []uint32{1, 2, 5, 6}, nil},
+		{"b before a", nil, testEvs(5, 1, 2), importEvs(1, 2), []uint32{1, 2, 5, 6}, nil},
+		{"duplicates", nil, testEvs(1, 1, 2), importEvs(1, 2),
+			[]uint32{1, 1, 2, 2}, map[int]uint32{0: 1, 1: 1000, 2: 2, 3: 1001}},
+		{"appended to dst", testEvs(0, 7), testEvs(1, 1), importEvs(1), []uint32{0, 1, 1}, map[int]uint32{0: 7, 1: 1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := mergeEvs(tt.dst, tt.a, tt.b)
+			if !reflect.DeepEqual(timesOf(got), tt.wantTimes) {
+				t.Errorf("got times %v, want %v", timesOf(got), tt.wantTimes)
+			}
+			for i, usr := range tt.wantUsrsAt {
+				if got[i].Usr != usr {
+					t.Errorf("event %d is of usr %d, want %d", i, got[i].Usr, usr)
+				}
+			}
+		})
+	}
+}
+
+func TestImport(t *testing.T) {
+	tests := []struct {
+		name          string
+		imported      []*ev.Ev
+		newestFirst   bool
+		blocksWritten int
+		blocksCopied  int
+	}{
+		// merged into every block, with events of the same times as events of the file
+		{"interleaved", importEvs(50, 101, 150, 201, 250, 400, 401), false, 6, 0},
+		{"interleaved newest first", importEvs(50, 101, 150, 201, 250, 400, 401), true, 6, 0},
+		// merged into the first block, the others are copied as they are
+		{"older", importEvs(50, 51), false, 2, 2},
+		// appended after the copied blocks
+		{"newer", importEvs(400, 401, 402, 403), false, 2, 3},
+		{"none", nil, false, 0, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			filename := filepath.Join(t.TempDir(), "events")
+			writeImportTestFile(t, filename)
+			before := readTestFile(t, filename)
+			src := make([]*ev.Ev, len(tt.imported))
+			copy(src, tt.imported)
+			if tt.newestFirst {
+				for i, j := 0, len(src)-1; i < j; i, j = i+1, j-1 {
+					src[i], src[j] = src[j], src[i]
+				}
+			}
+			res, err := Import(&ImportCfg{
+				Filename:  filename,
+				Src:       bytes.NewReader(ndjson(t, src)),
+				Format:    "ndjson",
+				BlockSize: 3,
+				Layout:    ev.LayoutColumnar,
+				Codec:     codec.Zstd,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if res.EventsImported != len(tt.imported) || res.BlocksWritten != tt.blocksWritten ||
+				res.BlocksCopied != tt.blocksCopied {
+				t.Errorf("got %+v, want %d events, %d blocks written & %d copied",
+					res, len(tt.imported), tt.blocksWritten, tt.blocksCopied)
+			}
+			got := readTestFile(t, filename)
+			want := mergeEvs(nil, before, tt.imported)
+			if !reflect.DeepEqual(timesOf(got), timesOf(want)) || !reflect.DeepEqual(usrsOf(got), usrsOf(want)) {
+				t.Errorf("file has events of %v at %v, want %v at %v",
+					usrsOf(got), timesOf(got), usrsOf(want), timesOf(want))
+			}
+			// the file is not rewritten if there is nothing to import
+			blocks := tt.blocksWritten + tt.blocksCopied
+			if len(tt.imported) == 0 {
+				blocks = 3
+			}
+			checkIndex(t, filename, blocks)
+		})
+	}
+}
+
+func TestImportInvalid(t *testing.T) {
+	unordered := importEvs(50, 60, 55)
+	future := importEvs(50, 4_000_000_000)
+	tests := []struct {
+		name    string
+		src     []byte
+		wantErr error
+	}{
+		{"unordered", ndjson(t, unordered), ErrUnordered},
+		{"future", ndjson(t, future), nil},
+		{"invalid evType", []byte(`{"time":50,"evType":"CLICK"}`), nil},
+		{"invalid consent", []byte(`{"time":50,"evType":"LOAD","consent":"SOME"}`), nil},
+		{"not json", []byte(`time,evType`), nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			filename := filepath.Join(t.TempDir(), "events")
+			writeImportTestFile(t, filename)
+			before, err := os.ReadFile(filename)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = Import(&ImportCfg{
+				Filename:  filename,
+				Src:       bytes.NewReader(tt.src),
+				Format:    "ndjson",
+				BlockSize: 3,
+			})
+			if err == nil || (tt.wantErr != nil && !errors.Is(err, tt.wantErr)) {
+				t.Fatalf("got error %v, want %v", err, tt.wantErr)
+			}
+			after, err := os.ReadFile(filename)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(before, after) {
+				t.Error("invalid import modified the file")
+			}
+			if matches, _ := filepath.Glob(filename + ".import-*"); len(matches) > 0 {
+				t.Errorf("temporary files were not removed: %v", matches)
+			}
+		})
+	}
+}
+
+func TestRecordEvConsent(t *testing.T) {
+	tests := []struct {
+		record string
+		want   ev.Consent
+	}{
+		{`{"time":50,"evType":"LOAD"}`, ev.Consent_FULL},
+		{`{"time":50,"evType":"LOAD","consent":""}`, ev.Consent_FULL},
+		{`{"time":50,"evType":"LOAD","consent":"ANONYMOUS"}`, ev.Consent_ANONYMOUS},
+		{`{"time":50,"evType":"LOAD","consent":"NONE"}`, ev.Consent_NONE},
+	}
+	for _, tt := range tests {
+		rec := &Record{}
+		if err := json.Unmarshal([]byte(tt.record), rec); err != nil {
+			t.Fatal(err)
+		}
+		e, err := rec.Ev()
+		if err != nil {
+			t.Errorf("%s: %v", tt.record, err)
+			continue
+		}
+		if e.Consent != tt.want {
+			t.Errorf("%s has consent %v, want %v", tt.record, e.Consent, tt.want)
+		}
+	}
+}
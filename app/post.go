@@ -1,25 +1,41 @@
 package app
 
 import (
-	"bytes"
-	"compress/gzip"
-	"encoding/binary"
 	"fmt"
 	"io"
 	"net/http"
 	"os"
 	"strconv"
+	"strings"
 	"time"
 
+	"github.com/swissinfo-ch/zoe/codec"
 	"github.com/swissinfo-ch/zoe/ev"
-	"google.golang.org/protobuf/proto"
+	"github.com/swissinfo-ch/zoe/report"
 )
 
 // handlePost is the HTTP handler for the POST / endpoint.
 func (a *App) handlePost(w http.ResponseWriter, r *http.Request) {
-	evType, ok := ev.EvType_value[r.Header.Get("TYPE")]
-	if !ok {
-		http.Error(w, "invalid header TYPE, must be one of LOAD, UNLOAD or TIME", http.StatusBadRequest)
+	p, err := a.resolveProperty(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	if origin := r.Header.Get("Origin"); origin != "" && !p.allowsOrigin(origin) {
+		http.Error(w, fmt.Sprintf("origin %s is not allowed for property %s", origin, p.name), http.StatusForbidden)
+		return
+	}
+	consent, err := a.requestConsent(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// case-insensitive, as ParseRegistry upper-cases the names of custom types
+	typeName := strings.ToUpper(strings.TrimSpace(r.Header.Get("TYPE")))
+	evType, ok := ev.EvType_value[typeName]
+	customType, isCustom := a.evTypes.ID(typeName)
+	if (!ok && !isCustom) || evType == int32(ev.EvType_CUSTOM) {
+		http.Error(w, "invalid header TYPE, must be one of LOAD, UNLOAD, TIME or a registered custom type", http.StatusBadRequest)
 		return
 	}
 	usr, err := strconv.ParseUint(r.Header.Get("USR"), 10, 32)
@@ -44,6 +60,19 @@ func (a *App) handlePost(w http.ResponseWriter, r *http.Request) {
 		Sess:   uint32(sess),
 		Cid:    uint32(cid),
 	}
+	if isCustom {
+		e.EvType = ev.EvType_CUSTOM
+		e.CustomType = &customType
+		if valueHeader := r.Header.Get("VALUE"); valueHeader != "" {
+			value, err := strconv.ParseInt(valueHeader, 10, 32)
+			if err != nil {
+				http.Error(w, fmt.Errorf("err to parse int32 in header VALUE: %w", err).Error(), http.StatusBadRequest)
+				return
+			}
+			value32 := int32(value)
+			e.Value = &value32
+		}
+	}
 	switch e.EvType {
 	case ev.EvType_UNLOAD:
 		scrolled, err := strconv.ParseFloat(r.Header.Get("SCROLLED"), 32)
@@ -61,74 +90,101 @@ func (a *App) handlePost(w http.ResponseWriter, r *http.Request) {
 		}
 		pageSeconds32 := uint32(pageSeconds)
 		e.PageSeconds = &pageSeconds32
+	case ev.EvType_LOAD:
+		// the client sends the page's referrer & url, as the Referer of this
+		// cross-origin request is only the origin of the page, without its UTM parameters
+		page := r.Header.Get("PAGE")
+		if page == "" {
+			page = r.Referer()
+		}
+		referrer := classifyReferrer(r.Header.Get("REFERRER"), page)
+		e.Referrer = &referrer
 	}
-	a.events <- e
-}
-
-// writeEvents writes to the file in a loop
-// TODO: add a buffer to write gzipped groups
-func (a *App) writeEvents() {
-	file, err := os.OpenFile(a.filename, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
-	if err != nil {
-		panic(fmt.Sprintf("failed to open file: %v", err))
+	device := classifyDevice(r.UserAgent())
+	e.Device = &device
+	if a.geoDB != nil {
+		if addr, ok := clientAddr(r); ok {
+			if country := a.geoDB.Country(addr); country != "" {
+				e.Country = &country
+			}
+		}
 	}
-	defer file.Close()
-	block := &ev.Block{
-		Evs: make([]*ev.Ev, 0, a.blockSize),
+	if a.botFilter != nil && a.botFilter.Classify(r.UserAgent(), e) != "" {
+		if a.dropBots {
+			return
+		}
+		e.Bot = true
 	}
+	// after bot classification, as it relies on Sess
+	a.applyConsent(e, consent)
+	p.events <- e
+}
+
+// writeEvents buffers the property's events & writes them to its file in blocks
+func (a *App) writeEvents(p *property) {
 	for {
 		select {
-		case e := <-a.events:
-			block.Evs = append(block.Evs, e)
-			if len(block.Evs) >= a.blockSize {
-				err := a.writeBlock(block, file)
+		case e := <-p.events:
+			p.fileMu.Lock()
+			p.block.Evs = append(p.block.Evs, e)
+			if len(p.block.Evs) >= a.blockSize {
+				entry, err := appendBlock(p.filename, p.block, a.blockLayout, a.blockCodec)
 				if err != nil {
 					panic(fmt.Sprintf("failed to write block: %v", err))
 				}
-				block.Reset()
+				// the block is written, so a failure only leaves the following blocks unindexed
+				if err := report.AppendIndex(p.filename, entry); err != nil {
+					fmt.Printf("\nfailed to index block of property %s: %v\n", p.name, err)
+				}
+				if p.rollup != nil {
+					// the block is written, so a failure only leaves the rollup stale
+					if err := p.rollup.AddBlock(p.block, entry.End()); err != nil {
+						fmt.Printf("\nfailed to add block to rollup of property %s: %v\n", p.name, err)
+					}
+				}
+				p.block.Reset()
 			}
+			p.fileMu.Unlock()
 		case <-a.ctx.Done():
 			return
 		}
 	}
 }
 
-// writeBlock gzips & writes a block to the io.Writer
-func (a *App) writeBlock(block *ev.Block, w io.Writer) error {
-	gzbuf := &bytes.Buffer{}
-	gw := gzip.NewWriter(gzbuf)
-
-	// Marshal the block into protobuf data
-	data, err := proto.Marshal(block)
+// appendBlock opens the file to append a block, so that
+// a file replaced by a rewrite is picked up by the next block.
+// It returns the index entry of the block.
+func appendBlock(filename string, block *ev.Block, layout ev.Layout, c codec.Codec) (report.IndexEntry, error) {
+	file, err := os.OpenFile(filename, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
 	if err != nil {
-		return fmt.Errorf("failed to marshal block: %w", err)
+		return report.IndexEntry{}, fmt.Errorf("failed to open file: %w", err)
 	}
-
-	// Write marshaled data to gzip writer
-	if _, err := gw.Write(data); err != nil {
-		return fmt.Errorf("failed to write block: %w", err)
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return report.IndexEntry{}, fmt.Errorf("failed to stat file: %w", err)
 	}
-
-	// It's crucial to close the gzip writer before accessing the buffer
-	// to ensure all data is flushed and compressed
-	if err := gw.Close(); err != nil {
-		return fmt.Errorf("failed to close gzip writer: %w", err)
+	length, err := writeBlock(block, layout, c, file)
+	if err != nil {
+		return report.IndexEntry{}, err
 	}
+	return report.NewIndexEntry(info.Size(), length, block), nil
+}
 
-	// Write gzipped block to the io.Writer
-	gzippedData := gzbuf.Bytes() // Get the compressed data
-	if _, err := w.Write(gzippedData); err != nil {
-		return fmt.Errorf("failed to write gzipped block: %w", err)
+// writeBlock encodes & writes a block to the io.Writer, returning the length of its payload
+func writeBlock(block *ev.Block, layout ev.Layout, c codec.Codec, w io.Writer) (int, error) {
+	encoded, suffix, err := report.EncodeBlock(block, layout, c)
+	if err != nil {
+		return 0, err
 	}
 
-	// Convert the length of gzipped data to a 4-byte slice
-	lengthBytes := make([]byte, 4)
-	binary.BigEndian.PutUint32(lengthBytes, uint32(len(gzippedData)))
-
-	// Write the length bytes to the io.Writer
-	if _, err := w.Write(lengthBytes); err != nil {
-		return fmt.Errorf("failed to write gzipped block length: %w", err)
+	// Write compressed block & suffix to the io.Writer
+	if _, err := w.Write(encoded); err != nil {
+		return 0, fmt.Errorf("failed to write compressed block: %w", err)
+	}
+	if _, err := w.Write(suffix); err != nil {
+		return 0, fmt.Errorf("failed to write compressed block length: %w", err)
 	}
 
-	return nil
+	return len(encoded), nil
 }
@@ -0,0 +1,128 @@
+package app
+
+import (
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/swissinfo-ch/zoe/ev"
+	"github.com/swissinfo-ch/zoe/geo"
+)
+
+func TestHandlePostType(t *testing.T) {
+	evTypes, err := ev.ParseRegistry("video_play=1,SHARE_CLICK=3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &property{name: "default", events: make(chan *ev.Ev, 1)}
+	a := &App{
+		properties:    map[string]*property{p.name: p},
+		propertyNames: []string{p.name},
+		evTypes:       evTypes,
+	}
+	tests := []struct {
+		name       string
+		headers    map[string]string
+		code       int
+		evType     ev.EvType
+		customType uint32
+		value      *int32
+	}{
+		{"built-in", map[string]string{"TYPE": "LOAD"}, 200, ev.EvType_LOAD, 0, nil},
+		{"built-in lower-case", map[string]string{"TYPE": "load"}, 200, ev.EvType_LOAD, 0, nil},
+		{"custom", map[string]string{"TYPE": "VIDEO_PLAY"}, 200, ev.EvType_CUSTOM, 1, nil},
+		{"custom as declared", map[string]string{"TYPE": "video_play"}, 200, ev.EvType_CUSTOM, 1, nil},
+		{"custom mixed case", map[string]string{"TYPE": " Share_Click ", "VALUE": "-7"}, 200, ev.EvType_CUSTOM, 3, ptr(int32(-7))},
+		{"custom with value", map[string]string{"TYPE": "VIDEO_PLAY", "VALUE": "42"}, 200, ev.EvType_CUSTOM, 1, ptr(int32(42))},
+		{"invalid value", map[string]string{"TYPE": "VIDEO_PLAY", "VALUE": "4.2"}, 400, 0, 0, nil},
+		{"value out of range", map[string]string{"TYPE": "VIDEO_PLAY", "VALUE": "2147483648"}, 400, 0, 0, nil},
+		{"unregistered", map[string]string{"TYPE": "NEWSLETTER_SIGNUP"}, 400, 0, 0, nil},
+		{"CUSTOM", map[string]string{"TYPE": "CUSTOM"}, 400, 0, 0, nil},
+		{"missing", map[string]string{}, 400, 0, 0, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("POST", "/", nil)
+			r.Header.Set("User-Agent", "Mozilla/5.0 (Windows NT 10.0; Win64; x64)")
+			r.Header.Set("USR", "1")
+			r.Header.Set("SESS", "2")
+			r.Header.Set("CID", "3")
+			for key, value := range tt.headers {
+				r.Header.Set(key, value)
+			}
+			w := httptest.NewRecorder()
+			a.handleRequest(w, r)
+			if w.Code != tt.code {
+				t.Fatalf("got %d, want %d: %s", w.Code, tt.code, w.Body)
+			}
+			if tt.code != 200 {
+				if len(p.events) != 0 {
+					t.Errorf("invalid event was stored: %v", <-p.events)
+				}
+				return
+			}
+			e := <-p.events
+			if e.EvType != tt.evType || e.GetCustomType() != tt.customType {
+				t.Errorf("got type %v & custom type %d, want %v & %d", e.EvType, e.GetCustomType(), tt.evType, tt.customType)
+			}
+			if (e.Value == nil) != (tt.value == nil) || e.Value != nil && *e.Value != *tt.value {
+				t.Errorf("got value %v, want %v", e.Value, tt.value)
+			}
+			if e.Usr != 1 || e.Sess != 2 || e.Cid != 3 {
+				t.Errorf("got usr %d, sess %d & cid %d, want 1, 2 & 3", e.Usr, e.Sess, e.Cid)
+			}
+		})
+	}
+}
+
+// TestHandlePostCountry resolves the country of the client, if there is a geo db
+func TestHandlePostCountry(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "geo.csv")
+	if err := os.WriteFile(filename, []byte("192.0.2.0,192.0.2.255,ch\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	geoDB, err := geo.Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name     string
+		geoDB    *geo.DB
+		clientIP string
+		want     string
+	}{
+		{"in a range", geoDB, "192.0.2.7", "CH"},
+		{"in no range", geoDB, "198.51.100.7", ""},
+		{"invalid client ip", geoDB, "unknown", ""},
+		{"no geo db", nil, "192.0.2.7", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &property{name: "default", events: make(chan *ev.Ev, 1)}
+			a := &App{
+				properties:    map[string]*property{p.name: p},
+				propertyNames: []string{p.name},
+				geoDB:         tt.geoDB,
+			}
+			r := httptest.NewRequest("POST", "/", nil)
+			r.Header.Set("TYPE", "LOAD")
+			r.Header.Set("USR", "1")
+			r.Header.Set("SESS", "2")
+			r.Header.Set("CID", "3")
+			r.Header.Set("Fly-Client-IP", tt.clientIP)
+			w := httptest.NewRecorder()
+			a.handleRequest(w, r)
+			if w.Code != 200 {
+				t.Fatalf("got %d: %s", w.Code, w.Body)
+			}
+			if got := (<-p.events).GetCountry(); got != tt.want {
+				t.Errorf("got country %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func ptr[T any](v T) *T {
+	return &v
+}
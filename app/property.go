@@ -0,0 +1,86 @@
+package app
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/swissinfo-ch/zoe/ev"
+	"github.com/swissinfo-ch/zoe/report"
+	"github.com/swissinfo-ch/zoe/rollup"
+)
+
+// property is a site with its own events file, reports & allowed origins.
+type property struct {
+	name           string
+	filename       string
+	events         chan *ev.Ev
+	reportRunner   *report.Runner
+	reportNames    []string
+	allowedOrigins []string
+	fileMu         sync.Mutex // held while appending a block & while replacing the file
+	block          *ev.Block  // events not yet written, guarded by fileMu
+	rewriteMu      sync.Mutex // held during a rewrite of the file, eg. an erasure
+	rollup         *rollup.Store
+	rollupReports  map[string]rollup.Report
+	queries        queryCache // prepared results of queries of the runner's results
+}
+
+type PropertyCfg struct {
+	Name           string
+	Filename       string
+	ReportRunner   *report.Runner
+	ReportNames    []string
+	AllowedOrigins []string
+	Rollup         *rollup.Store            // optional, maintained as blocks are written
+	RollupReports  map[string]rollup.Report // served from the rollup, requires Rollup
+}
+
+// resolveProperty returns the property of a request.
+// The property is taken from the PROPERTY header or query parameter,
+// then from the Origin. Requests without either go to the primary property.
+func (a *App) resolveProperty(r *http.Request) (*property, error) {
+	name := r.Header.Get("PROPERTY")
+	if name == "" {
+		name = r.URL.Query().Get("property")
+	}
+	if name != "" {
+		p, exists := a.properties[name]
+		if !exists {
+			return nil, fmt.Errorf("property %s not found", name)
+		}
+		return p, nil
+	}
+	origin := r.Header.Get("Origin")
+	if origin != "" {
+		for _, name := range a.propertyNames {
+			p := a.properties[name]
+			if p.allowsOrigin(origin) {
+				return p, nil
+			}
+		}
+		return nil, fmt.Errorf("origin %s is not allowed", origin)
+	}
+	return a.properties[a.propertyNames[0]], nil
+}
+
+// allowsOrigin returns true if the origin is in the property's allowlist.
+func (p *property) allowsOrigin(origin string) bool {
+	for _, o := range p.allowedOrigins {
+		if o == origin {
+			return true
+		}
+	}
+	return false
+}
+
+// rebuildRollup rebuilds the property's rollup from its file, if it has one,
+// eg. after events were erased or imported.
+func (p *property) rebuildRollup() {
+	if p.rollup == nil {
+		return
+	}
+	if err := p.rollup.Rebuild(p.filename, &p.fileMu); err != nil {
+		fmt.Printf("\nfailed to rebuild rollup of property %s: %v\n", p.name, err)
+	}
+}
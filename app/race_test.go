@@ -0,0 +1,144 @@
+package app
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/swissinfo-ch/zoe/codec"
+	"github.com/swissinfo-ch/zoe/ev"
+	"github.com/swissinfo-ch/zoe/report"
+)
+
+// TestRaceReportsAndStatus hammers /r & /status while events are written
+// & reports run, so that go test -race ./app finds unsynchronised state.
+func TestRaceReportsAndStatus(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	filename := filepath.Join(t.TempDir(), "events")
+	block := &ev.Block{}
+	for i := 0; i < 1000; i++ {
+		block.Evs = append(block.Evs, &ev.Ev{
+			Time:   uint32(time.Now().Unix()) - uint32(1000-i),
+			EvType: ev.EvType_LOAD,
+			Cid:    uint32(i % 10),
+		})
+	}
+	for i := 0; i < 10; i++ {
+		entry, err := appendBlock(filename, block, ev.LayoutRow, codec.Gzip)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := report.AppendIndex(filename, entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	evTypes, err := ev.ParseRegistry("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := &App{
+		ctx:           ctx,
+		properties:    make(map[string]*property),
+		propertyNames: []string{"default"},
+		blockSize:     100,
+		blockLayout:   ev.LayoutRow,
+		blockCodec:    codec.Gzip,
+		evTypes:       evTypes,
+	}
+	p := &property{
+		name:     "default",
+		filename: filename,
+		events:   make(chan *ev.Ev, 100),
+		reportRunner: report.NewRunner(&report.RunnerCfg{
+			Ctx:               ctx,
+			Name:              "default",
+			Filename:          filename,
+			BlockSize:         100,
+			WorkerPoolSize:    2,
+			MinReportInterval: time.Millisecond,
+			Jobs: map[string]*report.Job{
+				"views": {
+					Report: &report.Views{
+						MinEvTime: func() time.Time {
+							return time.Now().Add(-time.Hour)
+						},
+					},
+				},
+				"subset": {
+					Report: &report.Subset{
+						Limit:  100,
+						Filter: func(*ev.Ev) bool { return true },
+					},
+				},
+			},
+		}),
+		block: &ev.Block{},
+	}
+	a.properties[p.name] = p
+	written := make(chan struct{})
+	go func() {
+		a.writeEvents(p)
+		close(written)
+	}()
+	server := httptest.NewServer(http.HandlerFunc(a.handleRequest))
+	defer server.Close()
+
+	wg := sync.WaitGroup{}
+	deadline := time.Now().Add(time.Second)
+	get := func(path string) {
+		defer wg.Done()
+		for time.Now().Before(deadline) {
+			res, err := http.Get(server.URL + path)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			io.Copy(io.Discard, res.Body)
+			res.Body.Close()
+		}
+	}
+	post := func() {
+		defer wg.Done()
+		for i := 0; time.Now().Before(deadline); i++ {
+			req, _ := http.NewRequest("POST", server.URL, nil)
+			req.Header.Set("TYPE", "LOAD")
+			req.Header.Set("USR", strconv.Itoa(i))
+			req.Header.Set("SESS", strconv.Itoa(i))
+			req.Header.Set("CID", strconv.Itoa(i%10))
+			res, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			res.Body.Close()
+		}
+	}
+	for i := 0; i < 4; i++ {
+		wg.Add(3)
+		go get("/r?name=views")
+		go get("/status")
+		go post()
+	}
+	wg.Wait()
+
+	// stop writing & reporting before the file is removed
+	p.reportRunner.Stop()
+	p.reportRunner.Wait()
+	cancel()
+	<-written
+
+	if p.reportRunner.LastReportEventCount() == 0 {
+		t.Fatal("no report ran")
+	}
+	if _, exists := p.reportRunner.Result("views"); !exists {
+		t.Fatal("missing views result")
+	}
+}
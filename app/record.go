@@ -0,0 +1,147 @@
+package app
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/swissinfo-ch/zoe/ev"
+)
+
+// Record is an event as exported & imported in NDJSON, with the fields of the CSV export.
+// Enums are names, & optional fields that are not set are null, so that every
+// record has the same fields, with the same values as in CSV.
+type Record struct {
+	Time        uint32   `json:"time"`
+	EvType      string   `json:"evType"` // custom types are named, see ev.Registry.TypeName
+	Usr         uint32   `json:"usr"`
+	Sess        uint32   `json:"sess"`
+	Cid         uint32   `json:"cid"`
+	PageSeconds *uint32  `json:"pageSeconds"`
+	Scrolled    *float32 `json:"scrolled"`
+	Bot         bool     `json:"bot"`
+	Referrer    *string  `json:"referrer"`
+	Device      *string  `json:"device"`
+	Country     *string  `json:"country"`
+	CustomType  *uint32  `json:"customType"`
+	Value       *int32   `json:"value"`
+	Consent     string   `json:"consent"` // FULL if empty or missing
+}
+
+var csvHeader = []string{
+	"time", "evType", "usr", "sess", "cid", "pageSeconds", "scrolled", "bot",
+	"referrer", "device", "country", "customType", "value", "consent",
+}
+
+// NewRecord returns the record of an event.
+func NewRecord(e *ev.Ev, evTypes *ev.Registry) *Record {
+	rec := &Record{
+		Time:        e.Time,
+		EvType:      evTypes.TypeName(e),
+		Usr:         e.Usr,
+		Sess:        e.Sess,
+		Cid:         e.Cid,
+		PageSeconds: e.PageSeconds,
+		Scrolled:    e.Scrolled,
+		Bot:         e.Bot,
+		Country:     e.Country,
+		CustomType:  e.CustomType,
+		Value:       e.Value,
+		Consent:     e.Consent.String(),
+	}
+	if e.Referrer != nil {
+		referrer := e.Referrer.String()
+		rec.Referrer = &referrer
+	}
+	if e.Device != nil {
+		device := e.Device.String()
+		rec.Device = &device
+	}
+	return rec
+}
+
+// CSV returns the fields of the record in the order of csvHeader.
+// Fields that are not set are empty.
+func (rec *Record) CSV() []string {
+	fields := []string{
+		strconv.FormatUint(uint64(rec.Time), 10),
+		rec.EvType,
+		strconv.FormatUint(uint64(rec.Usr), 10),
+		strconv.FormatUint(uint64(rec.Sess), 10),
+		strconv.FormatUint(uint64(rec.Cid), 10),
+		"", "", strconv.FormatBool(rec.Bot), "", "", "", "", "",
+		rec.Consent,
+	}
+	if rec.PageSeconds != nil {
+		fields[5] = strconv.FormatUint(uint64(*rec.PageSeconds), 10)
+	}
+	if rec.Scrolled != nil {
+		fields[6] = strconv.FormatFloat(float64(*rec.Scrolled), 'f', -1, 32)
+	}
+	if rec.Referrer != nil {
+		fields[8] = *rec.Referrer
+	}
+	if rec.Device != nil {
+		fields[9] = *rec.Device
+	}
+	if rec.Country != nil {
+		fields[10] = *rec.Country
+	}
+	if rec.CustomType != nil {
+		fields[11] = strconv.FormatUint(uint64(*rec.CustomType), 10)
+	}
+	if rec.Value != nil {
+		fields[12] = strconv.FormatInt(int64(*rec.Value), 10)
+	}
+	return fields
+}
+
+// Ev returns the event of the record.
+// Events of a custom type are identified by customType, not by the name of their type.
+func (rec *Record) Ev() (*ev.Ev, error) {
+	e := &ev.Ev{
+		Time:        rec.Time,
+		Usr:         rec.Usr,
+		Sess:        rec.Sess,
+		Cid:         rec.Cid,
+		PageSeconds: rec.PageSeconds,
+		Scrolled:    rec.Scrolled,
+		Bot:         rec.Bot,
+		Country:     rec.Country,
+		CustomType:  rec.CustomType,
+		Value:       rec.Value,
+	}
+	if rec.CustomType != nil {
+		e.EvType = ev.EvType_CUSTOM
+	} else {
+		evType, ok := ev.EvType_value[rec.EvType]
+		if !ok {
+			return nil, fmt.Errorf("invalid evType %q", rec.EvType)
+		}
+		e.EvType = ev.EvType(evType)
+	}
+	if rec.Referrer != nil {
+		referrer, ok := ev.Referrer_value[*rec.Referrer]
+		if !ok {
+			return nil, fmt.Errorf("invalid referrer %q", *rec.Referrer)
+		}
+		e.Referrer = ev.Referrer(referrer).Enum()
+	}
+	if rec.Device != nil {
+		device, ok := ev.Device_value[*rec.Device]
+		if !ok {
+			return nil, fmt.Errorf("invalid device %q", *rec.Device)
+		}
+		e.Device = ev.Device(device).Enum()
+	}
+	if rec.Consent == "" {
+		// records of before consent was recorded, as events without it are decoded
+		e.Consent = ev.Consent_FULL
+		return e, nil
+	}
+	consent, ok := ev.Consent_value[rec.Consent]
+	if !ok {
+		return nil, fmt.Errorf("invalid consent %q", rec.Consent)
+	}
+	e.Consent = ev.Consent(consent)
+	return e, nil
+}
@@ -0,0 +1,260 @@
+package app
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/swissinfo-ch/zoe/codec"
+	"github.com/swissinfo-ch/zoe/ev"
+	"github.com/swissinfo-ch/zoe/report"
+)
+
+// codecMagics start the payloads of the codecs that have a magic number,
+// so that blocks after a damaged range are found again by scanning for them.
+// Snappy & uncompressed payloads have none.
+var codecMagics = map[byte][]byte{
+	codec.IDGzip: {0x1f, 0x8b, 0x08}, // with the deflate compression method
+	codec.IDZstd: {0x28, 0xb5, 0x2f, 0xfd},
+}
+
+// maxBlockLength is the longest payload a length suffix can hold.
+const maxBlockLength = 1<<24 - 1
+
+type RepairCfg struct {
+	Filename string
+	Out      string // path of the repaired file, which must not exist
+}
+
+// RepairResult is a JSON-serializable summary of a repair.
+type RepairResult struct {
+	Filename        string       `json:"filename"`
+	Out             string       `json:"out"`
+	BlocksKept      int          `json:"blocksKept"`
+	EventsKept      int          `json:"eventsKept"`
+	LengthsRestored int          `json:"lengthsRestored"` // blocks kept without their length suffix
+	BytesLost       int64        `json:"bytesLost"`
+	Lost            []*LostRange `json:"lost,omitempty"`
+}
+
+// LostRange is a range of the file that could not be recovered.
+type LostRange struct {
+	Offset int64  `json:"offset"`
+	Length int64  `json:"length"`
+	Error  string `json:"error"`
+}
+
+// Repair rebuilds an events file from its valid blocks, to a new file.
+// The intact end of the file is walked back by the length suffixes, as when reading,
+// & only the range before it is scanned forward. From the start of the file & after
+// each valid block, the next block is found by its length suffix, whatever its codec.
+// After a damaged range, the scan skips to the next gzip or zstd magic number,
+// so snappy & uncompressed blocks between a damaged range & the intact end are lost.
+// A gzip or zstd block at the end of the file, whose length was not written, is kept.
+func Repair(cfg *RepairCfg) (*RepairResult, error) {
+	src, err := os.Open(cfg.Filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open file for reading: %w", err)
+	}
+	defer src.Close()
+	info, err := src.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("failed to stat file: %w", err)
+	}
+	size := info.Size()
+	dst, err := os.OpenFile(cfg.Out, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create repaired file: %w", err)
+	}
+	defer dst.Close()
+	bw := bufio.NewWriter(dst)
+
+	res := &RepairResult{
+		Filename: cfg.Filename,
+		Out:      cfg.Out,
+	}
+	tail, damagedEnd, err := intactTail(src, size, res)
+	if err != nil {
+		return nil, err
+	}
+	offset := int64(0)
+	for offset < damagedEnd {
+		raw, block, next, err := scanBlock(src, offset, damagedEnd, size)
+		if err != nil {
+			// skip to the next block with a magic number
+			skipTo, ferr := findMagic(src, offset+1, damagedEnd)
+			if ferr != nil {
+				return nil, ferr
+			}
+			res.Lost = append(res.Lost, &LostRange{
+				Offset: offset,
+				Length: skipTo - offset,
+				Error:  err.Error(),
+			})
+			res.BytesLost += skipTo - offset
+			offset = skipTo
+			continue
+		}
+		if next > size {
+			// a partly written length is dropped
+			res.LengthsRestored++
+			next = size
+		}
+		if err := writeRawBlock(raw, bw); err != nil {
+			return nil, err
+		}
+		res.BlocksKept++
+		res.EventsKept += len(block.Evs)
+		offset = next
+	}
+	for _, ref := range tail {
+		raw, err := readRawBlock(src, ref)
+		if err != nil {
+			return nil, err
+		}
+		if err := writeRawBlock(raw, bw); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := bw.Flush(); err != nil {
+		return nil, fmt.Errorf("failed to write repaired file: %w", err)
+	}
+	if err := dst.Sync(); err != nil {
+		return nil, fmt.Errorf("failed to sync repaired file: %w", err)
+	}
+	return res, nil
+}
+
+// intactTail walks the blocks back from the end of the file while they are valid,
+// returning them oldest first, & the end of the damaged range before them,
+// 0 if the whole file is intact.
+func intactTail(file io.ReaderAt, size int64, res *RepairResult) ([]blockRef, int64, error) {
+	refs := make([]blockRef, 0)
+	damagedEnd := int64(0)
+	br := report.NewBlockReader(file, size)
+	for {
+		raw, err := br.Next()
+		if err == io.EOF {
+			break
+		}
+		var block *ev.Block
+		if err == nil {
+			block, err = raw.Decode()
+		}
+		if err != nil {
+			damagedEnd = br.Offset()
+			if raw != nil {
+				damagedEnd = raw.End()
+			}
+			break
+		}
+		refs = append(refs, blockRef{
+			offset: raw.Offset,
+			length: int64(len(raw.Data)),
+			layout: raw.Layout,
+			codec:  raw.Codec,
+		})
+		res.BlocksKept++
+		res.EventsKept += len(block.Evs)
+	}
+	for i, j := 0, len(refs)-1; i < j; i, j = i+1, j-1 {
+		refs[i], refs[j] = refs[j], refs[i]
+	}
+	return refs, damagedEnd, nil
+}
+
+// scanBlock finds the block starting at offset, before end, by the first length suffix
+// matching its distance from offset, whose block is valid. It returns the block & the offset
+// of the next one, which is beyond size when the block ends the file without its length,
+// or part of it.
+func scanBlock(file io.ReaderAt, offset, end, size int64) (*report.RawBlock, *ev.Block, int64, error) {
+	limit := min(end-offset, maxBlockLength+4)
+	var data []byte
+	length := 1
+	// read more of the file as long as no block is found, as most blocks are small
+	for n := min(limit, 64*1024); ; n = min(limit, 2*n) {
+		data = make([]byte, n)
+		if _, err := file.ReadAt(data, offset); err != nil {
+			return nil, nil, 0, fmt.Errorf("failed to read block: %w", err)
+		}
+		for ; length+4 <= len(data); length++ {
+			layout, codecID, got := codec.ParseSuffix(data[length : length+4])
+			if got != int64(length) || ev.Layout(layout) > ev.LayoutColumnar {
+				continue
+			}
+			raw := &report.RawBlock{
+				Offset: offset,
+				Layout: ev.Layout(layout),
+				Codec:  codecID,
+				Data:   data[:length:length],
+			}
+			if block, err := raw.Decode(); err == nil {
+				return raw, block, offset + int64(length) + 4, nil
+			}
+		}
+		if n == limit {
+			break
+		}
+	}
+	if end == size {
+		if raw, block, ok := unterminatedBlock(data, offset); ok {
+			return raw, block, offset + int64(len(raw.Data)) + 4, nil
+		}
+	}
+	return nil, nil, 0, fmt.Errorf("no valid block at offset %d", offset)
+}
+
+// unterminatedBlock returns the block at the end of the file, whose length was never
+// written, or only partly. Its codec is known by its magic number, but not its layout,
+// so columnar is tried first, as its framing is stricter.
+func unterminatedBlock(data []byte, offset int64) (*report.RawBlock, *ev.Block, bool) {
+	for codecID, magic := range codecMagics {
+		if !bytes.HasPrefix(data, magic) {
+			continue
+		}
+		// up to 3 bytes of the length may have been written
+		for cut := 0; cut < 4 && cut < len(data); cut++ {
+			for _, layout := range []ev.Layout{ev.LayoutColumnar, ev.LayoutRow} {
+				raw := &report.RawBlock{
+					Offset: offset,
+					Layout: layout,
+					Codec:  codecID,
+					Data:   data[: len(data)-cut : len(data)-cut],
+				}
+				if block, err := raw.Decode(); err == nil {
+					return raw, block, true
+				}
+			}
+		}
+	}
+	return nil, nil, false
+}
+
+// findMagic returns the offset of the next magic number of a codec from offset, or end if none.
+func findMagic(file io.ReaderAt, offset, end int64) (int64, error) {
+	buf := make([]byte, 64*1024)
+	for offset < end {
+		n, err := file.ReadAt(buf[:min(int64(len(buf)), end-offset)], offset)
+		if err != nil && err != io.EOF {
+			return 0, fmt.Errorf("failed to read file: %w", err)
+		}
+		found := -1
+		for _, magic := range codecMagics {
+			if i := bytes.Index(buf[:n], magic); i >= 0 && (found < 0 || i < found) {
+				found = i
+			}
+		}
+		if found >= 0 {
+			return offset + int64(found), nil
+		}
+		if offset+int64(n) >= end || n < len(buf) {
+			break
+		}
+		// overlap, in case a magic number, of up to 4 bytes, spans two reads
+		offset += int64(n - 3)
+	}
+	return end, nil
+}
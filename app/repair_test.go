@@ -0,0 +1,85 @@
+package app
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/swissinfo-ch/zoe/codec"
+	"github.com/swissinfo-ch/zoe/ev"
+)
+
+// TestRepairZstd repairs zstd files, which have no gzip member to scan for.
+func TestRepairZstd(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "events")
+	for i := 0; i < 5; i++ {
+		block := &ev.Block{}
+		for j := 0; j < 100; j++ {
+			block.Evs = append(block.Evs, &ev.Ev{
+				Time:   uint32(1700000000 + i*100 + j),
+				EvType: ev.EvType_LOAD,
+				Cid:    uint32(j % 7),
+			})
+		}
+		layout := ev.LayoutRow
+		if i%2 == 1 {
+			layout = ev.LayoutColumnar
+		}
+		if _, err := appendBlock(filename, block, layout, codec.Zstd); err != nil {
+			t.Fatal(err)
+		}
+	}
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	damaged := append([]byte{}, data...)
+	// the middle of the file, within the second or third block
+	for i := len(data) / 2; i < len(data)/2+8; i++ {
+		damaged[i] ^= 0xff
+	}
+
+	tests := []struct {
+		name            string
+		data            []byte
+		blocks          int
+		lengthsRestored int
+		lost            bool
+	}{
+		{"intact", data, 5, 0, false},
+		{"truncated length", data[:len(data)-2], 5, 1, false},
+		{"missing length", data[:len(data)-4], 5, 1, false},
+		{"truncated block", data[:len(data)-20], 4, 0, true},
+		{"damaged", damaged, 4, 0, true},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			src := filepath.Join(dir, "src"+strconv.Itoa(i))
+			if err := os.WriteFile(src, tt.data, 0644); err != nil {
+				t.Fatal(err)
+			}
+			res, err := Repair(&RepairCfg{Filename: src, Out: src + ".repaired"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if res.BlocksKept != tt.blocks || res.EventsKept != tt.blocks*100 {
+				t.Errorf("kept %d blocks & %d events, want %d blocks", res.BlocksKept, res.EventsKept, tt.blocks)
+			}
+			if res.LengthsRestored != tt.lengthsRestored {
+				t.Errorf("restored %d lengths, want %d", res.LengthsRestored, tt.lengthsRestored)
+			}
+			if (len(res.Lost) > 0) != tt.lost {
+				t.Errorf("lost %v, want lost %v", res.Lost, tt.lost)
+			}
+			repaired, err := Repair(&RepairCfg{Filename: src + ".repaired", Out: src + ".repaired2"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if repaired.BlocksKept != res.BlocksKept || len(repaired.Lost) > 0 || repaired.LengthsRestored > 0 {
+				t.Errorf("repaired file is not intact: %+v", repaired)
+			}
+		})
+	}
+}
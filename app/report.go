@@ -1,8 +1,22 @@
 package app
 
-import "net/http"
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/swissinfo-ch/zoe/report"
+)
 
 // handleGetReport is the HTTP handler for the /r endpoint.
+// With at, it serves the past result that was the last at that time.
+// Other parameters, eg. cid or limit, query the result if the report implements QueryReport.
 func (a *App) handleGetReportResult(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	name := r.URL.Query().Get("name")
@@ -10,11 +24,320 @@ func (a *App) handleGetReportResult(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "missing name query parameter", http.StatusBadRequest)
 		return
 	}
-	result, exists := a.reportRunner.Result(name)
+	p, err := a.resolveProperty(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	at := r.URL.Query().Get("at")
+	params := queryParams(r)
+	if rep, exists := p.rollupReports[name]; exists && at == "" {
+		if len(params) > 0 {
+			http.Error(w, fmt.Sprintf("report %s cannot be queried", name), http.StatusBadRequest)
+			return
+		}
+		result, err := rep.Generate(p.rollup)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", result.ContentType)
+		w.Write(result.Content)
+		return
+	}
+	latest, exists := p.reportRunner.Result(name)
+	result := latest
+	if at != "" {
+		t, err := ParseTime(at)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		result, exists = p.reportRunner.ResultAt(name, t)
+	}
 	if !exists {
 		http.Error(w, "report not found", http.StatusNotFound)
 		return
 	}
+	job := p.reportRunner.Jobs()[name]
+	nextRun := job.NextRun()
+	if replaced(result, latest) {
+		nextRun = time.Time{}
+	}
+	if len(params) > 0 {
+		qr, ok := job.Report.(report.QueryReport)
+		if !ok {
+			http.Error(w, fmt.Sprintf("report %s cannot be queried", name), http.StatusBadRequest)
+			return
+		}
+		result, err = p.queries.query(qr, name, result, params)
+		if errors.Is(err, report.ErrInvalidQuery) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	serveResult(w, r, result, nextRun)
+}
+
+// replaced returns true if a result newer than result was published,
+// so that result is the last at the times it was requested at for good
+func replaced(result, latest *report.Result) bool {
+	return latest != nil && latest.GeneratedAt.After(result.GeneratedAt)
+}
+
+// queryParams returns the query parameters of a request for the report,
+// without those of the endpoint
+func queryParams(r *http.Request) url.Values {
+	params := r.URL.Query()
+	for _, key := range []string{"name", "property", "at"} {
+		params.Del(key)
+	}
+	return params
+}
+
+// maxQueryCacheEntries bounds the prepared query results kept by a property
+const maxQueryCacheEntries = 1024
+
+// queryCache keeps the prepared results of queries, by job & normalised query,
+// until the result they were queried from is replaced by the next run of the job.
+// The zero value is ready to use.
+type queryCache struct {
+	mu      sync.Mutex
+	entries map[string]*queryEntry
+}
+
+type queryEntry struct {
+	base   *report.Result // result the query was answered from
+	result *report.Result
+}
+
+// query returns the prepared result of a query of a job's result,
+// queried & prepared only if it is not cached for that result
+func (c *queryCache) query(qr report.QueryReport, name string, base *report.Result, params url.Values) (*report.Result, error) {
+	// Encode sorts by key, so the order of the parameters does not matter
+	key := name + "?" + params.Encode()
+	c.mu.Lock()
+	entry, exists := c.entries[key]
+	c.mu.Unlock()
+	if exists && entry.base == base {
+		return entry.result, nil
+	}
+	result, err := qr.Query(base, params)
+	if err != nil {
+		return nil, err
+	}
+	if err := result.Prepare(); err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.entries == nil || len(c.entries) >= maxQueryCacheEntries {
+		c.entries = make(map[string]*queryEntry)
+	}
+	c.entries[key] = &queryEntry{base: base, result: result}
+	return result, nil
+}
+
+// clear removes all entries, eg. after results were cleared
+func (c *queryCache) clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries = nil
+}
+
+// fixedMaxAge is how long clients may cache past results that were replaced,
+// which never change, unless they are cleared by an erasure
+const fixedMaxAge = 24 * time.Hour
+
+// cacheControl returns the Cache-Control of a result that is replaced at nextRun,
+// or of a past result that was replaced, if nextRun is zero
+func cacheControl(nextRun time.Time) string {
+	if nextRun.IsZero() {
+		return fmt.Sprintf("public, max-age=%d, immutable", int(fixedMaxAge.Seconds()))
+	}
+	maxAge := max(int(time.Until(nextRun).Seconds()), 0)
+	return fmt.Sprintf("public, max-age=%d", maxAge)
+}
+
+// serveResult writes a result of the runner, cached as by cacheControl,
+// or only its headers if the client has it, in the encoding the client prefers
+// among those the result is compressed in, once per result
+func serveResult(w http.ResponseWriter, r *http.Request, result *report.Result, nextRun time.Time) {
+	h := w.Header()
+	if result.Stale {
+		// kept from before a restart, until the job runs
+		h.Set("X-Report-Stale", "true")
+	}
+	h.Set("X-Report-Generated-At", result.GeneratedAt.UTC().Format(time.RFC3339))
+	h.Set("X-Report-Event-Count", strconv.FormatUint(uint64(result.EventCount), 10))
+	h.Set("Content-Type", result.ContentType)
+	h.Set("Vary", "Accept-Encoding")
+	h.Set("ETag", result.ETag)
+	h.Set("Last-Modified", result.GeneratedAt.UTC().Format(http.TimeFormat))
+	h.Set("Cache-Control", cacheControl(nextRun))
+	if notModified(r, result) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	content := result.Content
+	gz, br, err := result.Compressed()
+	if err != nil {
+		// served uncompressed
+		fmt.Printf("\nfailed to compress result: %v\n", err)
+	}
+	if br != nil && acceptsEncoding(r, "br") {
+		h.Set("Content-Encoding", "br")
+		content = br
+	} else if gz != nil && acceptsEncoding(r, "gzip") {
+		h.Set("Content-Encoding", "gzip")
+		content = gz
+	}
+	w.Write(content)
+}
+
+// notModified returns true if the client has the result, by If-None-Match,
+// or else by If-Modified-Since
+func notModified(r *http.Request, result *report.Result) bool {
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		// weak comparison, as the ETag is weak
+		etag := strings.TrimPrefix(result.ETag, "W/")
+		for _, tag := range strings.Split(inm, ",") {
+			tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+			if tag == "*" || tag == etag {
+				return true
+			}
+		}
+		return false
+	}
+	ims, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	if err != nil {
+		return false
+	}
+	// Last-Modified is to the second
+	return !result.GeneratedAt.Truncate(time.Second).After(ims)
+}
+
+// acceptsEncoding returns true if the Accept-Encoding of the request includes enc
+func acceptsEncoding(r *http.Request, enc string) bool {
+	for _, accepted := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		name, params, _ := strings.Cut(accepted, ";")
+		if strings.TrimSpace(name) != enc {
+			continue
+		}
+		// q=0 means not acceptable
+		if q, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if v, err := strconv.ParseFloat(q, 64); err == nil && v == 0 {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// PastResult describes a past result of a report, for the /r/history endpoint.
+type PastResult struct {
+	GeneratedAt int64  `json:"generatedAt"` // Unix timestamp, to get it with /r?at=
+	EventCount  uint32 `json:"eventCount"`
+}
+
+// handleGetReportHistory is the HTTP handler for the /r/history endpoint.
+// It lists the past results of a report, oldest first.
+func (a *App) handleGetReportHistory(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get("name")
+	if name == "" {
+		http.Error(w, "missing name query parameter", http.StatusBadRequest)
+		return
+	}
+	p, err := a.resolveProperty(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if _, exists := p.reportRunner.Jobs()[name]; !exists {
+		http.Error(w, "report not found", http.StatusNotFound)
+		return
+	}
+	history := p.reportRunner.History(name)
+	past := make([]*PastResult, 0, len(history))
+	for _, result := range history {
+		past = append(past, &PastResult{
+			GeneratedAt: result.GeneratedAt.Unix(),
+			EventCount:  result.EventCount,
+		})
+	}
+	data, err := json.Marshal(past)
+	if err != nil {
+		panic(err)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
+
+// handleGetReportDiff is the HTTP handler for the /r/diff endpoint.
+// It compares the past results of a report that were the last at from & at to,
+// or the last result if to is omitted, eg. the changes of rank of a Top report.
+func (a *App) handleGetReportDiff(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	name := q.Get("name")
+	if name == "" {
+		http.Error(w, "missing name query parameter", http.StatusBadRequest)
+		return
+	}
+	p, err := a.resolveProperty(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	job, exists := p.reportRunner.Jobs()[name]
+	if !exists {
+		http.Error(w, "report not found", http.StatusNotFound)
+		return
+	}
+	dr, ok := job.Report.(report.DiffReport)
+	if !ok {
+		http.Error(w, fmt.Sprintf("report %s cannot be compared", name), http.StatusBadRequest)
+		return
+	}
+	fromTime, err := ParseTime(q.Get("from"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	from, exists := p.reportRunner.ResultAt(name, fromTime)
+	if !exists {
+		http.Error(w, "no result at from", http.StatusNotFound)
+		return
+	}
+	latest, exists := p.reportRunner.Result(name)
+	to := latest
+	if q.Get("to") != "" {
+		toTime, err := ParseTime(q.Get("to"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		to, exists = p.reportRunner.ResultAt(name, toTime)
+	}
+	if !exists {
+		http.Error(w, "no result at to", http.StatusNotFound)
+		return
+	}
+	result, err := dr.Diff(from, to)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	// a diff between past results that were replaced never changes
+	nextRun := job.NextRun()
+	if replaced(from, latest) && replaced(to, latest) {
+		nextRun = time.Time{}
+	}
+	w.Header().Set("Cache-Control", cacheControl(nextRun))
 	w.Header().Set("Content-Type", result.ContentType)
 	w.Write(result.Content)
 }
@@ -0,0 +1,232 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/swissinfo-ch/zoe/report"
+)
+
+// newReportTestApp returns an app with a property whose runner runs the jobs
+// every interval over a file of recent loads, stopped at the end of the test
+func newReportTestApp(t *testing.T, interval time.Duration, jobs map[string]*report.Job) (*App, *property) {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	filename := filepath.Join(t.TempDir(), "events")
+	now := uint32(time.Now().Unix())
+	writeTestFile(t, filename, testEvs(now-100, 1, 2, 3, 4, 5, 6), testEvs(now-50, 7, 8, 9))
+	p := &property{
+		name:     "default",
+		filename: filename,
+		reportRunner: report.NewRunner(&report.RunnerCfg{
+			Ctx:               ctx,
+			Name:              "default",
+			Filename:          filename,
+			BlockSize:         10,
+			WorkerPoolSize:    2,
+			MinReportInterval: interval,
+			Jobs:              jobs,
+		}),
+	}
+	t.Cleanup(func() {
+		cancel()
+		p.reportRunner.Wait()
+	})
+	a := &App{
+		ctx:           ctx,
+		properties:    map[string]*property{p.name: p},
+		propertyNames: []string{p.name},
+	}
+	return a, p
+}
+
+// getReport gets the path from the app
+func getReport(a *App, path string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	a.handleRequest(w, httptest.NewRequest("GET", path, nil))
+	return w
+}
+
+func lastHour() time.Time {
+	return time.Now().Add(-time.Hour)
+}
+
+// TestReportCacheControl checks that the last result is cached until the next run,
+// & past results that were replaced, & diffs between them, for good.
+func TestReportCacheControl(t *testing.T) {
+	a, p := newReportTestApp(t, 300*time.Millisecond, map[string]*report.Job{
+		"top": {Report: &report.Top{N: 3, MinEvTime: lastHour}, History: 10},
+	})
+	// wait for results in two seconds, as results are requested to the second
+	deadline := time.Now().Add(5 * time.Second)
+	var history []*report.Result
+	for ; time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		history = p.reportRunner.History("top")
+		if len(history) > 1 && history[len(history)-1].GeneratedAt.Unix() > history[0].GeneratedAt.Unix() {
+			break
+		}
+	}
+	if len(history) < 2 {
+		t.Fatal("no past result")
+	}
+	past := strconv.FormatInt(history[0].GeneratedAt.Unix(), 10)
+	future := strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10)
+	tests := []struct {
+		path      string
+		immutable bool
+	}{
+		{"/r?name=top", false},
+		{"/r?name=top&at=" + past, true},
+		{"/r?name=top&at=" + future, false},
+		{"/r/diff?name=top&from=" + past, false},
+		{"/r/diff?name=top&from=" + past + "&to=" + past, true},
+		{"/r/diff?name=top&from=" + past + "&to=" + future, false},
+	}
+	for _, tt := range tests {
+		w := getReport(a, tt.path)
+		if w.Code != 200 {
+			t.Errorf("%s got %d: %s", tt.path, w.Code, w.Body)
+			continue
+		}
+		cc := w.Header().Get("Cache-Control")
+		if immutable := strings.HasSuffix(cc, ", immutable"); immutable != tt.immutable {
+			t.Errorf("%s has Cache-Control %q, want immutable %v", tt.path, cc, tt.immutable)
+		}
+		if !tt.immutable && cc != "public, max-age=0" {
+			t.Errorf("%s has Cache-Control %q, want a max-age until the next run", tt.path, cc)
+		}
+	}
+}
+
+func TestCacheControl(t *testing.T) {
+	tests := []struct {
+		nextRun time.Time
+		want    string
+	}{
+		{time.Time{}, "public, max-age=86400, immutable"},
+		{time.Now().Add(time.Minute + time.Second/2), "public, max-age=60"},
+		{time.Now().Add(-time.Minute), "public, max-age=0"},
+	}
+	for _, tt := range tests {
+		if got := cacheControl(tt.nextRun); got != tt.want {
+			t.Errorf("cacheControl(%v) = %q, want %q", tt.nextRun, got, tt.want)
+		}
+	}
+}
+
+func TestReportQuery(t *testing.T) {
+	a, p := newReportTestApp(t, time.Hour, map[string]*report.Job{
+		"views": {Report: &report.Views{MinEvTime: lastHour}},
+		"share": {Report: &report.Share{GroupBy: report.GroupByReferrer, MinEvTime: lastHour}},
+	})
+	deadline := time.Now().Add(5 * time.Second)
+	for _, name := range []string{"views", "share"} {
+		for _, exists := p.reportRunner.Result(name); !exists && time.Now().Before(deadline); _, exists = p.reportRunner.Result(name) {
+			time.Sleep(time.Millisecond)
+		}
+	}
+	tests := []struct {
+		path string
+		code int
+		body string
+	}{
+		{"/r?name=views&cid=1,2&sort=cid", 200, `[{"cid":1,"views":3},{"cid":2,"views":3}]`},
+		{"/r?name=views&limit=1&property=default", 200, `{"0":3}`},
+		{"/r?name=views&cid=x", 400, ""},
+		{"/r?name=views&limit=-1", 400, ""},
+		{"/r?name=views&sort=time", 400, ""},
+		{"/r?name=views&from=1", 400, ""},
+		{"/r?name=share&cid=1", 400, ""},
+		{"/r?name=views&at=x", 400, ""},
+	}
+	for _, tt := range tests {
+		w := getReport(a, tt.path)
+		if w.Code != tt.code {
+			t.Errorf("%s got %d, want %d: %s", tt.path, w.Code, tt.code, w.Body)
+			continue
+		}
+		if tt.body != "" && w.Body.String() != tt.body {
+			t.Errorf("%s got %s, want %s", tt.path, w.Body, tt.body)
+		}
+	}
+}
+
+// countingQuery counts the queries of results
+type countingQuery struct {
+	queries int
+}
+
+func (c *countingQuery) Query(result *report.Result, q url.Values) (*report.Result, error) {
+	c.queries++
+	if q.Has("invalid") {
+		return nil, fmt.Errorf("%w: invalid", report.ErrInvalidQuery)
+	}
+	return &report.Result{ContentType: "application/json", Content: []byte(q.Encode())}, nil
+}
+
+func TestQueryCache(t *testing.T) {
+	qr := &countingQuery{}
+	c := &queryCache{}
+	base := &report.Result{}
+	query := func(name string, base *report.Result, query string, wantQueries int) *report.Result {
+		t.Helper()
+		params, err := url.ParseQuery(query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		result, err := c.query(qr, name, base, params)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if qr.queries != wantQueries {
+			t.Errorf("%s?%s: %d queries, want %d", name, query, qr.queries, wantQueries)
+		}
+		return result
+	}
+	first := query("views", base, "cid=1&limit=2", 1)
+	if first.ETag == "" {
+		t.Error("cached result was not prepared")
+	}
+	if query("views", base, "limit=2&cid=1", 1) != first {
+		t.Error("query in another order was not cached")
+	}
+	query("top", base, "cid=1&limit=2", 2)
+	query("views", base, "cid=1", 3)
+
+	// the next run replaces the result queried
+	next := &report.Result{}
+	if query("views", next, "cid=1&limit=2", 4) == first {
+		t.Error("query of the next result got that of the previous one")
+	}
+	query("views", next, "cid=1&limit=2", 4)
+
+	c.clear()
+	query("views", next, "cid=1&limit=2", 5)
+
+	// invalid queries are not cached
+	for i := 0; i < 2; i++ {
+		params := url.Values{"invalid": {""}}
+		if _, err := c.query(qr, "views", next, params); !errors.Is(err, report.ErrInvalidQuery) {
+			t.Fatalf("got error %v, want %v", err, report.ErrInvalidQuery)
+		}
+	}
+	if qr.queries != 7 {
+		t.Errorf("%d queries, want 7", qr.queries)
+	}
+
+	// the cache is bounded
+	for i := 0; i < maxQueryCacheEntries+1; i++ {
+		query("views", next, "cid="+strconv.Itoa(i), 8+i)
+	}
+	if len(c.entries) > maxQueryCacheEntries {
+		t.Errorf("cache has %d entries, more than %d", len(c.entries), maxQueryCacheEntries)
+	}
+}
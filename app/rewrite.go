@@ -0,0 +1,148 @@
+package app
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/swissinfo-ch/zoe/codec"
+	"github.com/swissinfo-ch/zoe/ev"
+	"github.com/swissinfo-ch/zoe/report"
+)
+
+// rewriteFunc writes the blocks between start & end of src to dst.
+// It is called once for the file as it was when the rewrite started,
+// then once more with final set, for the blocks appended meanwhile.
+type rewriteFunc func(src io.ReaderAt, start, end int64, dst io.Writer, final bool) error
+
+// blockRef is the position of a compressed block in a file.
+type blockRef struct {
+	offset int64
+	length int64
+	layout ev.Layout
+	codec  byte
+}
+
+// rewriteFile rewrites an events file through write, to a temporary file
+// that atomically replaces it. The lock is only held for the final call
+// to write & the rename, so the writer is blocked for as short as possible.
+// Readers that opened the file before the rename keep reading the old file.
+// The index is rebuilt from the temporary file, also mostly without the lock.
+func rewriteFile(filename string, lock sync.Locker, write rewriteFunc) error {
+	src, err := os.Open(filename)
+	if err != nil {
+		return fmt.Errorf("failed to open file for reading: %w", err)
+	}
+	defer src.Close()
+	info, err := src.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to stat file: %w", err)
+	}
+	size := info.Size()
+
+	tmpFilename := filename + ".rewrite"
+	dst, err := os.OpenFile(tmpFilename, os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to create temporary file: %w", err)
+	}
+	defer os.Remove(tmpFilename) // no-op once renamed
+	defer dst.Close()
+
+	if err := write(src, 0, size, dst, false); err != nil {
+		return err
+	}
+	dstInfo, err := dst.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to stat temporary file: %w", err)
+	}
+	index, err := report.ScanIndex(dst, 0, dstInfo.Size())
+	if err != nil {
+		return err
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+	info, err = src.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to stat file: %w", err)
+	}
+	if err := write(src, size, info.Size(), dst, true); err != nil {
+		return err
+	}
+	if err := dst.Sync(); err != nil {
+		return fmt.Errorf("failed to sync temporary file: %w", err)
+	}
+	dstEnd, err := dst.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to stat temporary file: %w", err)
+	}
+	appended, err := report.ScanIndex(dst, dstInfo.Size(), dstEnd.Size())
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(tmpFilename, filename); err != nil {
+		return fmt.Errorf("failed to replace file: %w", err)
+	}
+	// the index is checked against the file when read, so it is replaced after it
+	return report.WriteIndex(filename, append(index, appended...))
+}
+
+// blockRefs returns the positions of the blocks between start & end, oldest first.
+func blockRefs(file io.ReaderAt, start, end int64) ([]blockRef, error) {
+	refs := make([]blockRef, 0)
+	br := report.NewBlockRangeReader(file, start, end)
+	for {
+		raw, err := br.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		refs = append(refs, blockRef{
+			offset: raw.Offset,
+			length: int64(len(raw.Data)),
+			layout: raw.Layout,
+			codec:  raw.Codec,
+		})
+	}
+	// reverse, as blocks are read newest first
+	for i, j := 0, len(refs)-1; i < j; i, j = i+1, j-1 {
+		refs[i], refs[j] = refs[j], refs[i]
+	}
+	return refs, nil
+}
+
+// readRawBlock reads the compressed block at ref.
+func readRawBlock(file io.ReaderAt, ref blockRef) (*report.RawBlock, error) {
+	data := make([]byte, ref.length)
+	if _, err := file.ReadAt(data, ref.offset); err != nil {
+		return nil, fmt.Errorf("failed to read block at offset %d: %w", ref.offset, err)
+	}
+	return &report.RawBlock{
+		Offset: ref.offset,
+		Layout: ref.layout,
+		Codec:  ref.codec,
+		Data:   data,
+	}, nil
+}
+
+// writeRawBlock writes a compressed block as it is, followed by its layout, codec & length.
+func writeRawBlock(raw *report.RawBlock, w io.Writer) error {
+	c, err := codec.ByID(raw.Codec)
+	if err != nil {
+		return err
+	}
+	suffix, err := codec.Suffix(byte(raw.Layout), c, len(raw.Data))
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(raw.Data); err != nil {
+		return fmt.Errorf("failed to write block: %w", err)
+	}
+	if _, err := w.Write(suffix); err != nil {
+		return fmt.Errorf("failed to write block length: %w", err)
+	}
+	return nil
+}
@@ -17,12 +17,22 @@ func (a *App) handleRoot(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	data := struct {
-		Commit      string
+	type propertyData struct {
+		Name        string
 		ReportNames []string
+	}
+	data := struct {
+		Commit     string
+		Properties []propertyData
 	}{
-		Commit:      a.commit,
-		ReportNames: a.reportNames,
+		Commit:     a.commit,
+		Properties: make([]propertyData, 0, len(a.propertyNames)),
+	}
+	for _, name := range a.propertyNames {
+		data.Properties = append(data.Properties, propertyData{
+			Name:        name,
+			ReportNames: a.properties[name].reportNames,
+		})
 	}
 
 	err = t.Execute(w, data)
@@ -9,26 +9,61 @@ import (
 
 // Status is a JSON-serializable struct for the /stat endpoint.
 type Status struct {
+	Properties  map[string]*PropertyStatus `json:"properties"`            // status per property
+	Commit      string                     `json:"commit"`                // Git commit hash
+	NumCPU      int                        `json:"numCPU"`                // number of CPU cores
+	BotRuleHits map[string]uint64          `json:"botRuleHits,omitempty"` // number of events flagged per bot rule
+}
+
+// PropertyStatus is the status of a property's events file & reports.
+type PropertyStatus struct {
 	FileSize                int64  `json:"fileSize"`                // in bytes
 	CurrentReportEventCount uint32 `json:"currentReportEventCount"` // number of events in the current report so far
 	LastReportEventCount    uint32 `json:"lastReportEventCount"`    // number of events in the last report
 	LastReportDuration      string `json:"lastReportDuration"`      // duration of the last report
 	LastReportTime          int64  `json:"lastReportTime"`          // Unix timestamp of the last report
-	Commit                  string `json:"commit"`                  // Git commit hash
-	NumCPU                  int    `json:"numCPU"`                  // number of CPU cores
+	RollupCells             int    `json:"rollupCells,omitempty"`   // number of cells in the rollup
+	// number of events sent to each job in the last report, until it returned
+	JobEventCounts map[string]uint32  `json:"jobEventCounts"`
+	JobRuns        map[string]*JobRun `json:"jobRuns"` // runs of each job, on its schedule
+}
+
+// JobRun is the last & next run of a report job.
+type JobRun struct {
+	LastRun int64 `json:"lastRun"` // Unix timestamp of the end of the last run
+	NextRun int64 `json:"nextRun"` // Unix timestamp of the next run
 }
 
 // handleGetStatus is the HTTP handler for the /stat endpoint.
 func (a *App) handleGetStatus(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	s := &Status{
-		FileSize:                a.reportRunner.FileSize(),
-		CurrentReportEventCount: a.reportRunner.CurrentReportEventCount(),
-		LastReportEventCount:    a.reportRunner.LastReportEventCount(),
-		LastReportDuration:      jfmt.FmtDuration(a.reportRunner.LastReportDuration()),
-		LastReportTime:          a.reportRunner.LastReportTime().Unix(),
-		Commit:                  a.commit,
-		NumCPU:                  a.numCPU,
+		Properties: make(map[string]*PropertyStatus, len(a.properties)),
+		Commit:     a.commit,
+		NumCPU:     a.numCPU,
+	}
+	for name, p := range a.properties {
+		s.Properties[name] = &PropertyStatus{
+			FileSize:                p.reportRunner.FileSize(),
+			CurrentReportEventCount: p.reportRunner.CurrentReportEventCount(),
+			LastReportEventCount:    p.reportRunner.LastReportEventCount(),
+			LastReportDuration:      jfmt.FmtDuration(p.reportRunner.LastReportDuration()),
+			LastReportTime:          p.reportRunner.LastReportTime().Unix(),
+			JobEventCounts:          p.reportRunner.LastJobEventCounts(),
+			JobRuns:                 make(map[string]*JobRun),
+		}
+		for jobName, job := range p.reportRunner.Jobs() {
+			s.Properties[name].JobRuns[jobName] = &JobRun{
+				LastRun: job.LastRun().Unix(),
+				NextRun: job.NextRun().Unix(),
+			}
+		}
+		if p.rollup != nil {
+			s.Properties[name].RollupCells = p.rollup.Cells()
+		}
+	}
+	if a.botFilter != nil {
+		s.BotRuleHits = a.botFilter.Hits()
 	}
 	data, err := json.MarshalIndent(s, "", "  ")
 	if err != nil {
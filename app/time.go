@@ -0,0 +1,35 @@
+package app
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+)
+
+// ParseTime parses a Unix timestamp or an RFC 3339 time.
+func ParseTime(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, fmt.Errorf("missing time")
+	}
+	if unix, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Unix(unix, 0), nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid time %q, must be a Unix timestamp or RFC 3339", s)
+	}
+	return t, nil
+}
+
+// parseEvTime parses a time as ParseTime, as the Unix time of events.
+func parseEvTime(s string) (uint32, error) {
+	t, err := ParseTime(s)
+	if err != nil {
+		return 0, err
+	}
+	if t.Unix() < 0 || t.Unix() > math.MaxUint32 {
+		return 0, fmt.Errorf("time %q is out of the range of events", s)
+	}
+	return uint32(t.Unix()), nil
+}
@@ -9,6 +9,10 @@ function randCidForNow() {
 // TODO get the current article id
 const cid = randCidForNow()
 
+// consent level, one of none, anonymous or full,
+// set window.zoeConsent before loading this script
+const consent = window.zoeConsent || "full"
+
 // set user and session id
 if (!localStorage.usr) {
   localStorage.usr = randId()
@@ -27,6 +31,7 @@ setInterval(async () => {
       "USR": localStorage.usr,
       "SESS": sessionStorage.sess,
       "CID": cid,
+      "CONSENT": consent,
     }
   })
 }, 5000)
@@ -42,11 +47,34 @@ window.addEventListener("beforeunload", async() => {
       "USR": localStorage.usr,
       "SESS": sessionStorage.sess,
       "CID": cid,
+      "CONSENT": consent,
     }
   })
 })
 
-// send LOAD
+// track sends a custom event, declared in ZOE_CUSTOM_EV_TYPES,
+// with an optional integer value, eg. zoe.track("VIDEO_PLAY")
+window.zoe = {
+  track: (type, value) => {
+    const headers = {
+      "TYPE": type,
+      "USR": localStorage.usr,
+      "SESS": sessionStorage.sess,
+      "CID": cid,
+      "CONSENT": consent,
+    }
+    if (value !== undefined) {
+      headers["VALUE"] = value
+    }
+    return fetch("https://zoe.swissinfo.ch", {
+      method: "POST",
+      headers,
+    })
+  }
+}
+
+// send LOAD with the referrer & the url of the page,
+// as the Referer header is only the origin under the default referrer policy
 fetch("https://zoe.swissinfo.ch", {
   method: "POST",
   headers: {
@@ -54,5 +82,8 @@ fetch("https://zoe.swissinfo.ch", {
     "USR": localStorage.usr,
     "SESS": sessionStorage.sess,
     "CID": cid,
+    "CONSENT": consent,
+    "REFERRER": document.referrer,
+    "PAGE": location.href,
   }
 })
@@ -0,0 +1,249 @@
+package bot
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/swissinfo-ch/zoe/ev"
+)
+
+const (
+	RuleEmptyUserAgent = "ua-empty"
+	RuleHeartbeatRate  = "heartbeat-rate"
+	RulePageSeconds    = "page-seconds"
+)
+
+// builtinPatterns are case-insensitive User-Agent substrings
+// of crawlers, synthetic monitors & http libraries.
+// "bot" only matches when followed by "/", ";" or "-", or preceded by "-",
+// eg. Googlebot/2.1, PetalBot; or my-bot, so that device names like CUBOT,
+// followed by a space or "_", & words like Abbott are not matched.
+var builtinPatterns = []string{
+	"bot/",
+	"bot;",
+	"bot-",
+	"-bot",
+	"robot",
+	"telegrambot",
+	"crawl",
+	"spider",
+	"slurp",
+	"headless",
+	"lighthouse",
+	"pingdom",
+	"uptimerobot",
+	"datadogsynthetics",
+	"site24x7",
+	"newrelicpinger",
+	"catchpoint",
+	"ruxitsynthetic",
+	"checkly",
+	"gtmetrix",
+	"phantomjs",
+	"selenium",
+	"facebookexternalhit",
+	"bingpreview",
+	"python-requests",
+	"go-http-client",
+	"curl/",
+	"wget/",
+	"okhttp",
+	"axios/",
+	"node-fetch",
+}
+
+type FilterCfg struct {
+	Ctx                    context.Context
+	PatternsFile           string        // optional file with one User-Agent pattern per line
+	MaxHeartbeatsPerMinute int           // max TIME events per session per minute
+	MaxPageSeconds         uint32        // max plausible PAGE_SECONDS
+	SessionTTL             time.Duration // sessions not seen for this long are forgotten
+}
+
+// Filter classifies tracking events as bot traffic,
+// by User-Agent & by behaviour per session.
+type Filter struct {
+	ctx                    context.Context
+	patterns               []string
+	maxHeartbeatsPerMinute int
+	maxPageSeconds         uint32
+	sessionTTL             time.Duration
+	sessions               map[uint32]*session
+	sessMu                 sync.Mutex
+	hits                   map[string]*atomic.Uint64 // rule -> hits, keys fixed at construction
+}
+
+type session struct {
+	lastSeen    time.Time
+	loadTimes   map[uint32]time.Time // cid -> first LOAD, absent if we didn't see it
+	windowStart time.Time
+	heartbeats  int
+	rule        string // set once the session is classified as a bot
+}
+
+const defaultSessionTTL = 30 * time.Minute
+
+// NewFilter creates a new Filter, loading patterns from cfg.PatternsFile if set.
+// SessionTTL defaults to 30 minutes.
+func NewFilter(cfg *FilterCfg) (*Filter, error) {
+	sessionTTL := cfg.SessionTTL
+	if sessionTTL <= 0 {
+		sessionTTL = defaultSessionTTL
+	}
+	f := &Filter{
+		ctx:                    cfg.Ctx,
+		patterns:               append([]string{}, builtinPatterns...),
+		maxHeartbeatsPerMinute: cfg.MaxHeartbeatsPerMinute,
+		maxPageSeconds:         cfg.MaxPageSeconds,
+		sessionTTL:             sessionTTL,
+		sessions:               make(map[uint32]*session),
+		hits:                   make(map[string]*atomic.Uint64),
+	}
+	if cfg.PatternsFile != "" {
+		patterns, err := readPatterns(cfg.PatternsFile)
+		if err != nil {
+			return nil, err
+		}
+		f.patterns = append(f.patterns, patterns...)
+	}
+	for _, p := range f.patterns {
+		f.hits[uaRule(p)] = &atomic.Uint64{}
+	}
+	f.hits[RuleEmptyUserAgent] = &atomic.Uint64{}
+	f.hits[RuleHeartbeatRate] = &atomic.Uint64{}
+	f.hits[RulePageSeconds] = &atomic.Uint64{}
+	go f.cleanupSessions()
+	return f, nil
+}
+
+// Classify returns the name of the first matching rule,
+// or an empty string if the event looks human.
+func (f *Filter) Classify(userAgent string, e *ev.Ev) string {
+	rule := f.classifyUserAgent(userAgent)
+	if rule == "" {
+		rule = f.classifyBehaviour(e)
+	}
+	if rule != "" {
+		f.hits[rule].Add(1)
+	}
+	return rule
+}
+
+// Hits returns the number of hits per rule.
+func (f *Filter) Hits() map[string]uint64 {
+	hits := make(map[string]uint64, len(f.hits))
+	for rule, n := range f.hits {
+		hits[rule] = n.Load()
+	}
+	return hits
+}
+
+func (f *Filter) classifyUserAgent(userAgent string) string {
+	if userAgent == "" {
+		return RuleEmptyUserAgent
+	}
+	userAgent = strings.ToLower(userAgent)
+	for _, p := range f.patterns {
+		if strings.Contains(userAgent, p) {
+			return uaRule(p)
+		}
+	}
+	return ""
+}
+
+// classifyBehaviour flags sessions that send heartbeats faster than
+// the client does, or report more page seconds than is possible.
+// Page seconds are checked against the first LOAD of the page in the session,
+// so that pages open in several tabs are not flagged.
+// Once flagged, all further events of the session are flagged.
+func (f *Filter) classifyBehaviour(e *ev.Ev) string {
+	now := time.Now()
+	f.sessMu.Lock()
+	defer f.sessMu.Unlock()
+	s, exists := f.sessions[e.Sess]
+	if !exists {
+		s = &session{windowStart: now, loadTimes: make(map[uint32]time.Time)}
+		f.sessions[e.Sess] = s
+	}
+	s.lastSeen = now
+	if s.rule != "" {
+		return s.rule
+	}
+	switch e.EvType {
+	case ev.EvType_LOAD:
+		if _, exists := s.loadTimes[e.Cid]; !exists {
+			s.loadTimes[e.Cid] = now
+		}
+	case ev.EvType_TIME:
+		if now.Sub(s.windowStart) > time.Minute {
+			s.windowStart = now
+			s.heartbeats = 0
+		}
+		s.heartbeats++
+		if f.maxHeartbeatsPerMinute > 0 && s.heartbeats > f.maxHeartbeatsPerMinute {
+			s.rule = RuleHeartbeatRate
+			break
+		}
+		pageSeconds := e.GetPageSeconds()
+		if f.maxPageSeconds > 0 && pageSeconds > f.maxPageSeconds {
+			s.rule = RulePageSeconds
+			break
+		}
+		// allow some slack for clock skew & request latency
+		loadTime, loaded := s.loadTimes[e.Cid]
+		if loaded && time.Duration(pageSeconds)*time.Second > now.Sub(loadTime)+10*time.Second {
+			s.rule = RulePageSeconds
+		}
+	}
+	return s.rule
+}
+
+// cleanupSessions removes sessions that have not been seen for sessionTTL.
+func (f *Filter) cleanupSessions() {
+	for {
+		select {
+		case <-f.ctx.Done():
+			return
+		case <-time.After(f.sessionTTL):
+			f.sessMu.Lock()
+			for sess, s := range f.sessions {
+				if time.Since(s.lastSeen) > f.sessionTTL {
+					delete(f.sessions, sess)
+				}
+			}
+			f.sessMu.Unlock()
+		}
+	}
+}
+
+func uaRule(pattern string) string {
+	return "ua:" + pattern
+}
+
+// readPatterns reads one pattern per line, ignoring blank lines & # comments.
+func readPatterns(filename string) ([]string, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open bot patterns file: %w", err)
+	}
+	defer file.Close()
+	patterns := make([]string, 0)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		patterns = append(patterns, strings.ToLower(line))
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read bot patterns file: %w", err)
+	}
+	return patterns, nil
+}
@@ -0,0 +1,138 @@
+package bot
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/swissinfo-ch/zoe/ev"
+)
+
+func TestClassifyUserAgent(t *testing.T) {
+	f, err := NewFilter(&FilterCfg{Ctx: context.Background()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		userAgent string
+		bot       bool
+	}{
+		{"Mozilla/5.0 (compatible; Googlebot/2.1; +http://www.google.com/bot.html)", true},
+		{"Mozilla/5.0 (compatible; bingbot/2.0; +http://www.bing.com/bingbot.htm)", true},
+		{"Mozilla/5.0 (compatible; AhrefsBot/7.0; +http://ahrefs.com/robot/)", true},
+		{"Mozilla/5.0 (compatible; YandexBot/3.0; +http://yandex.com/bots)", true},
+		{"Mozilla/5.0 (compatible; PetalBot;+https://webmaster.petalsearch.com/site/petalbot)", true},
+		{"DuckDuckBot-Https/1.1; (+https://duckduckgo.com/duckduckbot)", true},
+		{"Slackbot-LinkExpanding 1.0 (+https://api.slack.com/robots)", true},
+		{"TelegramBot (like TwitterBot)", true},
+		{"Mozilla/5.0 (compatible; my-bot)", true},
+		{"facebookexternalhit/1.1 (+http://www.facebook.com/externalhit_uatext.php)", true},
+		{"curl/8.4.0", true},
+		{"Mozilla/5.0 (X11; Linux x86_64) AppleWebKit/537.36 (KHTML, like Gecko) HeadlessChrome/120.0.0.0 Safari/537.36", true},
+		{"Mozilla/5.0 (Linux; Android 10; CUBOT X30 Build/QP1A.190711.020; wv) AppleWebKit/537.36 (KHTML, like Gecko) Version/4.0 Chrome/120.0.6099.144 Mobile Safari/537.36", false},
+		{"Mozilla/5.0 (Linux; Android 9; CUBOT_P30) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/119.0.0.0 Mobile Safari/537.36", false},
+		{"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Safari/537.36 Abbott/1.0", false},
+		{"Mozilla/5.0 (Linux; Android 13; KINGKONG 9 Build/TP1A.220624.014) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Mobile Safari/537.36", false},
+		{"Mozilla/5.0 (iPhone; CPU iPhone OS 17_2 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.2 Mobile/15E148 Safari/604.1", false},
+		{"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Safari/537.36", false},
+		{"Mozilla/5.0 (Macintosh; Intel Mac OS X 14.2; rv:121.0) Gecko/20100101 Firefox/121.0", false},
+	}
+	for _, tt := range tests {
+		rule := f.classifyUserAgent(tt.userAgent)
+		if (rule != "") != tt.bot {
+			t.Errorf("classifyUserAgent(%q) = %q, want bot %v", tt.userAgent, rule, tt.bot)
+		}
+	}
+}
+
+func TestNewFilterSessionTTL(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	f, err := NewFilter(&FilterCfg{Ctx: ctx})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.sessionTTL != defaultSessionTTL {
+		t.Errorf("session ttl is %v, want %v", f.sessionTTL, defaultSessionTTL)
+	}
+}
+
+func TestClassifyBehaviour(t *testing.T) {
+	pageSeconds := func(s uint32) *uint32 { return &s }
+	load := func(sess, cid uint32) *ev.Ev {
+		return &ev.Ev{EvType: ev.EvType_LOAD, Sess: sess, Cid: cid}
+	}
+	heartbeat := func(sess, cid, s uint32) *ev.Ev {
+		return &ev.Ev{EvType: ev.EvType_TIME, Sess: sess, Cid: cid, PageSeconds: pageSeconds(s)}
+	}
+	// ago moves the first LOAD of a page of a session back in time
+	ago := func(f *Filter, sess, cid uint32, d time.Duration) {
+		f.sessions[sess].loadTimes[cid] = time.Now().Add(-d)
+	}
+	tests := []struct {
+		name string
+		run  func(f *Filter) string
+		want string
+	}{
+		{"plausible page seconds", func(f *Filter) string {
+			f.classifyBehaviour(load(1, 1))
+			ago(f, 1, 1, time.Minute)
+			return f.classifyBehaviour(heartbeat(1, 1, 60))
+		}, ""},
+		{"more page seconds than since the load", func(f *Filter) string {
+			f.classifyBehaviour(load(1, 1))
+			return f.classifyBehaviour(heartbeat(1, 1, 60))
+		}, RulePageSeconds},
+		{"more than max page seconds", func(f *Filter) string {
+			return f.classifyBehaviour(heartbeat(1, 1, 7200))
+		}, RulePageSeconds},
+		{"unseen load", func(f *Filter) string {
+			return f.classifyBehaviour(heartbeat(1, 1, 600))
+		}, ""},
+		{"page loaded in a second tab", func(f *Filter) string {
+			f.classifyBehaviour(load(1, 1))
+			ago(f, 1, 1, 2*time.Minute)
+			f.classifyBehaviour(load(1, 2))
+			return f.classifyBehaviour(heartbeat(1, 1, 100))
+		}, ""},
+		{"same page loaded in a second tab", func(f *Filter) string {
+			f.classifyBehaviour(load(1, 1))
+			ago(f, 1, 1, 2*time.Minute)
+			f.classifyBehaviour(load(1, 1))
+			return f.classifyBehaviour(heartbeat(1, 1, 100))
+		}, ""},
+		{"other session", func(f *Filter) string {
+			f.classifyBehaviour(load(1, 1))
+			f.classifyBehaviour(heartbeat(1, 1, 60))
+			return f.classifyBehaviour(load(2, 1))
+		}, ""},
+		{"flagged session", func(f *Filter) string {
+			f.classifyBehaviour(load(1, 1))
+			f.classifyBehaviour(heartbeat(1, 1, 60))
+			return f.classifyBehaviour(load(1, 2))
+		}, RulePageSeconds},
+		{"heartbeat rate", func(f *Filter) string {
+			for i := 0; i < 4; i++ {
+				f.classifyBehaviour(heartbeat(1, 1, 0))
+			}
+			return f.classifyBehaviour(heartbeat(1, 1, 0))
+		}, RuleHeartbeatRate},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			f, err := NewFilter(&FilterCfg{
+				Ctx:                    ctx,
+				MaxHeartbeatsPerMinute: 4,
+				MaxPageSeconds:         3600,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := tt.run(f); got != tt.want {
+				t.Errorf("got rule %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
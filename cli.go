@@ -0,0 +1,226 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/swissinfo-ch/zoe/app"
+	"github.com/swissinfo-ch/zoe/codec"
+	"github.com/swissinfo-ch/zoe/ev"
+	"github.com/swissinfo-ch/zoe/report"
+	"github.com/swissinfo-ch/zoe/rollup"
+)
+
+// runCommand runs a subcommand, such as zoe erase.
+// Commands operate on files offline, while the server is not running.
+func runCommand(args []string) error {
+	switch args[0] {
+	case "erase":
+		return cmdErase(args[1:])
+	case "import":
+		return cmdImport(args[1:])
+	case "inspect":
+		return cmdInspect(args[1:])
+	case "dump":
+		return cmdDump(args[1:])
+	case "verify":
+		return cmdVerify(args[1:])
+	case "repair":
+		return cmdRepair(args[1:])
+	case "rollup":
+		return cmdRollup(args[1:])
+	case "index":
+		return cmdIndex(args[1:])
+	default:
+		return fmt.Errorf("unknown command %s, must be one of erase, import, inspect, dump, verify, repair, rollup or index", args[0])
+	}
+}
+
+// cmdErase removes all events of the given users from an events file.
+func cmdErase(args []string) error {
+	fs := flag.NewFlagSet("erase", flag.ExitOnError)
+	filename := fs.String("file", "events", "events file")
+	usrs := fs.String("usr", "", "comma-separated list of user ids")
+	dryRun := fs.Bool("dry-run", false, "only count the events that would be removed")
+	ref := fs.String("ref", "", "reference of the request, eg. a ticket id, for the audit log")
+	codecName := fs.String("codec", defaultCodec(), "codec of the blocks rewritten")
+	layoutName := fs.String("layout", defaultLayout(), "layout of the blocks rewritten, row or columnar")
+	fs.Parse(args)
+	usrList, err := app.ParseUsrs(*usrs)
+	if err != nil {
+		return err
+	}
+	c, err := codec.ByName(*codecName)
+	if err != nil {
+		return err
+	}
+	layout, err := ev.ParseLayout(*layoutName)
+	if err != nil {
+		return err
+	}
+	res, err := app.Erase(&app.EraseCfg{
+		Filename:    *filename,
+		Usrs:        usrList,
+		DryRun:      *dryRun,
+		Ref:         *ref,
+		RequestedBy: "cli",
+		Layout:      layout,
+		Codec:       c,
+	})
+	if err != nil {
+		return err
+	}
+	if !*dryRun && res.EventsRemoved > 0 {
+		if _, err := rebuildRollup(*filename, false); err != nil {
+			return err
+		}
+		// kept results may hold the events removed, eg. those of a subset
+		if err := os.RemoveAll(report.ResultsDir(*filename)); err != nil {
+			return err
+		}
+	}
+	return printJSON(res)
+}
+
+// cmdImport imports events from NDJSON or another events file.
+func cmdImport(args []string) error {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	filename := fs.String("file", "events", "events file to import into")
+	in := fs.String("in", "-", "file to import, - for stdin")
+	format := fs.String("format", "ndjson", "format of the file to import, ndjson or zoe")
+	blockSize := fs.Int("block-size", 10000, "number of events per block written")
+	codecName := fs.String("codec", defaultCodec(), "codec of the blocks written")
+	layoutName := fs.String("layout", defaultLayout(), "layout of the blocks written, row or columnar")
+	fs.Parse(args)
+	evTypes, err := ev.ParseRegistry(os.Getenv("ZOE_CUSTOM_EV_TYPES"))
+	if err != nil {
+		return err
+	}
+	c, err := codec.ByName(*codecName)
+	if err != nil {
+		return err
+	}
+	layout, err := ev.ParseLayout(*layoutName)
+	if err != nil {
+		return err
+	}
+	src := os.Stdin
+	if *in != "-" {
+		src, err = os.Open(*in)
+		if err != nil {
+			return err
+		}
+		defer src.Close()
+	}
+	res, err := app.Import(&app.ImportCfg{
+		Filename:  *filename,
+		Src:       src,
+		Format:    *format,
+		BlockSize: *blockSize,
+		Layout:    layout,
+		Codec:     c,
+		EvTypes:   evTypes,
+	})
+	if err != nil {
+		return err
+	}
+	if _, err := rebuildRollup(*filename, false); err != nil {
+		return err
+	}
+	return printJSON(res)
+}
+
+// cmdRepair rebuilds an events file from its valid blocks, to a new file.
+func cmdRepair(args []string) error {
+	fs := flag.NewFlagSet("repair", flag.ExitOnError)
+	filename := fs.String("file", "events", "events file to repair")
+	out := fs.String("out", "", "path of the repaired file, defaults to the events file + .repaired")
+	fs.Parse(args)
+	if *out == "" {
+		*out = *filename + ".repaired"
+	}
+	res, err := app.Repair(&app.RepairCfg{
+		Filename: *filename,
+		Out:      *out,
+	})
+	if err != nil {
+		return err
+	}
+	return printJSON(res)
+}
+
+// cmdRollup rebuilds the rollup of an events file from its blocks.
+func cmdRollup(args []string) error {
+	fs := flag.NewFlagSet("rollup", flag.ExitOnError)
+	filename := fs.String("file", "events", "events file")
+	fs.Parse(args)
+	store, err := rebuildRollup(*filename, true)
+	if err != nil {
+		return err
+	}
+	return printJSON(map[string]any{
+		"dir":   rollup.Dir(*filename),
+		"cells": store.Cells(),
+	})
+}
+
+// cmdIndex rebuilds the index of an events file from its blocks.
+func cmdIndex(args []string) error {
+	fs := flag.NewFlagSet("index", flag.ExitOnError)
+	filename := fs.String("file", "events", "events file")
+	fs.Parse(args)
+	entries, err := report.BuildIndex(*filename)
+	if err != nil {
+		return err
+	}
+	return printJSON(map[string]any{
+		"index":  report.IndexFilename(*filename),
+		"blocks": len(entries),
+	})
+}
+
+// rebuildRollup rebuilds the rollup of an events file,
+// unless it does not exist & create is false.
+func rebuildRollup(filename string, create bool) (*rollup.Store, error) {
+	dir := rollup.Dir(filename)
+	if _, err := os.Stat(dir); os.IsNotExist(err) && !create {
+		return nil, nil
+	}
+	store, err := rollup.Open(dir)
+	if err != nil {
+		return nil, err
+	}
+	// commands run while the server is not, so no lock is needed
+	if err := store.Rebuild(filename, &sync.Mutex{}); err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+// defaultCodec returns the codec of ZOE_BLOCK_CODEC, as used by the server, or gzip.
+func defaultCodec() string {
+	if name, ok := os.LookupEnv("ZOE_BLOCK_CODEC"); ok {
+		return name
+	}
+	return codec.Gzip.Name()
+}
+
+// defaultLayout returns the layout of ZOE_BLOCK_LAYOUT, as used by the server, or row.
+func defaultLayout() string {
+	if name, ok := os.LookupEnv("ZOE_BLOCK_LAYOUT"); ok {
+		return name
+	}
+	return ev.LayoutRow.String()
+}
+
+func printJSON(v any) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(data))
+	return nil
+}
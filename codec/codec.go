@@ -0,0 +1,174 @@
+package codec
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Codec compresses block payloads.
+// Its id is stored with each block, so it must never change.
+// Ids are limited to 4 bits.
+type Codec interface {
+	ID() byte
+	Name() string
+	Encode(data []byte) ([]byte, error)
+	Decode(data []byte) ([]byte, error)
+}
+
+// Codec ids. Gzip is 0, as blocks written before codecs were
+// introduced have a length suffix with the top byte unset.
+const (
+	IDGzip   byte = 0
+	IDNone   byte = 1
+	IDZstd   byte = 2
+	IDSnappy byte = 3
+)
+
+// MaxLength is the maximum length of an encoded block.
+// The top byte of the length suffix holds the layout & the codec id.
+const MaxLength = 1<<24 - 1
+
+var (
+	Gzip   Codec = gzipCodec{}
+	None   Codec = noneCodec{}
+	Zstd   Codec = newZstdCodec()
+	Snappy Codec = snappyCodec{}
+)
+
+var codecs = []Codec{Gzip, None, Zstd, Snappy}
+
+// ByName returns the codec with the given name.
+func ByName(name string) (Codec, error) {
+	for _, c := range codecs {
+		if c.Name() == name {
+			return c, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown codec %s, must be one of gzip, none, zstd or snappy", name)
+}
+
+// ByID returns the codec with the given id.
+func ByID(id byte) (Codec, error) {
+	if int(id) >= len(codecs) {
+		return nil, fmt.Errorf("unknown codec id %d", id)
+	}
+	return codecs[id], nil
+}
+
+// Suffix returns the four bytes following a block, big endian, with the
+// layout in the top 4 bits, the codec id in the next 4 & the length in the others.
+func Suffix(layout byte, c Codec, length int) ([]byte, error) {
+	if length > MaxLength {
+		return nil, fmt.Errorf("block of %d bytes exceeds the maximum of %d", length, MaxLength)
+	}
+	suffix := make([]byte, 4)
+	binary.BigEndian.PutUint32(suffix, uint32(layout&0xf)<<28|uint32(c.ID()&0xf)<<24|uint32(length))
+	return suffix, nil
+}
+
+// ParseSuffix returns the layout, the codec id & the length of a block from its suffix.
+func ParseSuffix(suffix []byte) (byte, byte, int64) {
+	v := binary.BigEndian.Uint32(suffix)
+	return byte(v >> 28), byte(v>>24) & 0xf, int64(v & MaxLength)
+}
+
+type gzipCodec struct{}
+
+func (gzipCodec) ID() byte     { return IDGzip }
+func (gzipCodec) Name() string { return "gzip" }
+
+func (gzipCodec) Encode(data []byte) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	gw := gzip.NewWriter(buf)
+	if _, err := gw.Write(data); err != nil {
+		return nil, fmt.Errorf("failed to write gzip data: %w", err)
+	}
+	// the gzip writer must be closed to flush all data
+	if err := gw.Close(); err != nil {
+		return nil, fmt.Errorf("failed to close gzip writer: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+func (gzipCodec) Decode(data []byte) ([]byte, error) {
+	gzr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create gzip reader: %w", err)
+	}
+	defer gzr.Close()
+	decoded, err := io.ReadAll(gzr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress gzip data: %w", err)
+	}
+	return decoded, nil
+}
+
+type noneCodec struct{}
+
+func (noneCodec) ID() byte     { return IDNone }
+func (noneCodec) Name() string { return "none" }
+
+func (noneCodec) Encode(data []byte) ([]byte, error) {
+	return data, nil
+}
+
+func (noneCodec) Decode(data []byte) ([]byte, error) {
+	return data, nil
+}
+
+// zstdCodec shares an encoder & a decoder, as both are safe
+// for concurrent use with EncodeAll & DecodeAll.
+type zstdCodec struct {
+	enc *zstd.Encoder
+	dec *zstd.Decoder
+}
+
+func newZstdCodec() *zstdCodec {
+	enc, err := zstd.NewWriter(nil)
+	if err != nil {
+		panic(err)
+	}
+	dec, err := zstd.NewReader(nil, zstd.WithDecoderConcurrency(0))
+	if err != nil {
+		panic(err)
+	}
+	return &zstdCodec{enc: enc, dec: dec}
+}
+
+func (*zstdCodec) ID() byte     { return IDZstd }
+func (*zstdCodec) Name() string { return "zstd" }
+
+func (c *zstdCodec) Encode(data []byte) ([]byte, error) {
+	return c.enc.EncodeAll(data, nil), nil
+}
+
+func (c *zstdCodec) Decode(data []byte) ([]byte, error) {
+	decoded, err := c.dec.DecodeAll(data, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress zstd data: %w", err)
+	}
+	return decoded, nil
+}
+
+type snappyCodec struct{}
+
+func (snappyCodec) ID() byte     { return IDSnappy }
+func (snappyCodec) Name() string { return "snappy" }
+
+func (snappyCodec) Encode(data []byte) ([]byte, error) {
+	return snappy.Encode(nil, data), nil
+}
+
+func (snappyCodec) Decode(data []byte) ([]byte, error) {
+	decoded, err := snappy.Decode(nil, data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress snappy data: %w", err)
+	}
+	return decoded, nil
+}
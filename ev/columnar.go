@@ -0,0 +1,499 @@
+package ev
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"math/bits"
+)
+
+// Layout is the encoding of a block's events, before compression.
+type Layout byte
+
+const (
+	LayoutRow      Layout = 0 // a Block message, each event is a full Ev
+	LayoutColumnar Layout = 1 // each field is a column, see EncodeColumnar
+)
+
+// ParseLayout returns the layout with the given name, row or columnar.
+func ParseLayout(name string) (Layout, error) {
+	switch name {
+	case "row":
+		return LayoutRow, nil
+	case "columnar":
+		return LayoutColumnar, nil
+	default:
+		return 0, fmt.Errorf("unknown block layout %s, must be one of row or columnar", name)
+	}
+}
+
+func (l Layout) String() string {
+	switch l {
+	case LayoutRow:
+		return "row"
+	case LayoutColumnar:
+		return "columnar"
+	default:
+		return fmt.Sprintf("layout(%d)", byte(l))
+	}
+}
+
+// Columns is a set of fields of Ev.
+// Reports declare the columns they read, so other columns are not decoded.
+type Columns uint32
+
+// The bit index of each column is its id in a columnar block, so it must never change.
+const (
+	ColEvType Columns = 1 << iota
+	ColTime
+	ColUsr
+	ColSess
+	ColCid
+	ColPageSeconds
+	ColScrolled
+	ColBot
+	ColReferrer
+	ColDevice
+	ColCountry
+	ColCustomType
+	ColValue
+	ColConsent
+	AllColumns Columns = 1<<iota - 1
+)
+
+const numColumns = 14
+
+// ErrCorrupt is returned when a columnar block is truncated or its framing is invalid.
+var ErrCorrupt = errors.New("corrupt columnar block")
+
+var errTruncated = fmt.Errorf("%w: truncated column", ErrCorrupt)
+
+// EncodeColumnar encodes a block in the columnar layout:
+//
+//	uvarint event count
+//	uvarint column count, then per column its id (byte) & length (uvarint)
+//	the columns, in the order of the directory
+//
+// Columns where no event has a value are left out. EvType, Consent are a byte
+// per event, Time is zigzag varint deltas, Usr & Sess are fixed 4 bytes,
+// little endian, & Cid is a dictionary followed by a uvarint index per event.
+// Bot is a bitmap. Optional fields are sparse: a bitmap of the events
+// that have a value, followed by the values.
+func EncodeColumnar(b *Block) []byte {
+	evs := b.Evs
+	cols := make([][]byte, numColumns)
+	cols[colIndex(ColEvType)] = encodeBytes(evs, func(e *Ev) byte { return byte(e.EvType) })
+	cols[colIndex(ColTime)] = encodeTime(evs)
+	cols[colIndex(ColUsr)] = encodeFixed(evs, func(e *Ev) uint32 { return e.Usr })
+	cols[colIndex(ColSess)] = encodeFixed(evs, func(e *Ev) uint32 { return e.Sess })
+	cols[colIndex(ColCid)] = encodeCid(evs)
+	cols[colIndex(ColPageSeconds)] = encodeSparse(evs,
+		func(e *Ev) bool { return e.PageSeconds != nil },
+		func(dst []byte, e *Ev) []byte { return binary.AppendUvarint(dst, uint64(*e.PageSeconds)) })
+	cols[colIndex(ColScrolled)] = encodeSparse(evs,
+		func(e *Ev) bool { return e.Scrolled != nil },
+		func(dst []byte, e *Ev) []byte {
+			return binary.LittleEndian.AppendUint32(dst, math.Float32bits(*e.Scrolled))
+		})
+	cols[colIndex(ColBot)] = encodeBitmap(evs, func(e *Ev) bool { return e.Bot })
+	cols[colIndex(ColReferrer)] = encodeSparse(evs,
+		func(e *Ev) bool { return e.Referrer != nil },
+		func(dst []byte, e *Ev) []byte { return append(dst, byte(*e.Referrer)) })
+	cols[colIndex(ColDevice)] = encodeSparse(evs,
+		func(e *Ev) bool { return e.Device != nil },
+		func(dst []byte, e *Ev) []byte { return append(dst, byte(*e.Device)) })
+	cols[colIndex(ColCountry)] = encodeCountry(evs)
+	cols[colIndex(ColCustomType)] = encodeSparse(evs,
+		func(e *Ev) bool { return e.CustomType != nil },
+		func(dst []byte, e *Ev) []byte { return binary.AppendUvarint(dst, uint64(*e.CustomType)) })
+	cols[colIndex(ColValue)] = encodeSparse(evs,
+		func(e *Ev) bool { return e.Value != nil },
+		func(dst []byte, e *Ev) []byte { return binary.AppendVarint(dst, int64(*e.Value)) })
+	cols[colIndex(ColConsent)] = encodeBytes(evs, func(e *Ev) byte { return byte(e.Consent) })
+
+	present := 0
+	size := 0
+	for _, col := range cols {
+		if col != nil {
+			present++
+			size += len(col)
+		}
+	}
+	data := make([]byte, 0, size+3*present+10)
+	data = binary.AppendUvarint(data, uint64(len(evs)))
+	data = binary.AppendUvarint(data, uint64(present))
+	for id, col := range cols {
+		if col != nil {
+			data = append(data, byte(id))
+			data = binary.AppendUvarint(data, uint64(len(col)))
+		}
+	}
+	for _, col := range cols {
+		data = append(data, col...)
+	}
+	return data
+}
+
+// DecodeColumnar decodes the given columns of a columnar block.
+// Fields of other columns are left unset.
+func DecodeColumnar(data []byte, cols Columns) (*Block, error) {
+	r := &colReader{data: data}
+	n := r.uvarint()
+	present := r.uvarint()
+	if r.err != nil {
+		return nil, fmt.Errorf("invalid columnar header: %w", r.err)
+	}
+	// checked before converting to int, which huge counts would overflow
+	if n > uint64(len(data)) || present > numColumns {
+		return nil, fmt.Errorf("%w: invalid header: %d events, %d columns", ErrCorrupt, n, present)
+	}
+	type colRef struct {
+		id     int
+		length int
+	}
+	dir := make([]colRef, present)
+	size := 0
+	for i := range dir {
+		id := r.byte()
+		length := r.uvarint()
+		if r.err != nil {
+			return nil, fmt.Errorf("invalid column directory: %w", r.err)
+		}
+		if id >= numColumns || length > uint64(len(data)) {
+			return nil, fmt.Errorf("%w: invalid column %d of %d bytes", ErrCorrupt, id, length)
+		}
+		dir[i] = colRef{id: int(id), length: int(length)}
+		size += dir[i].length
+	}
+	if size != len(r.data) {
+		return nil, fmt.Errorf("%w: columns of %d bytes do not match %d bytes left", ErrCorrupt, size, len(r.data))
+	}
+
+	evs := make([]Ev, n)
+	block := &Block{Evs: make([]*Ev, n)}
+	for i := range evs {
+		block.Evs[i] = &evs[i]
+	}
+	for _, ref := range dir {
+		col := r.bytes(ref.length)
+		if cols&(1<<ref.id) == 0 {
+			continue
+		}
+		cr := &colReader{data: col}
+		decodeColumn(cr, Columns(1<<ref.id), block.Evs)
+		if cr.err == nil && len(cr.data) > 0 {
+			cr.err = fmt.Errorf("%w: %d bytes left", ErrCorrupt, len(cr.data))
+		}
+		if cr.err != nil {
+			return nil, fmt.Errorf("invalid column %d: %w", ref.id, cr.err)
+		}
+	}
+	return block, nil
+}
+
+func decodeColumn(r *colReader, col Columns, evs []*Ev) {
+	n := len(evs)
+	switch col {
+	case ColEvType:
+		for i, b := range r.bytes(n) {
+			evs[i].EvType = EvType(b)
+		}
+	case ColTime:
+		t := int64(0)
+		for _, e := range evs {
+			t += r.varint()
+			e.Time = uint32(t)
+		}
+	case ColUsr:
+		for _, e := range evs {
+			e.Usr = r.fixed32()
+		}
+	case ColSess:
+		for _, e := range evs {
+			e.Sess = r.fixed32()
+		}
+	case ColCid:
+		dictLen := r.uvarint()
+		if dictLen > uint64(len(r.data)) {
+			r.fail()
+			return
+		}
+		dict := make([]uint32, dictLen)
+		for i := range dict {
+			dict[i] = uint32(r.uvarint())
+		}
+		for _, e := range evs {
+			idx := r.uvarint()
+			if idx >= uint64(len(dict)) {
+				r.fail()
+				return
+			}
+			e.Cid = dict[idx]
+		}
+	case ColPageSeconds:
+		present := r.bitmap(evs)
+		values := make([]uint32, len(present))
+		for i, e := range present {
+			values[i] = uint32(r.uvarint())
+			e.PageSeconds = &values[i]
+		}
+	case ColScrolled:
+		present := r.bitmap(evs)
+		values := make([]float32, len(present))
+		for i, e := range present {
+			values[i] = math.Float32frombits(r.fixed32())
+			e.Scrolled = &values[i]
+		}
+	case ColBot:
+		for _, e := range r.bitmap(evs) {
+			e.Bot = true
+		}
+	case ColReferrer:
+		present := r.bitmap(evs)
+		values := make([]Referrer, len(present))
+		for i, e := range present {
+			values[i] = Referrer(r.byte())
+			e.Referrer = &values[i]
+		}
+	case ColDevice:
+		present := r.bitmap(evs)
+		values := make([]Device, len(present))
+		for i, e := range present {
+			values[i] = Device(r.byte())
+			e.Device = &values[i]
+		}
+	case ColCountry:
+		dictLen := r.uvarint()
+		if dictLen > uint64(len(r.data)) {
+			r.fail()
+			return
+		}
+		dict := make([]string, dictLen)
+		for i := range dict {
+			dict[i] = string(r.bytes(int(r.uvarint())))
+		}
+		for _, e := range r.bitmap(evs) {
+			idx := r.uvarint()
+			if idx >= uint64(len(dict)) {
+				r.fail()
+				return
+			}
+			e.Country = &dict[idx]
+		}
+	case ColCustomType:
+		present := r.bitmap(evs)
+		values := make([]uint32, len(present))
+		for i, e := range present {
+			values[i] = uint32(r.uvarint())
+			e.CustomType = &values[i]
+		}
+	case ColValue:
+		present := r.bitmap(evs)
+		values := make([]int32, len(present))
+		for i, e := range present {
+			values[i] = int32(r.varint())
+			e.Value = &values[i]
+		}
+	case ColConsent:
+		for i, b := range r.bytes(n) {
+			evs[i].Consent = Consent(b)
+		}
+	}
+}
+
+func colIndex(col Columns) int {
+	return bits.TrailingZeros32(uint32(col))
+}
+
+// encodeBytes returns a byte per event, or nil if all are zero.
+func encodeBytes(evs []*Ev, value func(*Ev) byte) []byte {
+	col := make([]byte, len(evs))
+	nonZero := false
+	for i, e := range evs {
+		col[i] = value(e)
+		nonZero = nonZero || col[i] != 0
+	}
+	if !nonZero {
+		return nil
+	}
+	return col
+}
+
+func encodeTime(evs []*Ev) []byte {
+	col := make([]byte, 0, len(evs)+binary.MaxVarintLen32)
+	prev := int64(0)
+	for _, e := range evs {
+		col = binary.AppendVarint(col, int64(e.Time)-prev)
+		prev = int64(e.Time)
+	}
+	return col
+}
+
+func encodeFixed(evs []*Ev, value func(*Ev) uint32) []byte {
+	col := make([]byte, 0, 4*len(evs))
+	for _, e := range evs {
+		col = binary.LittleEndian.AppendUint32(col, value(e))
+	}
+	return col
+}
+
+func encodeCid(evs []*Ev) []byte {
+	indexes := make(map[uint32]uint64)
+	dict := make([]uint32, 0)
+	for _, e := range evs {
+		if _, ok := indexes[e.Cid]; !ok {
+			indexes[e.Cid] = uint64(len(dict))
+			dict = append(dict, e.Cid)
+		}
+	}
+	col := binary.AppendUvarint(nil, uint64(len(dict)))
+	for _, cid := range dict {
+		col = binary.AppendUvarint(col, uint64(cid))
+	}
+	for _, e := range evs {
+		col = binary.AppendUvarint(col, indexes[e.Cid])
+	}
+	return col
+}
+
+func encodeCountry(evs []*Ev) []byte {
+	indexes := make(map[string]uint64)
+	dict := make([]string, 0)
+	for _, e := range evs {
+		if e.Country == nil {
+			continue
+		}
+		if _, ok := indexes[*e.Country]; !ok {
+			indexes[*e.Country] = uint64(len(dict))
+			dict = append(dict, *e.Country)
+		}
+	}
+	if len(dict) == 0 {
+		return nil
+	}
+	col := binary.AppendUvarint(nil, uint64(len(dict)))
+	for _, country := range dict {
+		col = binary.AppendUvarint(col, uint64(len(country)))
+		col = append(col, country...)
+	}
+	return encodeSparseTo(col, evs,
+		func(e *Ev) bool { return e.Country != nil },
+		func(dst []byte, e *Ev) []byte { return binary.AppendUvarint(dst, indexes[*e.Country]) })
+}
+
+// encodeBitmap returns a bit per event, or nil if none is set.
+func encodeBitmap(evs []*Ev, set func(*Ev) bool) []byte {
+	bitmap := make([]byte, (len(evs)+7)/8)
+	nonZero := false
+	for i, e := range evs {
+		if set(e) {
+			bitmap[i/8] |= 1 << (i % 8)
+			nonZero = true
+		}
+	}
+	if !nonZero {
+		return nil
+	}
+	return bitmap
+}
+
+// encodeSparse returns a bitmap of the events with a value, followed by
+// their values, or nil if no event has a value.
+func encodeSparse(evs []*Ev, has func(*Ev) bool, appendValue func([]byte, *Ev) []byte) []byte {
+	return encodeSparseTo(nil, evs, has, appendValue)
+}
+
+func encodeSparseTo(col []byte, evs []*Ev, has func(*Ev) bool, appendValue func([]byte, *Ev) []byte) []byte {
+	bitmap := encodeBitmap(evs, has)
+	if bitmap == nil {
+		return nil
+	}
+	col = append(col, bitmap...)
+	for _, e := range evs {
+		if has(e) {
+			col = appendValue(col, e)
+		}
+	}
+	return col
+}
+
+// colReader reads the values of a column. After an error, it returns zero values.
+type colReader struct {
+	data []byte
+	err  error
+}
+
+func (r *colReader) fail() {
+	if r.err == nil {
+		r.err = errTruncated
+	}
+	r.data = nil
+}
+
+func (r *colReader) uvarint() uint64 {
+	v, n := binary.Uvarint(r.data)
+	if n <= 0 {
+		r.fail()
+		return 0
+	}
+	r.data = r.data[n:]
+	return v
+}
+
+func (r *colReader) varint() int64 {
+	v, n := binary.Varint(r.data)
+	if n <= 0 {
+		r.fail()
+		return 0
+	}
+	r.data = r.data[n:]
+	return v
+}
+
+func (r *colReader) byte() byte {
+	if len(r.data) < 1 {
+		r.fail()
+		return 0
+	}
+	b := r.data[0]
+	r.data = r.data[1:]
+	return b
+}
+
+func (r *colReader) fixed32() uint32 {
+	if len(r.data) < 4 {
+		r.fail()
+		return 0
+	}
+	v := binary.LittleEndian.Uint32(r.data)
+	r.data = r.data[4:]
+	return v
+}
+
+func (r *colReader) bytes(n int) []byte {
+	if n < 0 || len(r.data) < n {
+		r.fail()
+		return nil
+	}
+	b := r.data[:n]
+	r.data = r.data[n:]
+	return b
+}
+
+// bitmap reads a bitmap & returns the events whose bit is set.
+func (r *colReader) bitmap(evs []*Ev) []*Ev {
+	bitmap := r.bytes((len(evs) + 7) / 8)
+	set := make([]*Ev, 0)
+	for i := range bitmap {
+		for b := bitmap[i]; b != 0; b &= b - 1 {
+			j := i*8 + bits.TrailingZeros8(b)
+			if j >= len(evs) {
+				r.fail()
+				return nil
+			}
+			set = append(set, evs[j])
+		}
+	}
+	return set
+}
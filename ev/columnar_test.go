@@ -0,0 +1,117 @@
+package ev
+
+import (
+	"errors"
+	"math/rand"
+	"testing"
+
+	"google.golang.org/protobuf/proto"
+)
+
+func TestColumnarEmptyBlock(t *testing.T) {
+	block, err := DecodeColumnar(EncodeColumnar(&Block{}), AllColumns)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(block.Evs) != 0 {
+		t.Errorf("decoded %d events, want 0", len(block.Evs))
+	}
+}
+
+func TestColumnarRoundTrip(t *testing.T) {
+	unset := []*Ev{
+		{EvType: EvType_LOAD, Time: 1700000000, Usr: 1, Sess: 2, Cid: 3},
+		{EvType: EvType_UNLOAD, Time: 1699999990, Usr: 4, Sess: 5, Cid: 3},
+		{Time: 1700000010},
+	}
+	set := make([]*Ev, 0)
+	for i := 0; i < 20; i++ {
+		set = append(set, &Ev{
+			EvType:      EvType_CUSTOM,
+			Time:        1700000000 + uint32(i),
+			Usr:         ^uint32(0) - uint32(i),
+			Sess:        uint32(i),
+			Cid:         uint32(i % 3),
+			PageSeconds: proto.Uint32(uint32(i * 10)),
+			Scrolled:    proto.Float32(float32(i) / 20),
+			Bot:         true,
+			Referrer:    Referrer(i % 4).Enum(),
+			Device:      Device(i % 3).Enum(),
+			Country:     proto.String([]string{"CH", "DE", "FR"}[i%3]),
+			CustomType:  proto.Uint32(uint32(i % 2)),
+			Value:       proto.Int32(int32(i) - 10),
+			Consent:     Consent(i % 3),
+		})
+	}
+	tests := []struct {
+		name string
+		evs  []*Ev
+	}{
+		{"optional fields unset", unset},
+		{"all fields set", set},
+		{"mixed", append(append([]*Ev{}, unset...), set...)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			want := &Block{Evs: tt.evs}
+			got, err := DecodeColumnar(EncodeColumnar(want), AllColumns)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !proto.Equal(got, want) {
+				t.Errorf("decoded %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestColumnarDecodeColumns(t *testing.T) {
+	data := EncodeColumnar(&Block{Evs: []*Ev{
+		{EvType: EvType_LOAD, Time: 1700000000, Usr: 1, Cid: 3, Country: proto.String("CH")},
+	}})
+	block, err := DecodeColumnar(data, ColCid|ColTime)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &Ev{Time: 1700000000, Cid: 3}
+	if !proto.Equal(block.Evs[0], want) {
+		t.Errorf("decoded %v, want %v", block.Evs[0], want)
+	}
+}
+
+func TestColumnarCorrupt(t *testing.T) {
+	evs := make([]*Ev, 0)
+	for i := 0; i < 50; i++ {
+		evs = append(evs, &Ev{
+			EvType:      EvType_TIME,
+			Time:        1700000000 + uint32(i),
+			Cid:         uint32(i % 5),
+			PageSeconds: proto.Uint32(uint32(i)),
+			Country:     proto.String("CH"),
+		})
+	}
+	data := EncodeColumnar(&Block{Evs: evs})
+	for n := 0; n < len(data); n++ {
+		if _, err := DecodeColumnar(data[:n], AllColumns); !errors.Is(err, ErrCorrupt) {
+			t.Fatalf("decoding %d of %d bytes returned %v, want ErrCorrupt", n, len(data), err)
+		}
+	}
+	if _, err := DecodeColumnar(append(data, 0), AllColumns); !errors.Is(err, ErrCorrupt) {
+		t.Errorf("decoding a trailing byte returned %v, want ErrCorrupt", err)
+	}
+	// corrupt bytes may still decode, but must not panic
+	rnd := rand.New(rand.NewSource(1))
+	for i := 0; i < 10000; i++ {
+		corrupt := append([]byte{}, data...)
+		for j := 0; j < 1+rnd.Intn(4); j++ {
+			corrupt[rnd.Intn(len(corrupt))] = byte(rnd.Intn(256))
+		}
+		if _, err := DecodeColumnar(corrupt, AllColumns); err != nil && !errors.Is(err, ErrCorrupt) {
+			t.Fatalf("decoding corrupt bytes returned %v, want ErrCorrupt", err)
+		}
+	}
+	// a huge event count
+	if _, err := DecodeColumnar([]byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01, 0}, AllColumns); !errors.Is(err, ErrCorrupt) {
+		t.Errorf("decoding a huge event count returned %v, want ErrCorrupt", err)
+	}
+}
@@ -27,6 +27,7 @@ const (
 	EvType_LOAD   EvType = 0 // Once per page load per session
 	EvType_UNLOAD EvType = 1 // Once per page unload per session
 	EvType_TIME   EvType = 2 // Time spent on a page
+	EvType_CUSTOM EvType = 3 // Custom event type, declared in the registry
 )
 
 // Enum value maps for EvType.
@@ -35,11 +36,13 @@ var (
 		0: "LOAD",
 		1: "UNLOAD",
 		2: "TIME",
+		3: "CUSTOM",
 	}
 	EvType_value = map[string]int32{
 		"LOAD":   0,
 		"UNLOAD": 1,
 		"TIME":   2,
+		"CUSTOM": 3,
 	}
 )
 
@@ -70,6 +73,165 @@ func (EvType) EnumDescriptor() ([]byte, []int) {
 	return file_ev_proto_rawDescGZIP(), []int{0}
 }
 
+// Referrer is the class of traffic source.
+type Referrer int32
+
+const (
+	Referrer_DIRECT     Referrer = 0 // No referrer
+	Referrer_SEARCH     Referrer = 1 // Search engine or paid search
+	Referrer_SOCIAL     Referrer = 2 // Social network
+	Referrer_INTERNAL   Referrer = 3 // Same site
+	Referrer_NEWSLETTER Referrer = 4 // Email newsletter
+	Referrer_EXTERNAL   Referrer = 5 // Any other site
+)
+
+// Enum value maps for Referrer.
+var (
+	Referrer_name = map[int32]string{
+		0: "DIRECT",
+		1: "SEARCH",
+		2: "SOCIAL",
+		3: "INTERNAL",
+		4: "NEWSLETTER",
+		5: "EXTERNAL",
+	}
+	Referrer_value = map[string]int32{
+		"DIRECT":     0,
+		"SEARCH":     1,
+		"SOCIAL":     2,
+		"INTERNAL":   3,
+		"NEWSLETTER": 4,
+		"EXTERNAL":   5,
+	}
+)
+
+func (x Referrer) Enum() *Referrer {
+	p := new(Referrer)
+	*p = x
+	return p
+}
+
+func (x Referrer) String() string {
+	return protoimpl.X.EnumStringOf(x.Descriptor(), protoreflect.EnumNumber(x))
+}
+
+func (Referrer) Descriptor() protoreflect.EnumDescriptor {
+	return file_ev_proto_enumTypes[1].Descriptor()
+}
+
+func (Referrer) Type() protoreflect.EnumType {
+	return &file_ev_proto_enumTypes[1]
+}
+
+func (x Referrer) Number() protoreflect.EnumNumber {
+	return protoreflect.EnumNumber(x)
+}
+
+// Deprecated: Use Referrer.Descriptor instead.
+func (Referrer) EnumDescriptor() ([]byte, []int) {
+	return file_ev_proto_rawDescGZIP(), []int{1}
+}
+
+// Device is the class of device, derived from the User-Agent.
+type Device int32
+
+const (
+	Device_DESKTOP Device = 0
+	Device_MOBILE  Device = 1
+	Device_TABLET  Device = 2
+)
+
+// Enum value maps for Device.
+var (
+	Device_name = map[int32]string{
+		0: "DESKTOP",
+		1: "MOBILE",
+		2: "TABLET",
+	}
+	Device_value = map[string]int32{
+		"DESKTOP": 0,
+		"MOBILE":  1,
+		"TABLET":  2,
+	}
+)
+
+func (x Device) Enum() *Device {
+	p := new(Device)
+	*p = x
+	return p
+}
+
+func (x Device) String() string {
+	return protoimpl.X.EnumStringOf(x.Descriptor(), protoreflect.EnumNumber(x))
+}
+
+func (Device) Descriptor() protoreflect.EnumDescriptor {
+	return file_ev_proto_enumTypes[2].Descriptor()
+}
+
+func (Device) Type() protoreflect.EnumType {
+	return &file_ev_proto_enumTypes[2]
+}
+
+func (x Device) Number() protoreflect.EnumNumber {
+	return protoreflect.EnumNumber(x)
+}
+
+// Deprecated: Use Device.Descriptor instead.
+func (Device) EnumDescriptor() ([]byte, []int) {
+	return file_ev_proto_rawDescGZIP(), []int{2}
+}
+
+// Consent is the consent level given by the reader.
+type Consent int32
+
+const (
+	Consent_FULL      Consent = 0 // Usr & Sess are stored as sent
+	Consent_ANONYMOUS Consent = 1 // Usr is replaced by a daily-rotating salted hash of Sess
+	Consent_NONE      Consent = 2 // Usr & Sess are not stored
+)
+
+// Enum value maps for Consent.
+var (
+	Consent_name = map[int32]string{
+		0: "FULL",
+		1: "ANONYMOUS",
+		2: "NONE",
+	}
+	Consent_value = map[string]int32{
+		"FULL":      0,
+		"ANONYMOUS": 1,
+		"NONE":      2,
+	}
+)
+
+func (x Consent) Enum() *Consent {
+	p := new(Consent)
+	*p = x
+	return p
+}
+
+func (x Consent) String() string {
+	return protoimpl.X.EnumStringOf(x.Descriptor(), protoreflect.EnumNumber(x))
+}
+
+func (Consent) Descriptor() protoreflect.EnumDescriptor {
+	return file_ev_proto_enumTypes[3].Descriptor()
+}
+
+func (Consent) Type() protoreflect.EnumType {
+	return &file_ev_proto_enumTypes[3]
+}
+
+func (x Consent) Number() protoreflect.EnumNumber {
+	return protoreflect.EnumNumber(x)
+}
+
+// Deprecated: Use Consent.Descriptor instead.
+func (Consent) EnumDescriptor() ([]byte, []int) {
+	return file_ev_proto_rawDescGZIP(), []int{3}
+}
+
 // Ev represents a tracking event.
 // As there are millions, we must aim for
 // optimum use of space.
@@ -81,13 +243,20 @@ type Ev struct {
 	sizeCache     protoimpl.SizeCache
 	unknownFields protoimpl.UnknownFields
 
-	EvType      EvType   `protobuf:"varint,1,opt,name=evType,proto3,enum=EvType" json:"evType,omitempty"`
-	Time        uint32   `protobuf:"varint,2,opt,name=time,proto3" json:"time,omitempty"` // good until year 2106
-	Usr         uint32   `protobuf:"fixed32,3,opt,name=usr,proto3" json:"usr,omitempty"`
-	Sess        uint32   `protobuf:"fixed32,4,opt,name=sess,proto3" json:"sess,omitempty"`
-	Cid         uint32   `protobuf:"varint,5,opt,name=cid,proto3" json:"cid,omitempty"`
-	PageSeconds *uint32  `protobuf:"varint,6,opt,name=pageSeconds,proto3,oneof" json:"pageSeconds,omitempty"`
-	Scrolled    *float32 `protobuf:"fixed32,7,opt,name=scrolled,proto3,oneof" json:"scrolled,omitempty"`
+	EvType      EvType    `protobuf:"varint,1,opt,name=evType,proto3,enum=EvType" json:"evType,omitempty"`
+	Time        uint32    `protobuf:"varint,2,opt,name=time,proto3" json:"time,omitempty"` // good until year 2106
+	Usr         uint32    `protobuf:"fixed32,3,opt,name=usr,proto3" json:"usr,omitempty"`
+	Sess        uint32    `protobuf:"fixed32,4,opt,name=sess,proto3" json:"sess,omitempty"`
+	Cid         uint32    `protobuf:"varint,5,opt,name=cid,proto3" json:"cid,omitempty"`
+	PageSeconds *uint32   `protobuf:"varint,6,opt,name=pageSeconds,proto3,oneof" json:"pageSeconds,omitempty"`
+	Scrolled    *float32  `protobuf:"fixed32,7,opt,name=scrolled,proto3,oneof" json:"scrolled,omitempty"`
+	Bot         bool      `protobuf:"varint,8,opt,name=bot,proto3" json:"bot,omitempty"` // set when the event was classified as bot traffic
+	Referrer    *Referrer `protobuf:"varint,9,opt,name=referrer,proto3,enum=Referrer,oneof" json:"referrer,omitempty"`
+	Device      *Device   `protobuf:"varint,10,opt,name=device,proto3,enum=Device,oneof" json:"device,omitempty"`
+	Country     *string   `protobuf:"bytes,11,opt,name=country,proto3,oneof" json:"country,omitempty"`         // ISO 3166-1 alpha-2 code
+	CustomType  *uint32   `protobuf:"varint,12,opt,name=customType,proto3,oneof" json:"customType,omitempty"`  // id of the custom event type, if evType is CUSTOM
+	Value       *int32    `protobuf:"zigzag32,13,opt,name=value,proto3,oneof" json:"value,omitempty"`          // optional value of a custom event
+	Consent     Consent   `protobuf:"varint,14,opt,name=consent,proto3,enum=Consent" json:"consent,omitempty"` // consent level of the reader, FULL for events stored before consent was recorded
 }
 
 func (x *Ev) Reset() {
@@ -171,6 +340,55 @@ func (x *Ev) GetScrolled() float32 {
 	return 0
 }
 
+func (x *Ev) GetBot() bool {
+	if x != nil {
+		return x.Bot
+	}
+	return false
+}
+
+func (x *Ev) GetReferrer() Referrer {
+	if x != nil && x.Referrer != nil {
+		return *x.Referrer
+	}
+	return Referrer_DIRECT
+}
+
+func (x *Ev) GetDevice() Device {
+	if x != nil && x.Device != nil {
+		return *x.Device
+	}
+	return Device_DESKTOP
+}
+
+func (x *Ev) GetCountry() string {
+	if x != nil && x.Country != nil {
+		return *x.Country
+	}
+	return ""
+}
+
+func (x *Ev) GetCustomType() uint32 {
+	if x != nil && x.CustomType != nil {
+		return *x.CustomType
+	}
+	return 0
+}
+
+func (x *Ev) GetValue() int32 {
+	if x != nil && x.Value != nil {
+		return *x.Value
+	}
+	return 0
+}
+
+func (x *Ev) GetConsent() Consent {
+	if x != nil {
+		return x.Consent
+	}
+	return Consent_FULL
+}
+
 // Block is a collection of events.
 type Block struct {
 	state         protoimpl.MessageState
@@ -222,7 +440,7 @@ func (x *Block) GetEvs() []*Ev {
 var File_ev_proto protoreflect.FileDescriptor
 
 var file_ev_proto_rawDesc = []byte{
-	0x0a, 0x08, 0x65, 0x76, 0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x22, 0xd6, 0x01, 0x0a, 0x02, 0x45,
+	0x0a, 0x08, 0x65, 0x76, 0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x22, 0xfa, 0x03, 0x0a, 0x02, 0x45,
 	0x76, 0x12, 0x1f, 0x0a, 0x06, 0x65, 0x76, 0x54, 0x79, 0x70, 0x65, 0x18, 0x01, 0x20, 0x01, 0x28,
 	0x0e, 0x32, 0x07, 0x2e, 0x45, 0x76, 0x54, 0x79, 0x70, 0x65, 0x52, 0x06, 0x65, 0x76, 0x54, 0x79,
 	0x70, 0x65, 0x12, 0x12, 0x0a, 0x04, 0x74, 0x69, 0x6d, 0x65, 0x18, 0x02, 0x20, 0x01, 0x28, 0x0d,
@@ -234,14 +452,45 @@ var file_ev_proto_rawDesc = []byte{
 	0x01, 0x28, 0x0d, 0x48, 0x00, 0x52, 0x0b, 0x70, 0x61, 0x67, 0x65, 0x53, 0x65, 0x63, 0x6f, 0x6e,
 	0x64, 0x73, 0x88, 0x01, 0x01, 0x12, 0x1f, 0x0a, 0x08, 0x73, 0x63, 0x72, 0x6f, 0x6c, 0x6c, 0x65,
 	0x64, 0x18, 0x07, 0x20, 0x01, 0x28, 0x02, 0x48, 0x01, 0x52, 0x08, 0x73, 0x63, 0x72, 0x6f, 0x6c,
-	0x6c, 0x65, 0x64, 0x88, 0x01, 0x01, 0x42, 0x0e, 0x0a, 0x0c, 0x5f, 0x70, 0x61, 0x67, 0x65, 0x53,
-	0x65, 0x63, 0x6f, 0x6e, 0x64, 0x73, 0x42, 0x0b, 0x0a, 0x09, 0x5f, 0x73, 0x63, 0x72, 0x6f, 0x6c,
-	0x6c, 0x65, 0x64, 0x22, 0x1e, 0x0a, 0x05, 0x42, 0x6c, 0x6f, 0x63, 0x6b, 0x12, 0x15, 0x0a, 0x03,
-	0x65, 0x76, 0x73, 0x18, 0x01, 0x20, 0x03, 0x28, 0x0b, 0x32, 0x03, 0x2e, 0x45, 0x76, 0x52, 0x03,
-	0x65, 0x76, 0x73, 0x2a, 0x28, 0x0a, 0x06, 0x45, 0x76, 0x54, 0x79, 0x70, 0x65, 0x12, 0x08, 0x0a,
-	0x04, 0x4c, 0x4f, 0x41, 0x44, 0x10, 0x00, 0x12, 0x0a, 0x0a, 0x06, 0x55, 0x4e, 0x4c, 0x4f, 0x41,
-	0x44, 0x10, 0x01, 0x12, 0x08, 0x0a, 0x04, 0x54, 0x49, 0x4d, 0x45, 0x10, 0x02, 0x42, 0x06, 0x5a,
-	0x04, 0x2e, 0x2f, 0x65, 0x76, 0x62, 0x06, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x33,
+	0x6c, 0x65, 0x64, 0x88, 0x01, 0x01, 0x12, 0x10, 0x0a, 0x03, 0x62, 0x6f, 0x74, 0x18, 0x08, 0x20,
+	0x01, 0x28, 0x08, 0x52, 0x03, 0x62, 0x6f, 0x74, 0x12, 0x2a, 0x0a, 0x08, 0x72, 0x65, 0x66, 0x65,
+	0x72, 0x72, 0x65, 0x72, 0x18, 0x09, 0x20, 0x01, 0x28, 0x0e, 0x32, 0x09, 0x2e, 0x52, 0x65, 0x66,
+	0x65, 0x72, 0x72, 0x65, 0x72, 0x48, 0x02, 0x52, 0x08, 0x72, 0x65, 0x66, 0x65, 0x72, 0x72, 0x65,
+	0x72, 0x88, 0x01, 0x01, 0x12, 0x24, 0x0a, 0x06, 0x64, 0x65, 0x76, 0x69, 0x63, 0x65, 0x18, 0x0a,
+	0x20, 0x01, 0x28, 0x0e, 0x32, 0x07, 0x2e, 0x44, 0x65, 0x76, 0x69, 0x63, 0x65, 0x48, 0x03, 0x52,
+	0x06, 0x64, 0x65, 0x76, 0x69, 0x63, 0x65, 0x88, 0x01, 0x01, 0x12, 0x1d, 0x0a, 0x07, 0x63, 0x6f,
+	0x75, 0x6e, 0x74, 0x72, 0x79, 0x18, 0x0b, 0x20, 0x01, 0x28, 0x09, 0x48, 0x04, 0x52, 0x07, 0x63,
+	0x6f, 0x75, 0x6e, 0x74, 0x72, 0x79, 0x88, 0x01, 0x01, 0x12, 0x23, 0x0a, 0x0a, 0x63, 0x75, 0x73,
+	0x74, 0x6f, 0x6d, 0x54, 0x79, 0x70, 0x65, 0x18, 0x0c, 0x20, 0x01, 0x28, 0x0d, 0x48, 0x05, 0x52,
+	0x0a, 0x63, 0x75, 0x73, 0x74, 0x6f, 0x6d, 0x54, 0x79, 0x70, 0x65, 0x88, 0x01, 0x01, 0x12, 0x19,
+	0x0a, 0x05, 0x76, 0x61, 0x6c, 0x75, 0x65, 0x18, 0x0d, 0x20, 0x01, 0x28, 0x11, 0x48, 0x06, 0x52,
+	0x05, 0x76, 0x61, 0x6c, 0x75, 0x65, 0x88, 0x01, 0x01, 0x12, 0x22, 0x0a, 0x07, 0x63, 0x6f, 0x6e,
+	0x73, 0x65, 0x6e, 0x74, 0x18, 0x0e, 0x20, 0x01, 0x28, 0x0e, 0x32, 0x08, 0x2e, 0x43, 0x6f, 0x6e,
+	0x73, 0x65, 0x6e, 0x74, 0x52, 0x07, 0x63, 0x6f, 0x6e, 0x73, 0x65, 0x6e, 0x74, 0x42, 0x0e, 0x0a,
+	0x0c, 0x5f, 0x70, 0x61, 0x67, 0x65, 0x53, 0x65, 0x63, 0x6f, 0x6e, 0x64, 0x73, 0x42, 0x0b, 0x0a,
+	0x09, 0x5f, 0x73, 0x63, 0x72, 0x6f, 0x6c, 0x6c, 0x65, 0x64, 0x42, 0x0b, 0x0a, 0x09, 0x5f, 0x72,
+	0x65, 0x66, 0x65, 0x72, 0x72, 0x65, 0x72, 0x42, 0x09, 0x0a, 0x07, 0x5f, 0x64, 0x65, 0x76, 0x69,
+	0x63, 0x65, 0x42, 0x0a, 0x0a, 0x08, 0x5f, 0x63, 0x6f, 0x75, 0x6e, 0x74, 0x72, 0x79, 0x42, 0x0d,
+	0x0a, 0x0b, 0x5f, 0x63, 0x75, 0x73, 0x74, 0x6f, 0x6d, 0x54, 0x79, 0x70, 0x65, 0x42, 0x08, 0x0a,
+	0x06, 0x5f, 0x76, 0x61, 0x6c, 0x75, 0x65, 0x22, 0x1e, 0x0a, 0x05, 0x42, 0x6c, 0x6f, 0x63, 0x6b,
+	0x12, 0x15, 0x0a, 0x03, 0x65, 0x76, 0x73, 0x18, 0x01, 0x20, 0x03, 0x28, 0x0b, 0x32, 0x03, 0x2e,
+	0x45, 0x76, 0x52, 0x03, 0x65, 0x76, 0x73, 0x2a, 0x34, 0x0a, 0x06, 0x45, 0x76, 0x54, 0x79, 0x70,
+	0x65, 0x12, 0x08, 0x0a, 0x04, 0x4c, 0x4f, 0x41, 0x44, 0x10, 0x00, 0x12, 0x0a, 0x0a, 0x06, 0x55,
+	0x4e, 0x4c, 0x4f, 0x41, 0x44, 0x10, 0x01, 0x12, 0x08, 0x0a, 0x04, 0x54, 0x49, 0x4d, 0x45, 0x10,
+	0x02, 0x12, 0x0a, 0x0a, 0x06, 0x43, 0x55, 0x53, 0x54, 0x4f, 0x4d, 0x10, 0x03, 0x2a, 0x5a, 0x0a,
+	0x08, 0x52, 0x65, 0x66, 0x65, 0x72, 0x72, 0x65, 0x72, 0x12, 0x0a, 0x0a, 0x06, 0x44, 0x49, 0x52,
+	0x45, 0x43, 0x54, 0x10, 0x00, 0x12, 0x0a, 0x0a, 0x06, 0x53, 0x45, 0x41, 0x52, 0x43, 0x48, 0x10,
+	0x01, 0x12, 0x0a, 0x0a, 0x06, 0x53, 0x4f, 0x43, 0x49, 0x41, 0x4c, 0x10, 0x02, 0x12, 0x0c, 0x0a,
+	0x08, 0x49, 0x4e, 0x54, 0x45, 0x52, 0x4e, 0x41, 0x4c, 0x10, 0x03, 0x12, 0x0e, 0x0a, 0x0a, 0x4e,
+	0x45, 0x57, 0x53, 0x4c, 0x45, 0x54, 0x54, 0x45, 0x52, 0x10, 0x04, 0x12, 0x0c, 0x0a, 0x08, 0x45,
+	0x58, 0x54, 0x45, 0x52, 0x4e, 0x41, 0x4c, 0x10, 0x05, 0x2a, 0x2d, 0x0a, 0x06, 0x44, 0x65, 0x76,
+	0x69, 0x63, 0x65, 0x12, 0x0b, 0x0a, 0x07, 0x44, 0x45, 0x53, 0x4b, 0x54, 0x4f, 0x50, 0x10, 0x00,
+	0x12, 0x0a, 0x0a, 0x06, 0x4d, 0x4f, 0x42, 0x49, 0x4c, 0x45, 0x10, 0x01, 0x12, 0x0a, 0x0a, 0x06,
+	0x54, 0x41, 0x42, 0x4c, 0x45, 0x54, 0x10, 0x02, 0x2a, 0x2c, 0x0a, 0x07, 0x43, 0x6f, 0x6e, 0x73,
+	0x65, 0x6e, 0x74, 0x12, 0x08, 0x0a, 0x04, 0x46, 0x55, 0x4c, 0x4c, 0x10, 0x00, 0x12, 0x0d, 0x0a,
+	0x09, 0x41, 0x4e, 0x4f, 0x4e, 0x59, 0x4d, 0x4f, 0x55, 0x53, 0x10, 0x01, 0x12, 0x08, 0x0a, 0x04,
+	0x4e, 0x4f, 0x4e, 0x45, 0x10, 0x02, 0x42, 0x06, 0x5a, 0x04, 0x2e, 0x2f, 0x65, 0x76, 0x62, 0x06,
+	0x70, 0x72, 0x6f, 0x74, 0x6f, 0x33,
 }
 
 var (
@@ -256,21 +505,27 @@ func file_ev_proto_rawDescGZIP() []byte {
 	return file_ev_proto_rawDescData
 }
 
-var file_ev_proto_enumTypes = make([]protoimpl.EnumInfo, 1)
+var file_ev_proto_enumTypes = make([]protoimpl.EnumInfo, 4)
 var file_ev_proto_msgTypes = make([]protoimpl.MessageInfo, 2)
 var file_ev_proto_goTypes = []interface{}{
 	(EvType)(0),   // 0: EvType
-	(*Ev)(nil),    // 1: Ev
-	(*Block)(nil), // 2: Block
+	(Referrer)(0), // 1: Referrer
+	(Device)(0),   // 2: Device
+	(Consent)(0),  // 3: Consent
+	(*Ev)(nil),    // 4: Ev
+	(*Block)(nil), // 5: Block
 }
 var file_ev_proto_depIdxs = []int32{
 	0, // 0: Ev.evType:type_name -> EvType
-	1, // 1: Block.evs:type_name -> Ev
-	2, // [2:2] is the sub-list for method output_type
-	2, // [2:2] is the sub-list for method input_type
-	2, // [2:2] is the sub-list for extension type_name
-	2, // [2:2] is the sub-list for extension extendee
-	0, // [0:2] is the sub-list for field type_name
+	1, // 1: Ev.referrer:type_name -> Referrer
+	2, // 2: Ev.device:type_name -> Device
+	3, // 3: Ev.consent:type_name -> Consent
+	4, // 4: Block.evs:type_name -> Ev
+	5, // [5:5] is the sub-list for method output_type
+	5, // [5:5] is the sub-list for method input_type
+	5, // [5:5] is the sub-list for extension type_name
+	5, // [5:5] is the sub-list for extension extendee
+	0, // [0:5] is the sub-list for field type_name
 }
 
 func init() { file_ev_proto_init() }
@@ -310,7 +565,7 @@ func file_ev_proto_init() {
 		File: protoimpl.DescBuilder{
 			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
 			RawDescriptor: file_ev_proto_rawDesc,
-			NumEnums:      1,
+			NumEnums:      4,
 			NumMessages:   2,
 			NumExtensions: 0,
 			NumServices:   0,
@@ -0,0 +1,87 @@
+package ev
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Registry maps the names of custom event types to their ids.
+// A nil Registry has no custom event types.
+type Registry struct {
+	ids   map[string]uint32
+	names map[uint32]string
+}
+
+// ParseRegistry parses a registry declared as NAME=id pairs,
+// separated by commas, eg. "VIDEO_PLAY=1,NEWSLETTER_SIGNUP=2".
+func ParseRegistry(s string) (*Registry, error) {
+	r := &Registry{
+		ids:   make(map[string]uint32),
+		names: make(map[uint32]string),
+	}
+	for _, pair := range strings.Split(s, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		name, idStr, ok := strings.Cut(pair, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid custom event type %q, expected NAME=id", pair)
+		}
+		name = strings.ToUpper(strings.TrimSpace(name))
+		if _, builtin := EvType_value[name]; builtin {
+			return nil, fmt.Errorf("custom event type %s collides with a built-in type", name)
+		}
+		id, err := strconv.ParseUint(strings.TrimSpace(idStr), 10, 32)
+		if err != nil || id == 0 {
+			return nil, fmt.Errorf("invalid id for custom event type %s, must be a positive uint32", name)
+		}
+		if _, exists := r.ids[name]; exists {
+			return nil, fmt.Errorf("custom event type %s is declared twice", name)
+		}
+		if other, exists := r.names[uint32(id)]; exists {
+			return nil, fmt.Errorf("custom event types %s & %s share id %d", other, name, id)
+		}
+		r.ids[name] = uint32(id)
+		r.names[uint32(id)] = name
+	}
+	return r, nil
+}
+
+// ID returns the id of the custom event type with the given name.
+func (r *Registry) ID(name string) (uint32, bool) {
+	if r == nil {
+		return 0, false
+	}
+	id, ok := r.ids[name]
+	return id, ok
+}
+
+// Names returns the names of all custom event types, sorted.
+func (r *Registry) Names() []string {
+	if r == nil {
+		return nil
+	}
+	names := make([]string, 0, len(r.ids))
+	for name := range r.ids {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// TypeName returns the name of the event's type, resolving custom types.
+// Custom types missing from the registry are named CUSTOM_<id>.
+func (r *Registry) TypeName(e *Ev) string {
+	if e.EvType != EvType_CUSTOM {
+		return e.EvType.String()
+	}
+	if r != nil {
+		if name, ok := r.names[e.GetCustomType()]; ok {
+			return name
+		}
+	}
+	return "CUSTOM_" + strconv.FormatUint(uint64(e.GetCustomType()), 10)
+}
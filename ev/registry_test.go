@@ -0,0 +1,85 @@
+package ev
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseRegistry(t *testing.T) {
+	tests := []struct {
+		name  string
+		s     string
+		want  map[string]uint32
+		valid bool
+	}{
+		{"empty", "", map[string]uint32{}, true},
+		{"pairs", "VIDEO_PLAY=1,NEWSLETTER_SIGNUP=2", map[string]uint32{"VIDEO_PLAY": 1, "NEWSLETTER_SIGNUP": 2}, true},
+		{"upper-cased", "video_play=1,Share_Click=3", map[string]uint32{"VIDEO_PLAY": 1, "SHARE_CLICK": 3}, true},
+		{"spaces & trailing comma", " VIDEO_PLAY = 1 , ,SHARE_CLICK=3,", map[string]uint32{"VIDEO_PLAY": 1, "SHARE_CLICK": 3}, true},
+		{"max id", "VIDEO_PLAY=4294967295", map[string]uint32{"VIDEO_PLAY": 4294967295}, true},
+		{"missing id", "VIDEO_PLAY", nil, false},
+		{"zero id", "VIDEO_PLAY=0", nil, false},
+		{"negative id", "VIDEO_PLAY=-1", nil, false},
+		{"id out of range", "VIDEO_PLAY=4294967296", nil, false},
+		{"not a number", "VIDEO_PLAY=one", nil, false},
+		{"built-in", "LOAD=1", nil, false},
+		{"built-in lower-case", "load=1", nil, false},
+		{"custom", "CUSTOM=1", nil, false},
+		{"declared twice", "VIDEO_PLAY=1,video_play=2", nil, false},
+		{"shared id", "VIDEO_PLAY=1,SHARE_CLICK=1", nil, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := ParseRegistry(tt.s)
+			if !tt.valid {
+				if err == nil {
+					t.Errorf("ParseRegistry(%q) got no error", tt.s)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(r.ids, tt.want) {
+				t.Errorf("ParseRegistry(%q) has ids %v, want %v", tt.s, r.ids, tt.want)
+			}
+			for name, id := range tt.want {
+				if got, ok := r.ID(name); !ok || got != id {
+					t.Errorf("ID(%s) = %d, %v, want %d", name, got, ok, id)
+				}
+			}
+		})
+	}
+}
+
+func TestRegistryTypeName(t *testing.T) {
+	r, err := ParseRegistry("VIDEO_PLAY=1,SHARE_CLICK=3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	videoPlay, unknown := uint32(1), uint32(2)
+	tests := []struct {
+		r    *Registry
+		e    *Ev
+		want string
+	}{
+		{r, &Ev{EvType: EvType_LOAD}, "LOAD"},
+		{r, &Ev{EvType: EvType_CUSTOM, CustomType: &videoPlay}, "VIDEO_PLAY"},
+		{r, &Ev{EvType: EvType_CUSTOM, CustomType: &unknown}, "CUSTOM_2"},
+		{r, &Ev{EvType: EvType_CUSTOM}, "CUSTOM_0"},
+		{nil, &Ev{EvType: EvType_TIME}, "TIME"},
+		{nil, &Ev{EvType: EvType_CUSTOM, CustomType: &videoPlay}, "CUSTOM_1"},
+	}
+	for _, tt := range tests {
+		if got := tt.r.TypeName(tt.e); got != tt.want {
+			t.Errorf("TypeName(%v) = %s, want %s", tt.e, got, tt.want)
+		}
+	}
+	if want := []string{"SHARE_CLICK", "VIDEO_PLAY"}; !reflect.DeepEqual(r.Names(), want) {
+		t.Errorf("Names() = %v, want %v", r.Names(), want)
+	}
+	var none *Registry
+	if _, ok := none.ID("VIDEO_PLAY"); ok || none.Names() != nil {
+		t.Error("nil registry has custom types")
+	}
+}
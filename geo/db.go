@@ -0,0 +1,94 @@
+package geo
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"net/netip"
+	"os"
+	"sort"
+	"strings"
+)
+
+// DB maps IP ranges to country codes.
+// Only the country code is ever returned, the IP is not kept.
+type DB struct {
+	ranges []ipRange // sorted by start
+}
+
+type ipRange struct {
+	start   netip.Addr
+	end     netip.Addr
+	country string
+}
+
+// Open loads a CSV file of IP ranges, one range per line as
+// start_ip,end_ip,country_code. Both IPv4 & IPv6 ranges are supported.
+// This is the format of the free db-ip.com "IP to Country Lite" database.
+func Open(filename string) (*DB, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open geo db file: %w", err)
+	}
+	defer file.Close()
+	db := &DB{
+		ranges: make([]ipRange, 0),
+	}
+	r := csv.NewReader(file)
+	r.FieldsPerRecord = -1
+	r.Comment = '#'
+	line := 0
+	for {
+		record, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		line++
+		if err != nil {
+			return nil, fmt.Errorf("failed to read geo db line %d: %w", line, err)
+		}
+		if len(record) < 3 {
+			return nil, fmt.Errorf("invalid geo db line %d, expected start_ip,end_ip,country_code", line)
+		}
+		start, err := netip.ParseAddr(strings.TrimSpace(record[0]))
+		if err != nil {
+			return nil, fmt.Errorf("invalid start ip on geo db line %d: %w", line, err)
+		}
+		end, err := netip.ParseAddr(strings.TrimSpace(record[1]))
+		if err != nil {
+			return nil, fmt.Errorf("invalid end ip on geo db line %d: %w", line, err)
+		}
+		db.ranges = append(db.ranges, ipRange{
+			start:   start.Unmap(),
+			end:     end.Unmap(),
+			country: strings.ToUpper(strings.TrimSpace(record[2])),
+		})
+	}
+	sort.Slice(db.ranges, func(i, j int) bool {
+		return db.ranges[i].start.Less(db.ranges[j].start)
+	})
+	return db, nil
+}
+
+// Country returns the country code for the given address,
+// or an empty string if the address is not in any range.
+func (db *DB) Country(addr netip.Addr) string {
+	addr = addr.Unmap()
+	// find the first range starting after addr, the candidate is the one before
+	i := sort.Search(len(db.ranges), func(i int) bool {
+		return addr.Less(db.ranges[i].start)
+	})
+	if i == 0 {
+		return ""
+	}
+	r := db.ranges[i-1]
+	if r.end.Less(addr) {
+		return ""
+	}
+	return r.country
+}
+
+// Len returns the number of ranges.
+func (db *DB) Len() int {
+	return len(db.ranges)
+}
@@ -0,0 +1,101 @@
+package geo
+
+import (
+	"errors"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// openTestDB opens a geo db of the given CSV content
+func openTestDB(t *testing.T, content string) (*DB, error) {
+	t.Helper()
+	filename := filepath.Join(t.TempDir(), "geo.csv")
+	if err := os.WriteFile(filename, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return Open(filename)
+}
+
+func TestOpen(t *testing.T) {
+	if _, err := Open(filepath.Join(t.TempDir(), "missing.csv")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("missing file got error %v, want %v", err, os.ErrNotExist)
+	}
+	tests := []struct {
+		name    string
+		content string
+		ranges  int
+		valid   bool
+	}{
+		{"empty", "", 0, true},
+		{"ranges", "1.0.0.0,1.0.0.255,AU\n2001:db8::,2001:db8::ffff,ch\n", 2, true},
+		{"comments & spaces", "# db-ip.com\n 1.0.0.0 , 1.0.0.255 , AU \n", 1, true},
+		{"extra fields", "1.0.0.0,1.0.0.255,AU,Oceania\n", 1, true},
+		{"missing country", "1.0.0.0,1.0.0.255\n", 0, false},
+		{"invalid start", "1.0.0,1.0.0.255,AU\n", 0, false},
+		{"invalid end", "1.0.0.0,1.0.0.256,AU\n", 0, false},
+		{"bad quotes", "\"1.0.0.0,1.0.0.255,AU\n", 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, err := openTestDB(t, tt.content)
+			if !tt.valid {
+				if err == nil {
+					t.Error("got no error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if db.Len() != tt.ranges {
+				t.Errorf("got %d ranges, want %d", db.Len(), tt.ranges)
+			}
+		})
+	}
+}
+
+func TestCountry(t *testing.T) {
+	// unsorted, as Open sorts the ranges
+	db, err := openTestDB(t, `5.1.0.0,5.1.255.255,ch
+1.0.0.0,1.0.0.255,AU
+2001:db8::,2001:db8::ffff,DE
+1.0.1.0,1.0.3.255,CN
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		addr string
+		want string
+	}{
+		{"1.0.0.0", "AU"},
+		{"1.0.0.128", "AU"},
+		{"1.0.0.255", "AU"},
+		{"1.0.1.0", "CN"},
+		{"1.0.3.255", "CN"},
+		{"1.0.4.0", ""},
+		{"0.255.255.255", ""},
+		{"5.1.2.3", "CH"},
+		{"5.2.0.0", ""},
+		{"::ffff:5.1.2.3", "CH"},
+		{"2001:db8::1", "DE"},
+		{"2001:db8::1:0", ""},
+		{"2001:db7::1", ""},
+		{"255.255.255.255", ""},
+	}
+	for _, tt := range tests {
+		if got := db.Country(netip.MustParseAddr(tt.addr)); got != tt.want {
+			t.Errorf("Country(%s) = %q, want %q", tt.addr, got, tt.want)
+		}
+	}
+
+	empty, err := openTestDB(t, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := empty.Country(netip.MustParseAddr("1.0.0.1")); got != "" {
+		t.Errorf("empty db has country %q", got)
+	}
+}
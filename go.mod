@@ -7,3 +7,9 @@ require google.golang.org/protobuf v1.32.0
 require golang.org/x/time v0.5.0
 
 require github.com/intob/jfmt v0.1.3
+
+require github.com/klauspost/compress v1.18.0
+
+require github.com/golang/snappy v1.0.0
+
+require github.com/andybalholm/brotli v1.2.6
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/swissinfo-ch/zoe/app"
+	"github.com/swissinfo-ch/zoe/codec"
+	"github.com/swissinfo-ch/zoe/ev"
+	"github.com/swissinfo-ch/zoe/report"
+)
+
+// inspectResult is a summary of an events file.
+type inspectResult struct {
+	Filename          string         `json:"filename"`
+	FileSize          int64          `json:"fileSize"`
+	Blocks            int            `json:"blocks"`
+	Events            int            `json:"events"`
+	CompressedBytes   int64          `json:"compressedBytes"`
+	UncompressedBytes int64          `json:"uncompressedBytes"`
+	CompressionRatio  float64        `json:"compressionRatio"`
+	MinBlockBytes     int            `json:"minBlockBytes"`
+	MaxBlockBytes     int            `json:"maxBlockBytes"`
+	MinTime           string         `json:"minTime,omitempty"`
+	MaxTime           string         `json:"maxTime,omitempty"`
+	UnorderedBlocks   int            `json:"unorderedBlocks"` // blocks with events older than the previous block
+	EvTypes           map[string]int `json:"evTypes"`
+	Codecs            map[string]int `json:"codecs"`          // number of blocks of each codec
+	Layouts           map[string]int `json:"layouts"`         // number of blocks of each layout
+	Error             string         `json:"error,omitempty"` // why reading stopped early
+	BlockDetails      []*blockInfo   `json:"blockDetails,omitempty"`
+}
+
+// blockInfo is a summary of a block.
+type blockInfo struct {
+	Offset  int64  `json:"offset"`
+	Codec   string `json:"codec"`
+	Layout  string `json:"layout"`
+	Bytes   int    `json:"bytes"`
+	Events  int    `json:"events"`
+	MinTime uint32 `json:"minTime"`
+	MaxTime uint32 `json:"maxTime"`
+}
+
+// verifyResult lists the invalid blocks of an events file.
+type verifyResult struct {
+	Filename       string         `json:"filename"`
+	Blocks         int            `json:"blocks"`
+	Events         int            `json:"events"`
+	Valid          bool           `json:"valid"`
+	FirstBadOffset *int64         `json:"firstBadOffset,omitempty"`
+	UncheckedBytes int64          `json:"uncheckedBytes"` // before invalid framing, blocks cannot be found
+	Errors         []*verifyError `json:"errors,omitempty"`
+}
+
+type verifyError struct {
+	Offset int64  `json:"offset"`
+	Error  string `json:"error"`
+}
+
+// cmdInspect prints a summary of an events file.
+func cmdInspect(args []string) error {
+	fs := flag.NewFlagSet("inspect", flag.ExitOnError)
+	filename := fs.String("file", "events", "events file")
+	blocks := fs.Bool("blocks", false, "include a summary of each block")
+	fs.Parse(args)
+	evTypes, err := ev.ParseRegistry(os.Getenv("ZOE_CUSTOM_EV_TYPES"))
+	if err != nil {
+		return err
+	}
+	file, size, err := openEvents(*filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	res := &inspectResult{
+		Filename: *filename,
+		FileSize: size,
+		EvTypes:  make(map[string]int),
+		Codecs:   make(map[string]int),
+		Layouts:  make(map[string]int),
+	}
+	var minTime, maxTime uint32
+	var newer *blockInfo // the block read before, following this one in the file
+	br := report.NewBlockReader(file, size)
+	for {
+		raw, err := br.Next()
+		if err == io.EOF {
+			break
+		}
+		var block *ev.Block
+		if err == nil {
+			block, err = raw.Decode()
+		}
+		if err != nil {
+			res.Error = err.Error()
+			break
+		}
+		c, _ := codec.ByID(raw.Codec) // validated by the reader
+		res.Codecs[c.Name()]++
+		res.Layouts[raw.Layout.String()]++
+		info := &blockInfo{
+			Offset:  raw.Offset,
+			Codec:   c.Name(),
+			Layout:  raw.Layout.String(),
+			Bytes:   len(raw.Data),
+			Events:  len(block.Evs),
+			MinTime: ^uint32(0),
+		}
+		for _, e := range block.Evs {
+			info.MinTime = min(info.MinTime, e.Time)
+			info.MaxTime = max(info.MaxTime, e.Time)
+			res.EvTypes[evTypes.TypeName(e)]++
+		}
+		if len(block.Evs) == 0 {
+			info.MinTime = 0
+		}
+		if newer != nil && newer.Events > 0 && info.MaxTime > newer.MinTime {
+			res.UnorderedBlocks++
+		}
+		if res.Blocks == 0 || info.Bytes < res.MinBlockBytes {
+			res.MinBlockBytes = info.Bytes
+		}
+		res.MaxBlockBytes = max(res.MaxBlockBytes, info.Bytes)
+		if info.Events > 0 {
+			if minTime == 0 || info.MinTime < minTime {
+				minTime = info.MinTime
+			}
+			maxTime = max(maxTime, info.MaxTime)
+		}
+		res.Blocks++
+		res.Events += info.Events
+		res.CompressedBytes += int64(info.Bytes)
+		decompressed, err := c.Decode(raw.Data)
+		if err != nil {
+			res.Error = err.Error()
+			break
+		}
+		res.UncompressedBytes += int64(len(decompressed))
+		if *blocks {
+			res.BlockDetails = append(res.BlockDetails, info)
+		}
+		newer = info
+	}
+	if res.CompressedBytes > 0 {
+		res.CompressionRatio = float64(res.UncompressedBytes) / float64(res.CompressedBytes)
+	}
+	if maxTime > 0 {
+		res.MinTime = formatTime(minTime)
+		res.MaxTime = formatTime(maxTime)
+	}
+	// oldest block first, as in the file
+	for i, j := 0, len(res.BlockDetails)-1; i < j; i, j = i+1, j-1 {
+		res.BlockDetails[i], res.BlockDetails[j] = res.BlockDetails[j], res.BlockDetails[i]
+	}
+	return printJSON(res)
+}
+
+// cmdDump prints the events of an events file as NDJSON, newest first.
+func cmdDump(args []string) error {
+	fs := flag.NewFlagSet("dump", flag.ExitOnError)
+	filename := fs.String("file", "events", "events file")
+	from := fs.String("from", "", "oldest time, inclusive, Unix or RFC3339")
+	to := fs.String("to", "", "newest time, exclusive, Unix or RFC3339")
+	types := fs.String("type", "", "comma-separated list of event types")
+	cids := fs.String("cid", "", "comma-separated list of content ids")
+	limit := fs.Int("limit", 0, "maximum number of events, 0 for all")
+	fs.Parse(args)
+	evTypes, err := ev.ParseRegistry(os.Getenv("ZOE_CUSTOM_EV_TYPES"))
+	if err != nil {
+		return err
+	}
+	// filtered like /export
+	filter, err := app.ParseExportFilter(url.Values{
+		"from": {*from},
+		"to":   {*to},
+		"type": {*types},
+		"cid":  {*cids},
+	}, evTypes)
+	if err != nil {
+		return err
+	}
+	file, size, err := openEvents(*filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	bw := bufio.NewWriter(os.Stdout)
+	defer bw.Flush()
+	enc := json.NewEncoder(bw)
+	n := 0
+	return app.WalkEvents(*filename, file, size, filter, func(evs []*ev.Ev) error {
+		for _, e := range evs {
+			if err := enc.Encode(app.NewRecord(e, evTypes)); err != nil {
+				return err
+			}
+			n++
+			if n == *limit {
+				return app.ErrStopWalk
+			}
+		}
+		return nil
+	})
+}
+
+// cmdVerify checks the length, gzip & proto framing of every block.
+// Blocks with an invalid payload are skipped, but an invalid length
+// stops the walk, as the blocks before it cannot be found.
+func cmdVerify(args []string) error {
+	fs := flag.NewFlagSet("verify", flag.ExitOnError)
+	filename := fs.String("file", "events", "events file")
+	fs.Parse(args)
+	file, size, err := openEvents(*filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	res := &verifyResult{
+		Filename: *filename,
+	}
+	br := report.NewBlockReader(file, size)
+	for {
+		raw, err := br.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			if !errors.Is(err, report.ErrCorrupt) {
+				return err
+			}
+			res.UncheckedBytes = br.Offset()
+			res.Errors = append(res.Errors, &verifyError{
+				Offset: max(br.Offset()-4, 0),
+				Error:  err.Error(),
+			})
+			break
+		}
+		res.Blocks++
+		block, err := raw.Decode()
+		if err != nil {
+			res.Errors = append(res.Errors, &verifyError{
+				Offset: raw.Offset,
+				Error:  err.Error(),
+			})
+			continue
+		}
+		res.Events += len(block.Evs)
+	}
+	res.Valid = len(res.Errors) == 0
+	if !res.Valid {
+		// errors are found newest first
+		first := res.Errors[len(res.Errors)-1].Offset
+		res.FirstBadOffset = &first
+	}
+	if err := printJSON(res); err != nil {
+		return err
+	}
+	if !res.Valid {
+		return fmt.Errorf("%d invalid blocks, first at offset %d", len(res.Errors), *res.FirstBadOffset)
+	}
+	return nil
+}
+
+// openEvents opens an events file for reading & returns its size.
+func openEvents(filename string) (*os.File, int64, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to open file for reading: %w", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, 0, fmt.Errorf("failed to stat file: %w", err)
+	}
+	return file, info.Size(), nil
+}
+
+func formatTime(t uint32) string {
+	return time.Unix(int64(t), 0).UTC().Format(time.RFC3339)
+}
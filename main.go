@@ -2,21 +2,37 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"os"
 	"os/signal"
 	"runtime"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 
 	"github.com/swissinfo-ch/zoe/app"
+	"github.com/swissinfo-ch/zoe/bot"
+	"github.com/swissinfo-ch/zoe/codec"
 	"github.com/swissinfo-ch/zoe/ev"
+	"github.com/swissinfo-ch/zoe/geo"
 	"github.com/swissinfo-ch/zoe/report"
+	"github.com/swissinfo-ch/zoe/rollup"
 )
 
 func main() {
+	// run a subcommand instead of the server
+	if len(os.Args) > 1 {
+		if err := runCommand(os.Args[1:]); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	// laddr
 	laddr := ":1618"
 	laddrEnv, ok := os.LookupEnv("ZOE_LADDR")
@@ -25,26 +41,47 @@ func main() {
 	}
 	fmt.Println("listening http on", laddr)
 
-	// allowed origins
+	// setup events file
+	filename := "events"
+	filenameEnv, ok := os.LookupEnv("ZOE_EVENTS_FILE")
+	if ok {
+		filename = filenameEnv
+	}
+
+	// allowed origins, of the primary property if ZOE_PROPERTIES is not set
 	allowedOrigins := []string{}
 	allowedOriginsEnv, ok := os.LookupEnv("ZOE_ALLOWED_ORIGINS")
 	if ok {
 		allowedOrigins = strings.Split(allowedOriginsEnv, ",")
 	}
-	fmt.Println("allowed origins set to", allowedOrigins)
 
-	// setup events file
-	filename := "events"
-	filenameEnv, ok := os.LookupEnv("ZOE_EVENTS_FILE")
+	// setup properties
+	properties := []*propertyDef{{name: "default", allowedOrigins: allowedOrigins}}
+	propertiesEnv, ok := os.LookupEnv("ZOE_PROPERTIES")
 	if ok {
-		filename = filenameEnv
+		var err error
+		properties, err = parseProperties(propertiesEnv)
+		if err != nil {
+			panic(err)
+		}
 	}
-	file, err := os.OpenFile(filename, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
-	if err != nil {
-		panic(err)
+	for i, p := range properties {
+		// the primary property keeps the events file, so existing data stays with it
+		p.filename = filename
+		if i > 0 {
+			p.filename = filename + "-" + p.name
+		}
+		file, err := os.OpenFile(p.filename, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			panic(err)
+		}
+		file.Close()
+		if err := updateIndex(p.filename); err != nil {
+			panic(err)
+		}
+		fmt.Printf("property %s reading events from %s, allowed origins set to %v\n",
+			p.name, p.filename, p.allowedOrigins)
 	}
-	file.Close()
-	fmt.Println("reading events from", filename)
 
 	// setup block size
 	blockSize := 10000
@@ -58,6 +95,30 @@ func main() {
 	}
 	fmt.Println("block size set to", blockSize)
 
+	// setup block codec, blocks of any codec are read
+	blockCodec := codec.Gzip
+	blockCodecEnv, ok := os.LookupEnv("ZOE_BLOCK_CODEC")
+	if ok {
+		var err error
+		blockCodec, err = codec.ByName(blockCodecEnv)
+		if err != nil {
+			panic(err)
+		}
+	}
+	fmt.Println("block codec set to", blockCodec.Name())
+
+	// setup block layout, blocks of any layout are read
+	blockLayout := ev.LayoutRow
+	blockLayoutEnv, ok := os.LookupEnv("ZOE_BLOCK_LAYOUT")
+	if ok {
+		var err error
+		blockLayout, err = ev.ParseLayout(blockLayoutEnv)
+		if err != nil {
+			panic(err)
+		}
+	}
+	fmt.Println("block layout set to", blockLayout)
+
 	// setup worker pool size
 	workerPoolSize := runtime.NumCPU()
 	workerPoolSizeEnv, ok := os.LookupEnv("ZOE_WORKER_POOL_SIZE")
@@ -82,64 +143,287 @@ func main() {
 	}
 	fmt.Println("min report interval set to", minReportInterval)
 
-	// setup report runner
-	runnerCfg := &report.RunnerCfg{
-		Filename:          filename,
-		BlockSize:         blockSize,
-		WorkerPoolSize:    workerPoolSize,
-		MinReportInterval: minReportInterval,
-		Jobs: map[string]*report.Job{
-			"views-cutoff1000-last30d": {
-				Report: &report.Views{
-					Cutoff:        1000,
-					EstimatedSize: 10000,
-					MinEvTime: func() time.Time {
-						return time.Now().Add(-time.Hour * 24 * 30)
-					},
-				},
-			},
-			"views-top100-last30d": {
-				Report: &report.Top{
-					N: 100,
-					MinEvTime: func() time.Time {
-						return time.Now().Add(-time.Hour * 24 * 30)
-					},
-				},
-			},
-			"subset-views-max10k": {
-				Report: &report.Subset{
-					Limit: 10000,
-					Filter: func(e *ev.Ev) bool {
-						return e.EvType == ev.EvType_LOAD
-					},
-				},
-			},
-		},
+	// setup bot filter
+	botMode := "flag"
+	botModeEnv, ok := os.LookupEnv("ZOE_BOT_MODE")
+	if ok {
+		botMode = botModeEnv
 	}
-	reportsRunner := report.NewRunner(runnerCfg)
-
-	reportNames := make([]string, 0, len(runnerCfg.Jobs))
-	for name := range runnerCfg.Jobs {
-		reportNames = append(reportNames, name)
+	if botMode != "flag" && botMode != "drop" && botMode != "off" {
+		panic(fmt.Sprintf("invalid ZOE_BOT_MODE %q, must be one of flag, drop or off", botMode))
 	}
+	fmt.Println("bot mode set to", botMode)
 
 	ctx := getCtx()
 
-	app.NewApp(&app.AppCfg{
+	var botFilter *bot.Filter
+	if botMode != "off" {
+		var err error
+		botFilter, err = bot.NewFilter(&bot.FilterCfg{
+			Ctx:                    ctx,
+			PatternsFile:           os.Getenv("ZOE_BOT_PATTERNS_FILE"),
+			MaxHeartbeatsPerMinute: 20, // client sends one every 5s
+			MaxPageSeconds:         60 * 60 * 4,
+			SessionTTL:             time.Minute * 30,
+		})
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	// setup geo db
+	var geoDB *geo.DB
+	geoDBFile, ok := os.LookupEnv("ZOE_GEO_DB_FILE")
+	if ok {
+		var err error
+		geoDB, err = geo.Open(geoDBFile)
+		if err != nil {
+			panic(err)
+		}
+		fmt.Printf("loaded %d ip ranges from %s\n", geoDB.Len(), geoDBFile)
+	}
+
+	// setup default consent, for requests without CONSENT header
+	defaultConsent := ev.Consent_FULL
+	defaultConsentEnv, ok := os.LookupEnv("ZOE_DEFAULT_CONSENT")
+	if ok {
+		var err error
+		defaultConsent, err = app.ParseConsent(defaultConsentEnv)
+		if err != nil {
+			panic(err)
+		}
+	}
+	fmt.Println("default consent set to", defaultConsent)
+
+	// setup custom event types
+	evTypes, err := ev.ParseRegistry(os.Getenv("ZOE_CUSTOM_EV_TYPES"))
+	if err != nil {
+		panic(err)
+	}
+	fmt.Println("custom event types set to", evTypes.Names())
+
+	// setup rollup, maintained as blocks are written
+	rollupEnabled := os.Getenv("ZOE_ROLLUP") != "off"
+	fmt.Println("rollup enabled set to", rollupEnabled)
+
+	// setup results kept across restarts
+	resultsEnabled := os.Getenv("ZOE_RESULTS") != "off"
+	fmt.Println("results kept set to", resultsEnabled)
+
+	// setup a report runner per property
+	propertyCfgs := make([]*app.PropertyCfg, 0, len(properties))
+	for _, p := range properties {
+		jobs := newJobs(evTypes, minReportInterval)
+		reportNames := make([]string, 0, len(jobs))
+		for name := range jobs {
+			reportNames = append(reportNames, name)
+		}
+		var store *rollup.Store
+		var rollupReports map[string]rollup.Report
+		if rollupEnabled {
+			store, err = openRollup(p.filename)
+			if err != nil {
+				panic(err)
+			}
+			rollupReports = newRollupReports()
+			for name := range rollupReports {
+				reportNames = append(reportNames, name)
+			}
+		}
+		sort.Strings(reportNames)
+		resultsDir := ""
+		if resultsEnabled {
+			resultsDir = report.ResultsDir(p.filename)
+		}
+		propertyCfgs = append(propertyCfgs, &app.PropertyCfg{
+			Name:     p.name,
+			Filename: p.filename,
+			ReportRunner: report.NewRunner(&report.RunnerCfg{
+				Ctx:               ctx,
+				Name:              p.name,
+				Filename:          p.filename,
+				BlockSize:         blockSize,
+				WorkerPoolSize:    workerPoolSize,
+				MinReportInterval: minReportInterval,
+				Jobs:              jobs,
+				ResultsDir:        resultsDir,
+			}),
+			ReportNames:    reportNames,
+			AllowedOrigins: p.allowedOrigins,
+			Rollup:         store,
+			RollupReports:  rollupReports,
+		})
+	}
+
+	a := app.NewApp(&app.AppCfg{
 		Ctx:            ctx,
 		Laddr:          laddr,
-		Filename:       filename,
+		Properties:     propertyCfgs,
 		BlockSize:      blockSize,
-		ReportRunner:   reportsRunner,
-		ReportNames:    reportNames,
+		BlockLayout:    blockLayout,
+		BlockCodec:     blockCodec,
 		RateLimitEvery: time.Second,
 		RateLimitBurst: 100,
-		AllowedOrigins: allowedOrigins,
+		BotFilter:      botFilter,
+		DropBots:       botMode == "drop",
+		GeoDB:          geoDB,
+		EvTypes:        evTypes,
+		DefaultConsent: defaultConsent,
+		AdminToken:     os.Getenv("ZOE_ADMIN_TOKEN"),
+		ExportToken:    os.Getenv("ZOE_EXPORT_TOKEN"),
+		ExportEvery:    time.Minute,
+		ExportBurst:    10,
 	})
 
 	// wait for context to be done
 	<-ctx.Done()
 	fmt.Println("app shutting down")
+	a.Wait()
+}
+
+// newJobs returns the report jobs run for each property.
+// Jobs over 30 days change slowly, so they run at most every minute,
+// sharing a scan, & the others every minReportInterval.
+func newJobs(evTypes *ev.Registry, minReportInterval time.Duration) map[string]*report.Job {
+	last30d := report.Every(max(time.Minute, minReportInterval))
+	return map[string]*report.Job{
+		"views-cutoff1000-last30d": {
+			Schedule: last30d,
+			Report: &report.Views{
+				Cutoff:        1000,
+				EstimatedSize: 10000,
+				MinEvTime: func() time.Time {
+					return time.Now().Add(-time.Hour * 24 * 30)
+				},
+			},
+		},
+		"views-top100-last30d": {
+			Schedule: last30d,
+			History:  2 * 24 * 60, // two days of runs, at one a minute
+			Report: &report.Top{
+				N: 100,
+				MinEvTime: func() time.Time {
+					return time.Now().Add(-time.Hour * 24 * 30)
+				},
+			},
+		},
+		"views-top100-by-referrer-last30d": {
+			Schedule: last30d,
+			Report: &report.Top{
+				N: 100,
+				MinEvTime: func() time.Time {
+					return time.Now().Add(-time.Hour * 24 * 30)
+				},
+				GroupBy:       report.GroupByReferrer,
+				FilterColumns: ev.ColReferrer,
+			},
+		},
+		"count-by-type-last30d": {
+			Schedule: last30d,
+			Report: &report.Count{
+				Registry: evTypes,
+				MinEvTime: func() time.Time {
+					return time.Now().Add(-time.Hour * 24 * 30)
+				},
+			},
+		},
+		"share-by-consent-last30d": {
+			Schedule: last30d,
+			Report: &report.Share{
+				GroupBy: report.GroupByConsent,
+				MinEvTime: func() time.Time {
+					return time.Now().Add(-time.Hour * 24 * 30)
+				},
+				FilterColumns: ev.ColConsent,
+			},
+		},
+		"subset-views-max10k": {
+			Window: time.Hour * 24 * 30, // bounds the scan if there are fewer views
+			Report: &report.Subset{
+				Limit: 10000,
+				Filter: func(e *ev.Ev) bool {
+					return e.EvType == ev.EvType_LOAD && !e.Bot
+				},
+			},
+		},
+	}
+}
+
+// newRollupReports returns the reports served from the rollup of each property
+func newRollupReports() map[string]rollup.Report {
+	return map[string]rollup.Report{
+		"rollup-views-cutoff1000-last30d": &rollup.Views{
+			Cutoff: 1000,
+			Window: time.Hour * 24 * 30,
+		},
+		"rollup-views-top100-last30d": &rollup.Top{
+			N:      100,
+			Window: time.Hour * 24 * 30,
+		},
+		"rollup-hourly-loads-last7d": &rollup.TimeSeries{
+			EvType: ev.EvType_LOAD,
+			Window: time.Hour * 24 * 7,
+		},
+	}
+}
+
+// openRollup opens the rollup of an events file, adding the blocks written after it,
+// or building it from the file if it does not exist yet or does not match the file
+func openRollup(filename string) (*rollup.Store, error) {
+	dir := rollup.Dir(filename)
+	_, err := os.Stat(dir)
+	missing := os.IsNotExist(err)
+	store, err := rollup.Open(dir)
+	if err != nil {
+		return nil, err
+	}
+	if !missing {
+		// nothing is written yet, so the file is read as it is
+		n, err := store.CatchUp(filename)
+		if err == nil {
+			if n > 0 {
+				fmt.Printf("added %d blocks to rollup of %s\n", n, filename)
+			}
+			return store, nil
+		}
+		if !errors.Is(err, rollup.ErrUnknownEnd) {
+			return nil, err
+		}
+		fmt.Printf("rebuilding rollup of %s: %v\n", filename, err)
+	}
+	// nothing is written yet, so no lock is needed
+	if err := store.Rebuild(filename, &sync.Mutex{}); err != nil {
+		return nil, err
+	}
+	fmt.Printf("built rollup of %s with %d cells\n", filename, store.Cells())
+	return store, nil
+}
+
+// updateIndex indexes the blocks of an events file after its index,
+// eg. those written by a previous version, or all if the index does not match the file
+func updateIndex(filename string) error {
+	file, size, err := openEvents(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	entries, err := report.ReadIndex(filename, file, size)
+	if err != nil {
+		return err
+	}
+	end := int64(0)
+	if len(entries) > 0 {
+		end = entries[len(entries)-1].End()
+	}
+	if end == size {
+		return nil
+	}
+	appended, err := report.ScanIndex(file, end, size)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("indexed %d blocks of %s\n", len(appended), filename)
+	return report.WriteIndex(filename, append(entries, appended...))
 }
 
 // cancelOnKillSig cancels the context on os interrupt kill signal
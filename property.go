@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+var propertyNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9-]*$`)
+
+// propertyDef is a property as declared in ZOE_PROPERTIES
+type propertyDef struct {
+	name           string
+	filename       string
+	allowedOrigins []string
+}
+
+// parseProperties parses properties declared as name=origin,origin pairs,
+// separated by semicolons, eg. "www=https://www.swissinfo.ch;stg=https://toolbox.stg.swi-services.ch".
+// The first property is the primary.
+func parseProperties(s string) ([]*propertyDef, error) {
+	properties := make([]*propertyDef, 0)
+	names := make(map[string]bool)
+	for _, def := range strings.Split(s, ";") {
+		def = strings.TrimSpace(def)
+		if def == "" {
+			continue
+		}
+		name, origins, _ := strings.Cut(def, "=")
+		name = strings.TrimSpace(name)
+		if !propertyNamePattern.MatchString(name) {
+			return nil, fmt.Errorf("invalid property name %q, must match %s", name, propertyNamePattern)
+		}
+		if names[name] {
+			return nil, fmt.Errorf("property %s is declared twice", name)
+		}
+		names[name] = true
+		p := &propertyDef{
+			name:           name,
+			allowedOrigins: make([]string, 0),
+		}
+		for _, origin := range strings.Split(origins, ",") {
+			origin = strings.TrimSpace(origin)
+			if origin != "" {
+				p.allowedOrigins = append(p.allowedOrigins, origin)
+			}
+		}
+		properties = append(properties, p)
+	}
+	if len(properties) == 0 {
+		return nil, fmt.Errorf("no properties declared")
+	}
+	return properties, nil
+}
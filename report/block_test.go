@@ -0,0 +1,322 @@
+package report
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/swissinfo-ch/zoe/codec"
+	"github.com/swissinfo-ch/zoe/ev"
+	"google.golang.org/protobuf/proto"
+)
+
+// The benchmarks read blocks from the events file in ZOE_BENCH_EVENTS_FILE,
+// eg. a copy of production data, or else generate a similar distribution.
+//
+//	ZOE_BENCH_EVENTS_FILE=events go test ./report -run none -bench Block
+
+const benchBlockSize = 10000
+const benchBlocks = 20
+
+type benchFormat struct {
+	layout ev.Layout
+	codec  codec.Codec
+}
+
+func (f benchFormat) String() string {
+	return f.layout.String() + "-" + f.codec.Name()
+}
+
+var benchFormats = func() []benchFormat {
+	formats := make([]benchFormat, 0)
+	for _, layout := range []ev.Layout{ev.LayoutRow, ev.LayoutColumnar} {
+		for _, c := range []codec.Codec{codec.Gzip, codec.Zstd, codec.Snappy, codec.None} {
+			formats = append(formats, benchFormat{layout, c})
+		}
+	}
+	return formats
+}()
+
+// BenchmarkBlockEncode measures the encoding speed & the encoded size per event.
+func BenchmarkBlockEncode(b *testing.B) {
+	blocks := benchBlockData(b)
+	for _, f := range benchFormats {
+		b.Run(f.String(), func(b *testing.B) {
+			encodedBytes, evs := 0, 0
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				data := blocks[i%len(blocks)]
+				encoded, _, err := EncodeBlock(data.block, f.layout, f.codec)
+				if err != nil {
+					b.Fatal(err)
+				}
+				encodedBytes += len(encoded)
+				evs += len(data.block.Evs)
+			}
+			b.ReportMetric(float64(encodedBytes)/float64(evs), "B/ev")
+			b.ReportMetric(float64(evs)/b.Elapsed().Seconds(), "ev/s")
+		})
+	}
+}
+
+// BenchmarkBlockDecode measures decompressing & decoding all columns of blocks.
+func BenchmarkBlockDecode(b *testing.B) {
+	benchmarkBlockDecode(b, ev.AllColumns)
+}
+
+// BenchmarkBlockDecodeViews measures decoding the columns read by Views.
+func BenchmarkBlockDecodeViews(b *testing.B) {
+	benchmarkBlockDecode(b, (&Views{}).Columns())
+}
+
+func benchmarkBlockDecode(b *testing.B, cols ev.Columns) {
+	blocks := benchBlockData(b)
+	for _, f := range benchFormats {
+		b.Run(f.String(), func(b *testing.B) {
+			encoded := make([][]byte, len(blocks))
+			for i, data := range blocks {
+				var err error
+				encoded[i], _, err = EncodeBlock(data.block, f.layout, f.codec)
+				if err != nil {
+					b.Fatal(err)
+				}
+				// check the round trip
+				block, err := DecodeBlock(encoded[i], f.layout, f.codec, ev.AllColumns)
+				if err != nil {
+					b.Fatal(err)
+				}
+				if !proto.Equal(block, data.block) {
+					b.Fatal("decoded block differs from the encoded one")
+				}
+			}
+			b.ResetTimer()
+			evs := 0
+			for i := 0; i < b.N; i++ {
+				block, err := DecodeBlock(encoded[i%len(encoded)], f.layout, f.codec, cols)
+				if err != nil {
+					b.Fatal(err)
+				}
+				evs += len(block.Evs)
+			}
+			b.ReportMetric(float64(evs)/b.Elapsed().Seconds(), "ev/s")
+		})
+	}
+}
+
+// BenchmarkBlockReadParallel measures reading & decoding the blocks of a file
+// of each format in order, with 1 goroutine & with as many as CPUs.
+func BenchmarkBlockReadParallel(b *testing.B) {
+	blocks := benchBlockData(b)
+	for _, f := range benchFormats {
+		filename := filepath.Join(b.TempDir(), "events")
+		size := writeBenchFile(b, filename, f, blocks)
+		for _, n := range []int{1, runtime.GOMAXPROCS(0)} {
+			b.Run(fmt.Sprintf("%s-%d", f, n), func(b *testing.B) {
+				file, err := os.Open(filename)
+				if err != nil {
+					b.Fatal(err)
+				}
+				defer file.Close()
+				b.ResetTimer()
+				evs := 0
+				for i := 0; i < b.N; i++ {
+					stop := make(chan struct{})
+					for result := range DecodeBlocks(NewBlockReader(file, size), ev.AllColumns, n, stop) {
+						d := <-result
+						if d.Err != nil {
+							b.Fatal(d.Err)
+						}
+						evs += len(d.Block.Evs)
+					}
+					close(stop)
+				}
+				b.ReportMetric(float64(evs)/b.Elapsed().Seconds(), "ev/s")
+			})
+		}
+	}
+}
+
+// BenchmarkBlockRunner measures a report run over a file of each format,
+// with jobs like those of the server, & the size of the file per event.
+// The per-event runs send the same jobs the events one by one, as a baseline
+// for reports that implement BlockReport.
+func BenchmarkBlockRunner(b *testing.B) {
+	blocks := benchBlockData(b)
+	for _, f := range benchFormats {
+		filename := filepath.Join(b.TempDir(), "events")
+		size := writeBenchFile(b, filename, f, blocks)
+		fileEvs := 0
+		for _, data := range blocks {
+			fileEvs += len(data.block.Evs)
+		}
+		for _, perEvent := range []bool{false, true} {
+			name := f.String()
+			jobs := benchJobs()
+			if perEvent {
+				name += "-per-event"
+				for _, job := range jobs {
+					job.Report = perEventReport{job.Report}
+				}
+			}
+			b.Run(name, func(b *testing.B) {
+				r := &Runner{
+					filename:       filename,
+					blockSize:      benchBlockSize,
+					workerPoolSize: 4,
+					jobs:           jobs,
+				}
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					r.run(context.Background(), r.jobs, 0)
+				}
+				b.ReportMetric(float64(fileEvs*b.N)/b.Elapsed().Seconds(), "ev/s")
+				b.ReportMetric(float64(size)/float64(fileEvs), "B/ev")
+			})
+		}
+	}
+}
+
+// perEventReport hides the BlockReport implementation of a report,
+// so that it receives events one by one, but reads the same columns.
+type perEventReport struct {
+	Report
+}
+
+func (r perEventReport) Columns() ev.Columns {
+	if cr, ok := r.Report.(ColumnReport); ok {
+		return cr.Columns()
+	}
+	return ev.AllColumns
+}
+
+type benchBlock struct {
+	block *ev.Block
+}
+
+// benchBlockData returns blocks, from ZOE_BENCH_EVENTS_FILE or generated.
+func benchBlockData(b *testing.B) []*benchBlock {
+	blocks := make([]*benchBlock, 0, benchBlocks)
+	add := func(block *ev.Block) {
+		blocks = append(blocks, &benchBlock{block: block})
+	}
+	filename, ok := os.LookupEnv("ZOE_BENCH_EVENTS_FILE")
+	if !ok {
+		for _, block := range generateBenchBlocks() {
+			add(block)
+		}
+		return blocks
+	}
+	file, err := os.Open(filename)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		b.Fatal(err)
+	}
+	br := NewBlockReader(file, info.Size())
+	for len(blocks) < benchBlocks {
+		raw, err := br.Next()
+		if err != nil {
+			break
+		}
+		block, err := raw.Decode()
+		if err != nil {
+			b.Fatal(err)
+		}
+		add(block)
+	}
+	if len(blocks) == 0 {
+		b.Fatal("no blocks in ", filename)
+	}
+	// oldest first, as in the file
+	for i, j := 0, len(blocks)-1; i < j; i, j = i+1, j-1 {
+		blocks[i], blocks[j] = blocks[j], blocks[i]
+	}
+	return blocks
+}
+
+// generateBenchBlocks generates recent events with a distribution similar to
+// production: mostly loads & time events, a long tail of content ids,
+// & users with a few page views per session.
+func generateBenchBlocks() []*ev.Block {
+	rnd := rand.New(rand.NewSource(1))
+	cids := rand.NewZipf(rnd, 1.1, 10, 200000)
+	countries := []string{"CH", "CH", "CH", "DE", "FR", "IT", "US", "JP", "BR", "ES"}
+	t := uint32(time.Now().Add(-time.Hour * 24).Unix())
+	blocks := make([]*ev.Block, 0, benchBlocks)
+	for i := 0; i < benchBlocks; i++ {
+		block := &ev.Block{Evs: make([]*ev.Ev, 0, benchBlockSize)}
+		for j := 0; j < benchBlockSize; j++ {
+			usr := uint32(rnd.Intn(50000))
+			device := ev.Device(rnd.Intn(3))
+			country := countries[rnd.Intn(len(countries))]
+			e := &ev.Ev{
+				Time:    t,
+				Usr:     usr * 2654435761,
+				Sess:    (usr + t/1800) * 2246822519,
+				Cid:     uint32(cids.Uint64()) + 1000000,
+				Device:  &device,
+				Country: &country,
+			}
+			switch n := rnd.Intn(100); {
+			case n < 45:
+				e.EvType = ev.EvType_LOAD
+				referrer := ev.Referrer(rnd.Intn(6))
+				e.Referrer = &referrer
+			case n < 80:
+				e.EvType = ev.EvType_TIME
+				pageSeconds := uint32(rnd.Intn(600))
+				e.PageSeconds = &pageSeconds
+			default:
+				e.EvType = ev.EvType_UNLOAD
+				scrolled := rnd.Float32()
+				e.Scrolled = &scrolled
+			}
+			block.Evs = append(block.Evs, e)
+			if rnd.Intn(3) == 0 {
+				t++
+			}
+		}
+		blocks = append(blocks, block)
+	}
+	return blocks
+}
+
+// writeBenchFile writes the blocks in the format & returns the file size.
+func writeBenchFile(b *testing.B, filename string, f benchFormat, blocks []*benchBlock) int64 {
+	file, err := os.Create(filename)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer file.Close()
+	size := int64(0)
+	for _, data := range blocks {
+		encoded, suffix, err := EncodeBlock(data.block, f.layout, f.codec)
+		if err != nil {
+			b.Fatal(err)
+		}
+		file.Write(encoded)
+		file.Write(suffix)
+		size += int64(len(encoded) + len(suffix))
+	}
+	return size
+}
+
+// benchJobs returns jobs like those of the server.
+func benchJobs() map[string]*Job {
+	last30d := func() time.Time {
+		return time.Now().Add(-time.Hour * 24 * 30)
+	}
+	return map[string]*Job{
+		"views": {Report: &Views{Cutoff: 1000, EstimatedSize: 10000, MinEvTime: last30d}},
+		"top":   {Report: &Top{N: 100, MinEvTime: last30d}},
+		"share": {Report: &Share{GroupBy: GroupByReferrer, MinEvTime: last30d}},
+	}
+}
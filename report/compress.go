@@ -0,0 +1,62 @@
+package report
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+
+	"github.com/andybalholm/brotli"
+	"github.com/swissinfo-ch/zoe/codec"
+)
+
+// compressMinSize is the size of content under which it is served uncompressed,
+// as compressing would save less than the headers it costs
+const compressMinSize = 1024
+
+// Prepare sets the ETag of the result & compresses its content with gzip & brotli,
+// once per result rather than per request. Results are not modified once published.
+func (r *Result) Prepare() error {
+	r.SetETag()
+	_, _, err := r.Compressed()
+	return err
+}
+
+// SetETag sets the ETag of the result only, so that its content is compressed
+// by the first call to Compressed, eg. for past results, which are rarely served.
+func (r *Result) SetETag() {
+	sum := sha256.Sum256(r.Content)
+	// weak, as the compressed variants share it
+	r.ETag = `W/"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+// Compressed returns the content compressed with gzip & brotli, nil if it is small,
+// compressing it on the first call. It is safe for concurrent use.
+func (r *Result) Compressed() ([]byte, []byte, error) {
+	r.compressed.Do(func() {
+		r.compressErr = r.compress()
+	})
+	return r.Gzip, r.Brotli, r.compressErr
+}
+
+func (r *Result) compress() error {
+	if len(r.Content) < compressMinSize {
+		return nil
+	}
+	gz, err := codec.Gzip.Encode(r.Content)
+	if err != nil {
+		return err
+	}
+	buf := &bytes.Buffer{}
+	bw := brotli.NewWriter(buf)
+	if _, err := bw.Write(r.Content); err != nil {
+		return fmt.Errorf("failed to write brotli data: %w", err)
+	}
+	// the brotli writer must be closed to flush all data
+	if err := bw.Close(); err != nil {
+		return fmt.Errorf("failed to close brotli writer: %w", err)
+	}
+	r.Gzip = gz
+	r.Brotli = buf.Bytes()
+	return nil
+}
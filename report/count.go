@@ -0,0 +1,131 @@
+package report
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/swissinfo-ch/zoe/ev"
+)
+
+// Count is a report that counts events per event type,
+// resolving custom event types by name using the registry.
+type Count struct {
+	Registry  *ev.Registry        // registry of custom event types, may be nil
+	Types     []string            // optional, only these event types are counted
+	MinEvTime func() time.Time    // func that returns earliest time for events to be included in the report
+	Filter    func(*ev.Ev) bool   // optional, only events for which it returns true are counted
+	GroupBy   func(*ev.Ev) string // optional, events are counted per group, eg. GroupByCountry
+	// columns read by Filter & GroupBy, all if zero
+	FilterColumns ev.Columns
+}
+
+// Columns returns the columns read by the report
+func (c *Count) Columns() ev.Columns {
+	base := ev.ColEvType | ev.ColTime | ev.ColBot | ev.ColCustomType | ev.ColValue
+	return columns(base, c.Filter != nil || c.GroupBy != nil, c.FilterColumns)
+}
+
+// TimeRange returns the range of the events read by the report
+func (c *Count) TimeRange() (time.Time, time.Time) {
+	return c.MinEvTime(), time.Time{}
+}
+
+// TypeCount is the number of events of a type,
+// and the sum of their values, if they have any.
+type TypeCount struct {
+	Count    uint32 `json:"count"`
+	ValueSum int64  `json:"valueSum,omitempty"`
+}
+
+// Generate returns a json representation of the count per event type,
+// or of the count per event type per group if GroupBy is set
+func (c *Count) Generate(events <-chan *ev.Ev) (*Result, error) {
+	tc := c.newCounter()
+	readEvents(events, tc.add)
+	return c.result(tc)
+}
+
+// GenerateBlocks is Generate for blocks of events
+func (c *Count) GenerateBlocks(blocks <-chan []*ev.Ev) (*Result, error) {
+	tc := c.newCounter()
+	readBlocks(blocks, tc.add)
+	return c.result(tc)
+}
+
+func (c *Count) newCounter() *typeCounter {
+	types := make(map[string]bool, len(c.Types))
+	for _, t := range c.Types {
+		types[t] = true
+	}
+	return &typeCounter{
+		c:         c,
+		minEvTime: uint32(c.MinEvTime().Unix()),
+		types:     types,
+		groups:    make(map[string]map[string]*TypeCount),
+	}
+}
+
+func (c *Count) result(tc *typeCounter) (*Result, error) {
+	var data []byte
+	var err error
+	if c.GroupBy != nil {
+		data, err = json.Marshal(tc.groups)
+	} else {
+		typeCounts := tc.groups[""]
+		if typeCounts == nil {
+			typeCounts = make(map[string]*TypeCount)
+		}
+		data, err = json.Marshal(typeCounts)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &Result{
+		Content:     data,
+		ContentType: "application/json",
+	}, nil
+}
+
+// typeCounter counts events per type per group
+type typeCounter struct {
+	c         *Count
+	minEvTime uint32
+	types     map[string]bool
+	groups    map[string]map[string]*TypeCount
+}
+
+// add counts an event, returning false at the first event older than minEvTime
+func (tc *typeCounter) add(e *ev.Ev) bool {
+	if e.Time < tc.minEvTime {
+		// events are ordered by time, so we can stop here
+		return false
+	}
+	if e.Bot {
+		return true
+	}
+	typeName := tc.c.Registry.TypeName(e)
+	if len(tc.types) > 0 && !tc.types[typeName] {
+		return true
+	}
+	if tc.c.Filter != nil && !tc.c.Filter(e) {
+		return true
+	}
+	group := ""
+	if tc.c.GroupBy != nil {
+		group = tc.c.GroupBy(e)
+	}
+	typeCounts, exists := tc.groups[group]
+	if !exists {
+		typeCounts = make(map[string]*TypeCount)
+		tc.groups[group] = typeCounts
+	}
+	count, exists := typeCounts[typeName]
+	if !exists {
+		count = &TypeCount{}
+		typeCounts[typeName] = count
+	}
+	count.Count++
+	count.ValueSum += int64(e.GetValue())
+	return true
+}
@@ -0,0 +1,35 @@
+package report
+
+import "github.com/swissinfo-ch/zoe/ev"
+
+// Unknown is the group of events without a value for the dimension.
+const Unknown = "UNKNOWN"
+
+// GroupByReferrer groups events by referrer class.
+func GroupByReferrer(e *ev.Ev) string {
+	if e.Referrer == nil {
+		return Unknown
+	}
+	return e.Referrer.String()
+}
+
+// GroupByDevice groups events by device class.
+func GroupByDevice(e *ev.Ev) string {
+	if e.Device == nil {
+		return Unknown
+	}
+	return e.Device.String()
+}
+
+// GroupByCountry groups events by country code.
+func GroupByCountry(e *ev.Ev) string {
+	if e.Country == nil {
+		return Unknown
+	}
+	return *e.Country
+}
+
+// GroupByConsent groups events by consent level.
+func GroupByConsent(e *ev.Ev) string {
+	return e.Consent.String()
+}
@@ -0,0 +1,216 @@
+package report
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+
+	"github.com/swissinfo-ch/zoe/codec"
+	"github.com/swissinfo-ch/zoe/ev"
+)
+
+const indexRecordSize = 8 + 4 + 4 + 4 + 4
+
+// IndexEntry is the position & time range of a block, as stored
+// in the sidecar index of an events file, an entry per block, oldest first.
+type IndexEntry struct {
+	Offset  int64  // offset of the compressed payload
+	Length  uint32 // length of the compressed payload
+	MinTime uint32 // time of the oldest event
+	MaxTime uint32 // time of the newest event
+	Count   uint32 // number of events
+}
+
+// End returns the offset following the block's length suffix.
+func (e *IndexEntry) End() int64 {
+	return e.Offset + int64(e.Length) + 4
+}
+
+// IndexFilename returns the filename of the index of an events file.
+func IndexFilename(filename string) string {
+	return filename + ".idx"
+}
+
+// NewIndexEntry returns the index entry of a block written at offset.
+func NewIndexEntry(offset int64, length int, block *ev.Block) IndexEntry {
+	entry := IndexEntry{
+		Offset: offset,
+		Length: uint32(length),
+		Count:  uint32(len(block.Evs)),
+	}
+	for i, e := range block.Evs {
+		if i == 0 || e.Time < entry.MinTime {
+			entry.MinTime = e.Time
+		}
+		entry.MaxTime = max(entry.MaxTime, e.Time)
+	}
+	return entry
+}
+
+// ScanIndex returns the index entries of the blocks between start & end of a file,
+// oldest first. Only the time of events is decoded.
+func ScanIndex(file io.ReaderAt, start, end int64) ([]IndexEntry, error) {
+	entries := make([]IndexEntry, 0)
+	br := NewBlockRangeReader(file, start, end)
+	for {
+		raw, err := br.Next()
+		if err == io.EOF {
+			break
+		}
+		var block *ev.Block
+		if err == nil {
+			block, err = raw.DecodeColumns(ev.ColTime)
+		}
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, NewIndexEntry(raw.Offset, len(raw.Data), block))
+	}
+	// reverse, as blocks are read newest first
+	for i, j := 0, len(entries)-1; i < j; i, j = i+1, j-1 {
+		entries[i], entries[j] = entries[j], entries[i]
+	}
+	return entries, nil
+}
+
+// BuildIndex scans an events file & writes its index.
+func BuildIndex(filename string) ([]IndexEntry, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open file for reading: %w", err)
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("failed to stat file: %w", err)
+	}
+	entries, err := ScanIndex(file, 0, info.Size())
+	if err != nil {
+		return nil, err
+	}
+	return entries, WriteIndex(filename, entries)
+}
+
+// WriteIndex writes the index of an events file to a temporary file that replaces it.
+func WriteIndex(filename string, entries []IndexEntry) error {
+	indexFilename := IndexFilename(filename)
+	tmpFilename := indexFilename + ".tmp"
+	file, err := os.Create(tmpFilename)
+	if err != nil {
+		return fmt.Errorf("failed to create index: %w", err)
+	}
+	defer os.Remove(tmpFilename) // no-op once renamed
+	defer file.Close()
+	w := bufio.NewWriter(file)
+	for i := range entries {
+		w.Write(encodeIndexEntry(&entries[i]))
+	}
+	if err := w.Flush(); err != nil {
+		return fmt.Errorf("failed to write index: %w", err)
+	}
+	if err := os.Rename(tmpFilename, indexFilename); err != nil {
+		return fmt.Errorf("failed to replace index: %w", err)
+	}
+	return nil
+}
+
+// AppendIndex appends the entry of a block to the index of an events file.
+// A partial entry, left by an interrupted append, is dropped first.
+func AppendIndex(filename string, entry IndexEntry) error {
+	file, err := os.OpenFile(IndexFilename(filename), os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open index: %w", err)
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to stat index: %w", err)
+	}
+	size := info.Size() - info.Size()%indexRecordSize
+	if _, err := file.WriteAt(encodeIndexEntry(&entry), size); err != nil {
+		return fmt.Errorf("failed to write index: %w", err)
+	}
+	return nil
+}
+
+// ReadIndex reads the index of an events file of the given size.
+// It returns the entries of the contiguous blocks from the start of the file,
+// so blocks appended after an entry failed to be written are not indexed.
+// A missing index, or one that does not match the file, eg. after the file
+// was replaced, has no entries.
+func ReadIndex(filename string, file io.ReaderAt, size int64) ([]IndexEntry, error) {
+	data, err := os.ReadFile(IndexFilename(filename))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read index: %w", err)
+	}
+	entries := make([]IndexEntry, 0, len(data)/indexRecordSize)
+	end := int64(0)
+	for ; len(data) >= indexRecordSize; data = data[indexRecordSize:] {
+		entry := decodeIndexEntry(data)
+		if entry.Offset != end || entry.End() > size {
+			break
+		}
+		entries = append(entries, entry)
+		end = entry.End()
+	}
+	if len(entries) == 0 {
+		return nil, nil
+	}
+	// check the suffix of the last block, as the file may have been replaced
+	suffix := make([]byte, 4)
+	if _, err := file.ReadAt(suffix, end-4); err != nil {
+		return nil, fmt.Errorf("failed to read block length at offset %d: %w", end-4, err)
+	}
+	if _, _, length := codec.ParseSuffix(suffix); length != int64(entries[len(entries)-1].Length) {
+		return nil, nil
+	}
+	return entries, nil
+}
+
+// SeekRange returns the offsets between which the blocks of a file of the given size
+// may hold events in [from, to), found by binary search of the index entries.
+// Blocks are expected to be in time order. Blocks after the index are included
+// unless an indexed block is newer than to.
+func SeekRange(entries []IndexEntry, size int64, from, to uint32) (int64, int64) {
+	i := sort.Search(len(entries), func(i int) bool {
+		return entries[i].MaxTime >= from
+	})
+	j := sort.Search(len(entries), func(j int) bool {
+		return entries[j].MinTime >= to
+	})
+	start, end := int64(0), size
+	if i > 0 {
+		start = entries[i-1].End()
+	}
+	if j < len(entries) {
+		end = entries[j].Offset
+	}
+	return start, max(start, end)
+}
+
+func encodeIndexEntry(entry *IndexEntry) []byte {
+	b := make([]byte, indexRecordSize)
+	binary.BigEndian.PutUint64(b[0:], uint64(entry.Offset))
+	binary.BigEndian.PutUint32(b[8:], entry.Length)
+	binary.BigEndian.PutUint32(b[12:], entry.MinTime)
+	binary.BigEndian.PutUint32(b[16:], entry.MaxTime)
+	binary.BigEndian.PutUint32(b[20:], entry.Count)
+	return b
+}
+
+func decodeIndexEntry(b []byte) IndexEntry {
+	return IndexEntry{
+		Offset:  int64(binary.BigEndian.Uint64(b[0:])),
+		Length:  binary.BigEndian.Uint32(b[8:]),
+		MinTime: binary.BigEndian.Uint32(b[12:]),
+		MaxTime: binary.BigEndian.Uint32(b[16:]),
+		Count:   binary.BigEndian.Uint32(b[20:]),
+	}
+}
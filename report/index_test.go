@@ -0,0 +1,249 @@
+package report
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/swissinfo-ch/zoe/ev"
+)
+
+// writeTestIndex writes the entries as an index, followed by extra bytes
+func writeTestIndex(t *testing.T, filename string, entries []IndexEntry, extra ...byte) {
+	t.Helper()
+	data := make([]byte, 0, len(entries)*indexRecordSize+len(extra))
+	for i := range entries {
+		data = append(data, encodeIndexEntry(&entries[i])...)
+	}
+	if err := os.WriteFile(IndexFilename(filename), append(data, extra...), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// readTestIndex reads the index of a file of the given size
+func readTestIndex(t *testing.T, filename string, size int64) []IndexEntry {
+	t.Helper()
+	file, err := os.Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	entries, err := ReadIndex(filename, file, size)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return entries
+}
+
+// tenUsrs are the users of a block of ten events
+var tenUsrs = []uint32{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}
+
+func TestReadIndex(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "events")
+	entries := writeTestBlocks(t, filename,
+		testBlock(100, tenUsrs...), testBlock(200, tenUsrs...), testBlock(300, tenUsrs...))
+	size := entries[2].End()
+	if info, err := os.Stat(filename); err != nil || info.Size() != size {
+		t.Fatalf("file has size %v, want %d: %v", info.Size(), size, err)
+	}
+	if got := readTestIndex(t, filename, size); got != nil {
+		t.Errorf("missing index has entries %v", got)
+	}
+
+	tests := []struct {
+		name    string
+		entries []IndexEntry
+		extra   []byte
+		size    int64
+		want    []IndexEntry
+	}{
+		{"complete", entries, nil, size, entries},
+		{"partial entry", entries, []byte{0, 0, 0, 1, 2}, size, entries},
+		{"gap", []IndexEntry{entries[0], entries[2]}, nil, size, entries[:1]},
+		{"not from the start", entries[1:], nil, size, nil},
+		{"beyond the file", entries, nil, entries[2].End() - 1, entries[:2]},
+		{"overlapping", []IndexEntry{entries[0], entries[0]}, nil, size, entries[:1]},
+		{"wrong length", []IndexEntry{{Offset: 0, Length: entries[0].Length + 1}}, nil, size, nil},
+		{"empty", nil, nil, size, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			writeTestIndex(t, filename, tt.entries, tt.extra...)
+			got := readTestIndex(t, filename, tt.size)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestReadIndexStale reads an index that no longer matches its file,
+// as after the file was replaced without its index, or truncated.
+func TestReadIndexStale(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "events")
+	entries := writeTestBlocks(t, filename,
+		testBlock(100, tenUsrs...), testBlock(200, tenUsrs...), testBlock(300, tenUsrs...))
+	writeTestIndex(t, filename, entries)
+
+	// replaced by a file of blocks of other lengths, in the same formats
+	replaced := writeTestBlocks(t, filename,
+		testBlock(100, tenUsrs[:4]...), testBlock(200, tenUsrs[:7]...), testBlock(300, tenUsrs...),
+		testBlock(400, tenUsrs...))
+	if got := readTestIndex(t, filename, replaced[3].End()); got != nil {
+		t.Errorf("index of the replaced file has entries %+v", got)
+	}
+
+	// truncated within the last block, eg. by a repair
+	writeTestBlocks(t, filename,
+		testBlock(100, tenUsrs...), testBlock(200, tenUsrs...), testBlock(300, tenUsrs...))
+	if err := os.Truncate(filename, entries[2].End()-5); err != nil {
+		t.Fatal(err)
+	}
+	if got := readTestIndex(t, filename, entries[2].End()-5); !reflect.DeepEqual(got, entries[:2]) {
+		t.Errorf("index of the truncated file has entries %+v, want %+v", got, entries[:2])
+	}
+}
+
+// TestAppendIndex appends entries as blocks are written, after BuildIndex,
+// & after an append that was interrupted.
+func TestAppendIndex(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "events")
+	entries := writeTestBlocks(t, filename, testBlock(100, tenUsrs...), testBlock(200, tenUsrs...))
+	built, err := BuildIndex(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(built, entries) {
+		t.Fatalf("built %+v, want %+v", built, entries)
+	}
+
+	entries = append(entries, appendTestBlock(t, filename, testBlock(300, tenUsrs...), 2))
+	if err := AppendIndex(filename, entries[2]); err != nil {
+		t.Fatal(err)
+	}
+	if got := readTestIndex(t, filename, entries[2].End()); !reflect.DeepEqual(got, entries) {
+		t.Errorf("got %+v after an append, want %+v", got, entries)
+	}
+
+	// an interrupted append leaves part of an entry
+	entries = append(entries, appendTestBlock(t, filename, testBlock(400, tenUsrs...), 3))
+	writeTestIndex(t, filename, entries[:3], encodeIndexEntry(&entries[3])[:7]...)
+	if err := AppendIndex(filename, entries[3]); err != nil {
+		t.Fatal(err)
+	}
+	if got := readTestIndex(t, filename, entries[3].End()); !reflect.DeepEqual(got, entries) {
+		t.Errorf("got %+v after an interrupted append, want %+v", got, entries)
+	}
+
+	// a block whose entry was not appended is not indexed, nor are those after it
+	entries = append(entries, appendTestBlock(t, filename, testBlock(500, tenUsrs...), 4))
+	next := appendTestBlock(t, filename, testBlock(600, tenUsrs...), 5)
+	if err := AppendIndex(filename, next); err != nil {
+		t.Fatal(err)
+	}
+	if got := readTestIndex(t, filename, next.End()); !reflect.DeepEqual(got, entries[:4]) {
+		t.Errorf("got %+v after a missed entry, want %+v", got, entries[:4])
+	}
+	file, err := os.Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	scanned, err := ScanIndex(file, 0, next.End())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := append(entries, next); !reflect.DeepEqual(scanned, want) {
+		t.Errorf("scanned %+v, want %+v", scanned, want)
+	}
+}
+
+func TestSeekRange(t *testing.T) {
+	// blocks of [100, 109], [200, 209] & [300, 309], & a block after the index
+	entries := []IndexEntry{
+		{Offset: 0, Length: 96, MinTime: 100, MaxTime: 109},
+		{Offset: 100, Length: 96, MinTime: 200, MaxTime: 209},
+		{Offset: 200, Length: 96, MinTime: 300, MaxTime: 309},
+	}
+	size := int64(400)
+	all := ^uint32(0)
+	tests := []struct {
+		name       string
+		entries    []IndexEntry
+		from, to   uint32
+		start, end int64
+	}{
+		{"all", entries, 0, all, 0, size},
+		{"no index", nil, 150, 250, 0, size},
+		{"from within a block", entries, 205, all, 100, size},
+		{"from between blocks", entries, 150, all, 100, size},
+		{"from the max time of a block", entries, 109, all, 0, size},
+		{"from after the index", entries, 400, all, 300, size},
+		{"to within a block", entries, 0, 205, 0, 200},
+		{"to the min time of a block", entries, 0, 200, 0, 100},
+		{"to before the first block", entries, 0, 50, 0, 0},
+		{"within a block", entries, 203, 206, 100, 200},
+		{"across blocks", entries, 105, 205, 0, 200},
+		{"to within the last indexed block", entries, 0, 305, 0, size},
+		{"empty between blocks", entries, 150, 150, 100, 100},
+		{"empty within a block", entries, 205, 205, 100, 200},
+		{"reversed", entries, 300, 200, 200, 200},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			start, end := SeekRange(tt.entries, size, tt.from, tt.to)
+			if start != tt.start || end != tt.end {
+				t.Errorf("SeekRange(%d, %d) = [%d, %d), want [%d, %d)", tt.from, tt.to, start, end, tt.start, tt.end)
+			}
+		})
+	}
+}
+
+// TestSeekRangeEvents checks that the range found holds every event in [from, to).
+func TestSeekRangeEvents(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "events")
+	blocks := make([]*ev.Block, 0)
+	for i := uint32(0); i < 8; i++ {
+		blocks = append(blocks, testBlock(100+i*10, tenUsrs...))
+	}
+	entries := writeTestBlocks(t, filename, blocks...)
+	size := entries[len(entries)-1].End()
+	file, err := os.Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	for from := uint32(95); from < 185; from += 3 {
+		for to := from; to < 185; to += 7 {
+			start, end := SeekRange(entries[:6], size, from, to)
+			want, got := 0, 0
+			for _, block := range blocks {
+				for _, e := range block.Evs {
+					if e.Time >= from && e.Time < to {
+						want++
+					}
+				}
+			}
+			br := NewBlockRangeReader(file, start, end)
+			for raw, err := br.Next(); err == nil; raw, err = br.Next() {
+				block, err := raw.Decode()
+				if err != nil {
+					t.Fatal(err)
+				}
+				for _, e := range block.Evs {
+					if e.Time >= from && e.Time < to {
+						got++
+					}
+				}
+			}
+			if got != want {
+				t.Errorf("[%d, %d) at [%d, %d) has %d events, want %d", from, to, start, end, got, want)
+			}
+		}
+	}
+}
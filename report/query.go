@@ -0,0 +1,224 @@
+package report
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/swissinfo-ch/zoe/ev"
+)
+
+// ErrInvalidQuery is returned for query parameters a report does not understand.
+var ErrInvalidQuery = errors.New("invalid query")
+
+// CidViews is the views of a content id, in the results of queries sorted by sort=.
+type CidViews struct {
+	Cid   uint32 `json:"cid"`
+	Views uint32 `json:"views"`
+}
+
+// cidViewsQuery selects the views of content ids, of Views & Top
+type cidViewsQuery struct {
+	cids     map[uint32]bool // only these content ids if not nil, from cid=
+	minViews uint32          // from minViews=
+	limit    int             // only the content ids with the most views if not 0, from limit=
+	sort     string          // views or cid, from sort=, a list of CidViews instead of a map if set
+}
+
+// parseCidViewsQuery parses the cid, minViews, limit & sort query parameters
+func parseCidViewsQuery(q url.Values) (*cidViewsQuery, error) {
+	if err := checkParams(q, "cid", "minViews", "limit", "sort"); err != nil {
+		return nil, err
+	}
+	cids, err := parseCids(q)
+	if err != nil {
+		return nil, err
+	}
+	minViews, err := parseUintParam(q, "minViews")
+	if err != nil {
+		return nil, err
+	}
+	limit, err := parseUintParam(q, "limit")
+	if err != nil {
+		return nil, err
+	}
+	sortBy := q.Get("sort")
+	if sortBy != "" && sortBy != "views" && sortBy != "cid" {
+		return nil, fmt.Errorf("%w: sort must be views or cid", ErrInvalidQuery)
+	}
+	return &cidViewsQuery{
+		cids:     cids,
+		minViews: uint32(minViews),
+		limit:    int(limit),
+		sort:     sortBy,
+	}, nil
+}
+
+// apply returns the selected views, as a map, or as a list of CidViews if sorted.
+// cidViews is shared, so it is not modified.
+func (cq *cidViewsQuery) apply(cidViews map[uint32]uint32) any {
+	selected := make(map[uint32]uint32)
+	for cid, views := range cidViews {
+		if cq.cids != nil && !cq.cids[cid] || views < cq.minViews {
+			continue
+		}
+		selected[cid] = views
+	}
+	if cq.limit > 0 && len(selected) > cq.limit {
+		// ranked, rather than by TopN, so that ties are kept by cid, like with sort=views
+		top := make(map[uint32]uint32, cq.limit)
+		for _, cid := range rankCids(selected)[:cq.limit] {
+			top[cid] = selected[cid]
+		}
+		selected = top
+	}
+	if cq.sort == "" {
+		return selected
+	}
+	var cids []uint32
+	if cq.sort == "views" {
+		cids = rankCids(selected)
+	} else {
+		cids = make([]uint32, 0, len(selected))
+		for cid := range selected {
+			cids = append(cids, cid)
+		}
+		sort.Slice(cids, func(i, j int) bool {
+			return cids[i] < cids[j]
+		})
+	}
+	list := make([]CidViews, 0, len(cids))
+	for _, cid := range cids {
+		list = append(list, CidViews{Cid: cid, Views: selected[cid]})
+	}
+	return list
+}
+
+// queryCidViews queries a result of Views or Top, per group if grouped
+func queryCidViews(result *Result, q url.Values, grouped bool) (*Result, error) {
+	cq, err := parseCidViewsQuery(q)
+	if err != nil {
+		return nil, err
+	}
+	if !grouped {
+		cidViews, err := cidViewsData(result)
+		if err != nil {
+			return nil, err
+		}
+		return queryResult(result, cq.apply(cidViews))
+	}
+	groups, err := groupedCidViewsData(result)
+	if err != nil {
+		return nil, err
+	}
+	selected := make(map[string]any, len(groups))
+	for group, cidViews := range groups {
+		selected[group] = cq.apply(cidViews)
+	}
+	return queryResult(result, selected)
+}
+
+// cidViewsData returns the views per content id of a result of Views or Top,
+// unmarshalled if the result was loaded from the results dir
+func cidViewsData(result *Result) (map[uint32]uint32, error) {
+	if cidViews, ok := result.Data.(map[uint32]uint32); ok {
+		return cidViews, nil
+	}
+	cidViews := make(map[uint32]uint32)
+	if err := json.Unmarshal(result.Content, &cidViews); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal result: %w", err)
+	}
+	return cidViews, nil
+}
+
+// groupedCidViewsData is cidViewsData for the results of reports with GroupBy
+func groupedCidViewsData(result *Result) (map[string]map[uint32]uint32, error) {
+	if groups, ok := result.Data.(map[string]map[uint32]uint32); ok {
+		return groups, nil
+	}
+	groups := make(map[string]map[uint32]uint32)
+	if err := json.Unmarshal(result.Content, &groups); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal result: %w", err)
+	}
+	return groups, nil
+}
+
+// subsetData returns the events of a result of Subset,
+// unmarshalled if the result was loaded from the results dir
+func subsetData(result *Result) ([]*ev.Ev, error) {
+	if evs, ok := result.Data.([]*ev.Ev); ok {
+		return evs, nil
+	}
+	evs := make([]*ev.Ev, 0)
+	if err := json.Unmarshal(result.Content, &evs); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal result: %w", err)
+	}
+	return evs, nil
+}
+
+// queryResult returns the result of a query of a result, generated with it
+func queryResult(result *Result, data any) (*Result, error) {
+	content, err := json.Marshal(data)
+	if err != nil {
+		return nil, err
+	}
+	return &Result{
+		ContentType: "application/json",
+		Content:     content,
+		Data:        data,
+		GeneratedAt: result.GeneratedAt,
+		EventCount:  result.EventCount,
+		Stale:       result.Stale,
+	}, nil
+}
+
+// checkParams returns an error if q has parameters other than those allowed
+func checkParams(q url.Values, allowed ...string) error {
+	for key := range q {
+		found := false
+		for _, a := range allowed {
+			found = found || key == a
+		}
+		if !found {
+			return fmt.Errorf("%w: unknown parameter %s, must be one of %s",
+				ErrInvalidQuery, key, strings.Join(allowed, ", "))
+		}
+	}
+	return nil
+}
+
+// parseCids parses the content ids of the cid parameters, each a comma-separated list,
+// returning nil if there are none
+func parseCids(q url.Values) (map[uint32]bool, error) {
+	if len(q["cid"]) == 0 {
+		return nil, nil
+	}
+	cids := make(map[uint32]bool)
+	for _, list := range q["cid"] {
+		for _, s := range strings.Split(list, ",") {
+			cid, err := strconv.ParseUint(strings.TrimSpace(s), 10, 32)
+			if err != nil {
+				return nil, fmt.Errorf("%w: invalid cid %q", ErrInvalidQuery, s)
+			}
+			cids[uint32(cid)] = true
+		}
+	}
+	return cids, nil
+}
+
+// parseUintParam parses a parameter as an unsigned integer, 0 if it is missing
+func parseUintParam(q url.Values, key string) (uint64, error) {
+	s := q.Get(key)
+	if s == "" {
+		return 0, nil
+	}
+	v, err := strconv.ParseUint(s, 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("%w: invalid %s %q", ErrInvalidQuery, key, s)
+	}
+	return v, nil
+}
@@ -0,0 +1,176 @@
+package report
+
+import (
+	"encoding/json"
+	"errors"
+	"net/url"
+	"reflect"
+	"testing"
+)
+
+func TestParseCids(t *testing.T) {
+	tests := []struct {
+		query   string
+		want    map[uint32]bool
+		invalid bool
+	}{
+		{"", nil, false},
+		{"cid=1", map[uint32]bool{1: true}, false},
+		{"cid=1,2&cid=3", map[uint32]bool{1: true, 2: true, 3: true}, false},
+		{"cid=1,+2", map[uint32]bool{1: true, 2: true}, false},
+		{"cid=1,1", map[uint32]bool{1: true}, false},
+		{"cid=4294967295", map[uint32]bool{4294967295: true}, false},
+		{"cid=", nil, true},
+		{"cid=1,", nil, true},
+		{"cid=a", nil, true},
+		{"cid=-1", nil, true},
+		{"cid=4294967296", nil, true},
+	}
+	for _, tt := range tests {
+		q, err := url.ParseQuery(tt.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := parseCids(q)
+		if tt.invalid {
+			if !errors.Is(err, ErrInvalidQuery) {
+				t.Errorf("parseCids(%q) got error %v, want %v", tt.query, err, ErrInvalidQuery)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseCids(%q) = %v, %v, want %v", tt.query, got, err, tt.want)
+		}
+	}
+}
+
+func TestCheckParams(t *testing.T) {
+	tests := []struct {
+		query   string
+		invalid bool
+	}{
+		{"", false},
+		{"cid=1&limit=2", false},
+		{"cid=1&cid=2", false},
+		{"limit=2&sort=views", true},
+		{"Cid=1", true},
+		{"cid=1&from=2", true},
+	}
+	for _, tt := range tests {
+		q, err := url.ParseQuery(tt.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = checkParams(q, "cid", "limit")
+		if tt.invalid != errors.Is(err, ErrInvalidQuery) || !tt.invalid && err != nil {
+			t.Errorf("checkParams(%q) = %v, want invalid %v", tt.query, err, tt.invalid)
+		}
+	}
+}
+
+func TestCidViewsQuery(t *testing.T) {
+	cidViews := map[uint32]uint32{1: 10, 2: 20, 3: 20, 4: 5, 5: 30}
+	tests := []struct {
+		query   string
+		want    any
+		invalid bool
+	}{
+		{"", cidViews, false},
+		{"cid=1,4&cid=9", map[uint32]uint32{1: 10, 4: 5}, false},
+		{"minViews=20", map[uint32]uint32{2: 20, 3: 20, 5: 30}, false},
+		// ties are ranked by cid
+		{"limit=2", map[uint32]uint32{2: 20, 5: 30}, false},
+		{"limit=10", cidViews, false},
+		{"sort=views", []CidViews{{5, 30}, {2, 20}, {3, 20}, {1, 10}, {4, 5}}, false},
+		{"sort=cid&minViews=10", []CidViews{{1, 10}, {2, 20}, {3, 20}, {5, 30}}, false},
+		{"sort=views&limit=3&cid=1,2,3,4", []CidViews{{2, 20}, {3, 20}, {1, 10}}, false},
+		{"minViews=100&sort=cid", []CidViews{}, false},
+		{"sort=time", nil, true},
+		{"limit=-1", nil, true},
+		{"minViews=x", nil, true},
+		{"cid=x", nil, true},
+		{"at=1", nil, true},
+	}
+	for _, tt := range tests {
+		q, err := url.ParseQuery(tt.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cq, err := parseCidViewsQuery(q)
+		if tt.invalid {
+			if !errors.Is(err, ErrInvalidQuery) {
+				t.Errorf("%q got error %v, want %v", tt.query, err, ErrInvalidQuery)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%q: %v", tt.query, err)
+		}
+		if got := cq.apply(cidViews); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%q got %v, want %v", tt.query, got, tt.want)
+		}
+	}
+	if len(cidViews) != 5 {
+		t.Errorf("queries modified the views: %v", cidViews)
+	}
+}
+
+// TestQueryLoadedResult queries results with their structured data, as published
+// by the runner, & without, as loaded from the results dir.
+func TestQueryLoadedResult(t *testing.T) {
+	views := map[uint32]uint32{1: 10, 2: 20, 3: 30}
+	groups := map[string]map[uint32]uint32{"CH": {1: 10, 2: 20}, "DE": {3: 30}}
+	evs := testBlock(100, 1, 2, 3, 4).Evs
+	tests := []struct {
+		name   string
+		report QueryReport
+		data   any
+		query  string
+		want   string
+	}{
+		{"views", &Views{}, views, "cid=1,3&sort=cid", `[{"cid":1,"views":10},{"cid":3,"views":30}]`},
+		{"grouped views", &Views{GroupBy: GroupByCountry}, groups, "minViews=20", `{"CH":{"2":20},"DE":{"3":30}}`},
+		{"top", &Top{}, views, "limit=1", `{"3":30}`},
+		{"subset", &Subset{}, evs, "cid=1&limit=1", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			content, err := json.Marshal(tt.data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			q, err := url.ParseQuery(tt.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			published := &Result{ContentType: "application/json", Content: content, Data: tt.data}
+			loaded := &Result{ContentType: "application/json", Content: content, Stale: true}
+			fromData, err := tt.report.Query(published, q)
+			if err != nil {
+				t.Fatal(err)
+			}
+			fromContent, err := tt.report.Query(loaded, q)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(fromData.Content) != string(fromContent.Content) {
+				t.Errorf("loaded result got %s, want %s", fromContent.Content, fromData.Content)
+			}
+			if tt.want != "" && string(fromData.Content) != tt.want {
+				t.Errorf("got %s, want %s", fromData.Content, tt.want)
+			}
+			if !fromContent.Stale {
+				t.Error("query of a stale result is not stale")
+			}
+			if string(published.Content) != string(content) || string(loaded.Content) != string(content) {
+				t.Error("query modified the result")
+			}
+		})
+	}
+
+	// content that is not of the report
+	_, err := (&Views{}).Query(&Result{Content: []byte(`[1, 2]`)}, url.Values{})
+	if err == nil || errors.Is(err, ErrInvalidQuery) {
+		t.Errorf("got error %v for a result of another report", err)
+	}
+}
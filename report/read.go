@@ -1,20 +1,263 @@
 package report
 
 import (
-	"bytes"
-	"compress/gzip"
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"os"
+	"time"
 
+	"github.com/swissinfo-ch/zoe/codec"
 	"github.com/swissinfo-ch/zoe/ev"
 	"google.golang.org/protobuf/proto"
 )
 
-func (r *Runner) readEventsFromFile() {
-	// Reset the event count
-	r.currentReportEventCount = 0
+// ErrCorrupt is returned when a block's framing or payload is invalid.
+var ErrCorrupt = errors.New("invalid block length or corrupted file")
 
+// BlockReader reads the blocks of an events file backwards, newest first.
+// Each block is a compressed payload followed by a four-byte suffix, big endian,
+// holding the layout & codec id in the top byte & the payload length in the others.
+type BlockReader struct {
+	file   io.ReaderAt
+	offset int64 // end of the next block to read
+	start  int64 // offset at which to stop reading
+}
+
+// RawBlock is a compressed block & its position in the file.
+type RawBlock struct {
+	Offset int64     // offset of the compressed payload
+	Layout ev.Layout // layout of the events in the payload
+	Codec  byte      // id of the codec of the payload
+	Data   []byte    // compressed payload, without the length suffix
+}
+
+// NewBlockReader returns a reader of the blocks in file before offset end.
+func NewBlockReader(file io.ReaderAt, end int64) *BlockReader {
+	return &BlockReader{
+		file:   file,
+		offset: end,
+	}
+}
+
+// NewBlockRangeReader returns a reader of the blocks in file between offsets start & end.
+// Both offsets must be block boundaries.
+func NewBlockRangeReader(file io.ReaderAt, start, end int64) *BlockReader {
+	return &BlockReader{
+		file:   file,
+		offset: end,
+		start:  start,
+	}
+}
+
+// End returns the offset following the block's length suffix.
+func (b *RawBlock) End() int64 {
+	return b.Offset + int64(len(b.Data)) + 4
+}
+
+// Next returns the next older block, or io.EOF when the start is reached.
+// Errors wrapping ErrCorrupt carry the offset of the invalid block.
+func (br *BlockReader) Next() (*RawBlock, error) {
+	if br.offset <= br.start {
+		return nil, io.EOF
+	}
+	// Read the four-byte length at the end of the compressed event block
+	lengthOffset := br.offset - 4
+	if lengthOffset < br.start {
+		return nil, fmt.Errorf("%w: truncated length at offset %d", ErrCorrupt, br.start)
+	}
+	lengthBytes := make([]byte, 4)
+	if _, err := br.file.ReadAt(lengthBytes, lengthOffset); err != nil {
+		return nil, fmt.Errorf("failed to read block length at offset %d: %w", lengthOffset, err)
+	}
+	layout, codecID, length := codec.ParseSuffix(lengthBytes)
+
+	// Validate length and ensure offset does not go beyond the start
+	if length <= 0 || length > lengthOffset-br.start {
+		return nil, fmt.Errorf("%w: length %d at offset %d", ErrCorrupt, length, lengthOffset)
+	}
+	if _, err := codec.ByID(codecID); err != nil {
+		return nil, fmt.Errorf("%w: %w at offset %d", ErrCorrupt, err, lengthOffset)
+	}
+	if ev.Layout(layout) > ev.LayoutColumnar {
+		return nil, fmt.Errorf("%w: unknown layout %d at offset %d", ErrCorrupt, layout, lengthOffset)
+	}
+
+	// Read the compressed block payload
+	offset := lengthOffset - length
+	data := make([]byte, length)
+	if _, err := br.file.ReadAt(data, offset); err != nil {
+		return nil, fmt.Errorf("failed to read block payload at offset %d: %w", offset, err)
+	}
+	br.offset = offset
+	return &RawBlock{
+		Offset: offset,
+		Layout: ev.Layout(layout),
+		Codec:  codecID,
+		Data:   data,
+	}, nil
+}
+
+// Offset returns the end of the next block to read, or of the invalid one after an error.
+func (br *BlockReader) Offset() int64 {
+	return br.offset
+}
+
+// Decode decompresses & unmarshals the block.
+func (b *RawBlock) Decode() (*ev.Block, error) {
+	return b.DecodeColumns(ev.AllColumns)
+}
+
+// DecodeColumns decompresses & unmarshals the block, decoding only
+// the given columns if the block is columnar. Row blocks are fully decoded.
+func (b *RawBlock) DecodeColumns(cols ev.Columns) (*ev.Block, error) {
+	c, err := codec.ByID(b.Codec)
+	if err != nil {
+		return nil, fmt.Errorf("%w: block at offset %d: %w", ErrCorrupt, b.Offset, err)
+	}
+	block, err := DecodeBlock(b.Data, b.Layout, c, cols)
+	if err != nil {
+		return nil, fmt.Errorf("%w: block at offset %d: %w", ErrCorrupt, b.Offset, err)
+	}
+	return block, nil
+}
+
+// DecodeBlock decompresses & unmarshals a block payload.
+func DecodeBlock(data []byte, layout ev.Layout, c codec.Codec, cols ev.Columns) (*ev.Block, error) {
+	decompressedData, err := c.Decode(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress block: %w", err)
+	}
+	if layout == ev.LayoutColumnar {
+		block, err := ev.DecodeColumnar(decompressedData, cols)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode columnar block: %w", err)
+		}
+		return block, nil
+	}
+	block := &ev.Block{}
+	if err := proto.Unmarshal(decompressedData, block); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal block: %w", err)
+	}
+	return block, nil
+}
+
+// EncodeBlock marshals & compresses a block, returning the payload & its suffix.
+func EncodeBlock(block *ev.Block, layout ev.Layout, c codec.Codec) ([]byte, []byte, error) {
+	var data []byte
+	if layout == ev.LayoutColumnar {
+		data = ev.EncodeColumnar(block)
+	} else {
+		var err error
+		data, err = proto.Marshal(block)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to marshal block: %w", err)
+		}
+	}
+	encoded, err := c.Encode(data)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to compress block: %w", err)
+	}
+	suffix, err := codec.Suffix(byte(layout), c, len(encoded))
+	if err != nil {
+		return nil, nil, err
+	}
+	return encoded, suffix, nil
+}
+
+// DecodedBlock is a block decoded by DecodeBlocks, or the error reading or decoding it.
+type DecodedBlock struct {
+	Block *ev.Block
+	Err   error
+}
+
+// DecodeBlocks reads the blocks of br & decodes them in up to n goroutines.
+// It returns a channel of the pending results in the order of the blocks,
+// so that decoding runs ahead of the reader by up to n blocks.
+// The channel is closed after the last block, or after the first error.
+// Closing stop ends reading early, & the channel is closed once reading has stopped.
+func DecodeBlocks(br *BlockReader, cols ev.Columns, n int, stop <-chan struct{}) <-chan chan *DecodedBlock {
+	pending := make(chan chan *DecodedBlock, max(n-1, 0))
+	go func() {
+		defer close(pending)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			raw, err := br.Next()
+			if err == io.EOF {
+				return
+			}
+			result := make(chan *DecodedBlock, 1)
+			select {
+			case pending <- result:
+			case <-stop:
+				return
+			}
+			if err != nil {
+				result <- &DecodedBlock{Err: err}
+				return
+			}
+			go func() {
+				block, err := raw.DecodeColumns(cols)
+				result <- &DecodedBlock{Block: block, Err: err}
+			}()
+		}
+	}()
+	return pending
+}
+
+// jobColumns returns the columns read by any of the jobs
+func jobColumns(jobs map[string]*Job) ev.Columns {
+	cols := ev.Columns(0)
+	for _, job := range jobs {
+		cr, ok := job.Report.(ColumnReport)
+		if !ok {
+			return ev.AllColumns
+		}
+		cols |= cr.Columns()
+	}
+	return cols
+}
+
+// jobRange returns the range of events read by any of the jobs, as Unix times
+func jobRange(jobs map[string]*Job, now time.Time) (uint32, uint32) {
+	if len(jobs) == 0 {
+		return 0, ^uint32(0)
+	}
+	from, to := ^uint32(0), uint32(0)
+	for _, job := range jobs {
+		jobFrom, jobTo := job.timeRange(now)
+		from = min(from, jobFrom)
+		to = max(to, jobTo)
+	}
+	return from, to
+}
+
+// timeRange returns the range of events read by the job, as Unix times:
+// the range of its report, if any, within its window, if any
+func (job *Job) timeRange(now time.Time) (uint32, uint32) {
+	from, to := uint32(0), ^uint32(0)
+	if tr, ok := job.Report.(TimeRangeReport); ok {
+		reportFrom, reportTo := tr.TimeRange()
+		from = uint32(max(reportFrom.Unix(), 0))
+		if !reportTo.IsZero() {
+			to = uint32(max(reportTo.Unix(), 0))
+		}
+	}
+	if job.Window > 0 {
+		from = max(from, uint32(max(now.Add(-job.Window).Unix(), 0)))
+	}
+	return from, to
+}
+
+// readBlocksFromFile sends the events of the blocks in the range of the jobs,
+// newest first, closing the blocks channel after the last block,
+// once jobsDone is closed, as no job reads more blocks, or once ctx is done
+func (r *Runner) readBlocksFromFile(ctx context.Context, jobs map[string]*Job, now time.Time, jobsDone <-chan struct{}) {
 	// Open the file
 	file, err := os.Open(r.filename)
 	if err != nil {
@@ -28,80 +271,69 @@ func (r *Runner) readEventsFromFile() {
 		panic(err)
 	}
 	fileSize := fileInfo.Size()
-	r.fileSize = fileSize
-
-	// Starting from the end of the file, read backwards
-	for fileSize > 0 {
-		// Move back to read the four-byte length at the end of the compressed event block
-		offset := fileSize - 4
-		_, err := file.Seek(offset, io.SeekStart)
-		if err != nil {
-			panic(fmt.Sprintf("failed to seek in file: %v", err))
-		}
+	r.fileSize.Store(fileSize)
 
-		// Read the four-byte length, big endian
-		lengthBytes := make([]byte, 4)
-		_, err = file.Read(lengthBytes)
-		if err != nil {
-			panic(fmt.Sprintf("failed to read event size: %v", err))
-		}
-		length := (int(lengthBytes[0]) << 24) + (int(lengthBytes[1]) << 16) + (int(lengthBytes[2]) << 8) + int(lengthBytes[3])
+	// Only decode the columns read by the jobs, & the time to stop reading
+	from, to := jobRange(jobs, now)
+	cols := jobColumns(jobs)
+	if from > 0 {
+		cols |= ev.ColTime
+	}
 
-		// Validate length and ensure offset does not go beyond the file start
-		if length <= 0 || length > int(fileSize-4) {
-			fmt.Println("invalid block length or corrupted file")
-			break
-		}
+	// Only read the blocks in the range of the jobs, found in the index
+	index, err := ReadIndex(r.filename, file, fileSize)
+	if err != nil {
+		fmt.Println(err)
+	}
+	start, end := SeekRange(index, fileSize, from, to)
 
-		// Move back to read the compressed block payload
-		offset -= int64(length)
-		if offset < 0 {
-			panic("offset calculated is beyond the file start, indicating a potential error in block length or file corruption")
+	// Starting from the end of the range, read backwards,
+	// decoding blocks in parallel, until the reader returns
+	stop := make(chan struct{})
+	br := NewBlockRangeReader(file, start, end)
+	pending := DecodeBlocks(br, cols, r.workerPoolSize, stop)
+	defer func() {
+		// wait for the reading goroutine to return before closing the file
+		close(stop)
+		for range pending {
 		}
-		_, err = file.Seek(offset, io.SeekStart)
-		if err != nil {
-			panic(fmt.Sprintf("failed to seek in file: %v", err))
+	}()
+loop:
+	for result := range pending {
+		d := <-result
+		block, err := d.Block, d.Err
+		if errors.Is(err, ErrCorrupt) {
+			fmt.Println(err)
+			break
 		}
-
-		// Read the compressed block payload
-		compressedData := make([]byte, length)
-		_, err = file.Read(compressedData)
 		if err != nil {
-			panic(fmt.Sprintf("failed to read compressed event payload: %v", err))
+			panic(err)
 		}
 
-		// Decompress the block payload
-		gzr, err := gzip.NewReader(bytes.NewBuffer(compressedData))
-		if err != nil {
-			panic(fmt.Sprintf("failed to create gzip reader: %v", err))
-		}
-		decompressedData, err := io.ReadAll(gzr)
-		if err != nil {
-			panic(fmt.Sprintf("failed to decompress event payload: %v", err))
+		// Blocks are ordered by time, so all older blocks are out of range,
+		// including those after the index
+		evs := block.GetEvs()
+		if len(evs) > 0 && evs[len(evs)-1].Time < from {
+			break
 		}
-		gzr.Close()
 
-		// Unmarshal the block
-		block := &ev.Block{}
-		if err := proto.Unmarshal(decompressedData, block); err != nil {
-			panic(fmt.Sprintf("failed to unmarshal block: %v", err))
+		// Send the events to the channel, newest first like the blocks,
+		// as reports stop at the first event older than their range
+		for i, j := 0, len(evs)-1; i < j; i, j = i+1, j-1 {
+			evs[i], evs[j] = evs[j], evs[i]
 		}
-
-		// Send the events to the channel
-		for _, e := range block.GetEvs() {
-			r.events <- e
+		select {
+		case r.blocks <- evs:
+		case <-jobsDone:
+			break loop
+		case <-ctx.Done():
+			break loop
 		}
 
 		// Increment the event count
-		r.currentReportEventCount += uint32(len(block.GetEvs()))
-
-		// Update fileSize to the new offset for the next iteration
-		fileSize = offset
+		r.currentReportEventCount.Add(uint32(len(evs)))
 	}
 
-	// Close the events channel after reading all events
-	close(r.events)
-
-	// Update the last report event count
-	r.lastReportEventCount = r.currentReportEventCount
+	// Close the blocks channel after reading all blocks
+	close(r.blocks)
 }
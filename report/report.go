@@ -1,6 +1,8 @@
 package report
 
 import (
+	"net/url"
+	"sync"
 	"time"
 
 	"github.com/swissinfo-ch/zoe/ev"
@@ -9,12 +11,95 @@ import (
 type Result struct {
 	ContentType string
 	Content     []byte
+	Data        any       // optional, structured content, queried by QueryReport, not modified once published
+	GeneratedAt time.Time // end of the run that generated it, set by the runner
+	EventCount  uint32    // number of events sent to the job for it, set by the runner
+	Stale       bool      // loaded from the results dir, before the job's first run
+	ETag        string    // weak ETag of the content, set by Prepare or SetETag
+	Gzip        []byte    // content compressed with gzip, unless it is small, see Compressed
+	Brotli      []byte    // content compressed with brotli, unless it is small, see Compressed
+	compressed  sync.Once
+	compressErr error
 }
 
+// Report generates a result from events, newest first.
+// A report may return before the channel is closed, eg. once its events
+// are older than its range. The runner then stops sending it events,
+// & stops reading the file once every report has returned.
+// When the runner is stopped, the channel is closed early, so that the report
+// returns with what it has read, & its result is discarded.
 type Report interface {
 	Generate(<-chan *ev.Ev) (*Result, error)
 }
 
+// BlockReport is a report that reads whole blocks of events, newest first,
+// saving the runner a channel send per event. Blocks are shared by all jobs,
+// so they must not be modified. Reports that do not implement it receive
+// the events of each block one by one through Generate.
+type BlockReport interface {
+	GenerateBlocks(<-chan []*ev.Ev) (*Result, error)
+}
+
+// readEvents calls add for each event until it returns false
+func readEvents(events <-chan *ev.Ev, add func(*ev.Ev) bool) {
+	for e := range events {
+		if !add(e) {
+			return
+		}
+	}
+}
+
+// readBlocks calls add for each event of each block until it returns false
+func readBlocks(blocks <-chan []*ev.Ev, add func(*ev.Ev) bool) {
+	for evs := range blocks {
+		for _, e := range evs {
+			if !add(e) {
+				return
+			}
+		}
+	}
+}
+
+// DiffReport is a report whose results can be compared,
+// eg. Top, for the changes of rank of content ids between two runs.
+type DiffReport interface {
+	Diff(from, to *Result) (*Result, error)
+}
+
+// QueryReport is a report whose results can be queried, eg. for some content ids,
+// from a result of a run rather than by a scan. Query returns errors wrapping
+// ErrInvalidQuery for parameters it does not understand, & does not modify the result.
+type QueryReport interface {
+	Query(result *Result, q url.Values) (*Result, error)
+}
+
+// ColumnReport is a report that reads only some fields of events,
+// so that columnar blocks are decoded partially.
+// Reports that do not implement it receive all fields.
+type ColumnReport interface {
+	Columns() ev.Columns
+}
+
+// TimeRangeReport is a report that reads only the events in [from, to),
+// so that the runner reads only the blocks in the range of its jobs.
+// A zero to is the newest event.
+// Reports that do not implement it receive all events.
+type TimeRangeReport interface {
+	TimeRange() (from, to time.Time)
+}
+
+// columns returns the columns read by a report, adding those read by its
+// Filter & GroupBy funcs if it has any: the declared ones, or else all.
+func columns(base ev.Columns, hasFuncs bool, declared ev.Columns) ev.Columns {
+	if !hasFuncs {
+		return base
+	}
+	if declared == 0 {
+		return ev.AllColumns
+	}
+	return base | declared
+}
+
 func YoungerThan(e *ev.Ev, d time.Duration) bool {
 	return e.Time > uint32(time.Now().Add(-d).Unix())
 }
@@ -0,0 +1,173 @@
+package report
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// resultHeader is the first line of a results file, followed by the content
+type resultHeader struct {
+	ContentType string    `json:"contentType"`
+	GeneratedAt time.Time `json:"generatedAt"`
+	EventCount  uint32    `json:"eventCount"`
+}
+
+// ResultsDir returns the directory of the last results of the jobs of an events file.
+func ResultsDir(filename string) string {
+	return filename + ".results"
+}
+
+// resultFilename returns the file of the last result of a job in dir
+func resultFilename(dir, jobName string) string {
+	return filepath.Join(dir, url.PathEscape(jobName))
+}
+
+// WriteResult writes the result of a job to dir, replacing its last result at once,
+// so that a crash leaves either result.
+func WriteResult(dir, jobName string, result *Result) error {
+	return writeResultFile(resultFilename(dir, jobName), result)
+}
+
+// ReadResult reads the last result of a job from dir, marked as stale.
+// It returns nil if the job has no result yet.
+func ReadResult(dir, jobName string) (*Result, error) {
+	result, err := readResultFile(resultFilename(dir, jobName))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read result of %s: %w", jobName, err)
+	}
+	result.Stale = true
+	return result, nil
+}
+
+// writeResultFile writes a result to a file atomically
+func writeResultFile(filename string, result *Result) error {
+	header, err := json.Marshal(&resultHeader{
+		ContentType: result.ContentType,
+		GeneratedAt: result.GeneratedAt,
+		EventCount:  result.EventCount,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to marshal result header: %w", err)
+	}
+	tmpFilename := filename + ".tmp"
+	file, err := os.Create(tmpFilename)
+	if err != nil {
+		return fmt.Errorf("failed to create result: %w", err)
+	}
+	defer os.Remove(tmpFilename) // no-op once renamed
+	defer file.Close()
+	w := bufio.NewWriter(file)
+	w.Write(header)
+	w.WriteByte('\n')
+	w.Write(result.Content)
+	if err := w.Flush(); err != nil {
+		return fmt.Errorf("failed to write result: %w", err)
+	}
+	if err := file.Sync(); err != nil {
+		return fmt.Errorf("failed to sync result: %w", err)
+	}
+	if err := os.Rename(tmpFilename, filename); err != nil {
+		return fmt.Errorf("failed to replace result: %w", err)
+	}
+	return nil
+}
+
+// readResultFile reads a result written by writeResultFile
+func readResultFile(filename string) (*Result, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	line, content, found := bytes.Cut(data, []byte{'\n'})
+	if !found {
+		return nil, fmt.Errorf("invalid result %s: missing header", filename)
+	}
+	header := &resultHeader{}
+	if err := json.Unmarshal(line, header); err != nil {
+		return nil, fmt.Errorf("invalid result header %s: %w", filename, err)
+	}
+	return &Result{
+		ContentType: header.ContentType,
+		Content:     content,
+		GeneratedAt: header.GeneratedAt,
+		EventCount:  header.EventCount,
+	}, nil
+}
+
+// historyDir returns the directory of the past results of a job in dir
+func historyDir(dir, jobName string) string {
+	return resultFilename(dir, jobName) + ".history"
+}
+
+// WriteHistory adds a result of a job to its past results in dir,
+// a file per result named by its generation time, & removes all but the last n.
+func WriteHistory(dir, jobName string, result *Result, n int) error {
+	hdir := historyDir(dir, jobName)
+	if err := os.MkdirAll(hdir, 0755); err != nil {
+		return fmt.Errorf("failed to create history dir: %w", err)
+	}
+	filename := filepath.Join(hdir, result.GeneratedAt.UTC().Format(historyLayout))
+	if err := writeResultFile(filename, result); err != nil {
+		return err
+	}
+	names, err := historyNames(hdir)
+	if err != nil {
+		return err
+	}
+	for _, name := range names[:max(len(names)-n, 0)] {
+		if err := os.Remove(filepath.Join(hdir, name)); err != nil {
+			return fmt.Errorf("failed to remove past result: %w", err)
+		}
+	}
+	return nil
+}
+
+// ReadHistory reads the last n past results of a job from dir, oldest first
+func ReadHistory(dir, jobName string, n int) ([]*Result, error) {
+	hdir := historyDir(dir, jobName)
+	names, err := historyNames(hdir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	names = names[max(len(names)-n, 0):]
+	history := make([]*Result, 0, len(names))
+	for _, name := range names {
+		result, err := readResultFile(filepath.Join(hdir, name))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read past result of %s: %w", jobName, err)
+		}
+		history = append(history, result)
+	}
+	return history, nil
+}
+
+// historyLayout names the files of past results, so that they sort by time
+const historyLayout = "20060102T150405.000000000Z"
+
+// historyNames returns the names of the past results in a history dir, oldest first,
+// skipping files left by an interrupted write
+func historyNames(hdir string) ([]string, error) {
+	entries, err := os.ReadDir(hdir)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(entries))
+	for _, e := range entries {
+		if _, err := time.Parse(historyLayout, e.Name()); err == nil {
+			names = append(names, e.Name())
+		}
+	}
+	return names, nil
+}
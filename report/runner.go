@@ -3,40 +3,66 @@ package report
 import (
 	"context"
 	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/intob/jfmt"
 	"github.com/swissinfo-ch/zoe/ev"
-	"github.com/swissinfo-ch/zoe/worker"
 )
 
 type RunnerCfg struct {
+	Ctx               context.Context // the runner stops when it is done, context.Background() if nil
+	Name              string          // name of the property, used in logs
 	Filename          string
 	BlockSize         int
 	WorkerPoolSize    int
-	MinReportInterval time.Duration
+	MinReportInterval time.Duration // interval of jobs without a Schedule
 	Jobs              map[string]*Job
+	ResultsDir        string // optional, the last result of each job is kept there across restarts
 }
 
 type Runner struct {
-	filename                string
-	blockSize               int
-	workerPoolSize          int
-	minReportInterval       time.Duration
-	jobs                    map[string]*Job
-	results                 map[string]*Result
-	jobDone                 chan *JobDone
-	events                  chan *ev.Ev
-	fileSize                int64
-	currentReportEventCount uint32
-	lastReportEventCount    uint32
-	lastReportDuration      time.Duration
-	lastReportTime          time.Time
+	ctx               context.Context
+	cancel            context.CancelFunc
+	done              chan struct{} // closed once the runner has stopped
+	name              string
+	filename          string
+	blockSize         int
+	workerPoolSize    int // number of goroutines decoding blocks
+	minReportInterval time.Duration
+	jobs              map[string]*Job
+	resultsDir        string
+	jobDone           chan *JobDone
+	blocks            chan []*ev.Ev // events of each block, newest first
+	wake              chan struct{} // wakes the runner before the next run, eg. after results are cleared
+	publishMu         sync.Mutex    // held while results are published, & while they are cleared
+	cleared           atomic.Uint64 // incremented when results are cleared, so runs started before are discarded
+	// read by HTTP handlers while the runner writes them
+	results                 atomic.Pointer[map[string]*Result]   // replaced after each run, never modified
+	history                 atomic.Pointer[map[string][]*Result] // past results of each job, oldest first, like results
+	fileSize                atomic.Int64
+	currentReportEventCount atomic.Uint32
+	lastReportEventCount    atomic.Uint32
+	lastReportDuration      atomic.Int64 // in nanoseconds
+	lastReportTime          atomic.Int64 // in Unix nanoseconds, 0 before the first report
 }
 
 type Job struct {
-	Report Report
-	events chan *ev.Ev // events will be sent to this channel, and closed when the job is done
+	Report        Report
+	Schedule      Schedule      // optional, runs of the job, Every(MinReportInterval) if nil
+	Window        time.Duration // optional, only events of the last Window are sent to the job
+	History       int           // optional, number of past results kept, in memory & in the results dir
+	windowFrom    uint32        // Unix time of the start of the window in the current run, 0 if none
+	blocks        chan []*ev.Ev // blocks will be sent to this channel, and closed when the job is done
+	blocksClosed  bool          // blocks is closed, as the window of the job ended
+	finished      chan struct{} // closed when Generate returns
+	delivered     atomic.Uint32 // events of the blocks sent to the job in the current run
+	lastDelivered atomic.Uint32 // events of the blocks sent to the job in the last run
+	lastRun       atomic.Int64  // in Unix nanoseconds, 0 before the first run
+	nextRun       atomic.Int64  // in Unix nanoseconds
 }
 
 type JobDone struct {
@@ -44,176 +70,497 @@ type JobDone struct {
 	Result *Result
 }
 
-// NewRunner creates & starts a new report runner
+// NewRunner creates & starts a new report runner.
+// Every job runs once at the start, then on its schedule.
 func NewRunner(cfg *RunnerCfg) *Runner {
+	parent := cfg.Ctx
+	if parent == nil {
+		// stopped by Stop only
+		parent = context.Background()
+	}
+	ctx, cancel := context.WithCancel(parent)
 	r := &Runner{
+		ctx:               ctx,
+		cancel:            cancel,
+		done:              make(chan struct{}),
+		name:              cfg.Name,
 		filename:          cfg.Filename,
 		blockSize:         cfg.BlockSize,
 		workerPoolSize:    cfg.WorkerPoolSize,
 		minReportInterval: cfg.MinReportInterval,
 		jobs:              cfg.Jobs,
-		results:           make(map[string]*Result, len(cfg.Jobs)),
+		resultsDir:        cfg.ResultsDir,
+		wake:              make(chan struct{}, 1),
+	}
+	if r.resultsDir != "" {
+		r.loadResults()
+	}
+	now := time.Now().UnixNano()
+	for _, job := range r.jobs {
+		job.nextRun.Store(now)
 	}
 	// Start the report runner
 	go func() {
+		defer close(r.done)
 		for {
+			// jobs due at the same time share a scan of the file
 			tStart := time.Now()
-			// TODO add context
-			r.run(context.TODO())
-			r.lastReportDuration = time.Since(tStart)
-			r.lastReportTime = time.Now()
-			evPerSec := jfmt.FmtCount32(uint32(float64(r.lastReportEventCount) / r.lastReportDuration.Seconds()))
-			fmt.Printf("\r%s // %s // reporting took %v for %s evs at %s ev/s",
-				r.lastReportTime.Format(time.RFC3339),
-				jfmt.FmtSize64(uint64(r.fileSize)),
-				r.lastReportDuration,
-				jfmt.FmtCount32(r.lastReportEventCount),
+			cleared := r.cleared.Load()
+			jobs := r.dueJobs(tStart)
+			r.run(r.ctx, jobs, cleared)
+			if r.ctx.Err() != nil {
+				return
+			}
+			duration := time.Since(tStart)
+			tEnd := time.Now()
+			r.publishMu.Lock()
+			for _, job := range jobs {
+				job.lastRun.Store(tEnd.UnixNano())
+				// jobs of a discarded run stay due
+				if r.cleared.Load() == cleared {
+					job.nextRun.Store(r.schedule(job).Next(tStart).UnixNano())
+				}
+			}
+			r.publishMu.Unlock()
+			r.lastReportDuration.Store(int64(duration))
+			r.lastReportTime.Store(tEnd.UnixNano())
+			eventCount := r.lastReportEventCount.Load()
+			evPerSec := jfmt.FmtCount32(uint32(float64(eventCount) / duration.Seconds()))
+			fmt.Printf("\r%s // %s // %s // reporting %d jobs took %v for %s evs at %s ev/s",
+				tEnd.Format(time.RFC3339),
+				r.name,
+				jfmt.FmtSize64(uint64(r.fileSize.Load())),
+				len(jobs),
+				duration,
+				jfmt.FmtCount32(eventCount),
 				evPerSec)
 			fmt.Print("\033[0K") // flush line
-			// limit report running rate
-			if r.lastReportDuration < r.minReportInterval {
-				time.Sleep(r.minReportInterval - r.lastReportDuration)
+			// wait for the next job
+			select {
+			case <-time.After(time.Until(r.nextRun())):
+			case <-r.wake:
+			case <-r.ctx.Done():
+				return
 			}
 		}
 	}()
 	return r
 }
 
+// Stop cancels the current run & stops the runner. Results of the cancelled run are discarded.
+func (r *Runner) Stop() {
+	r.cancel()
+}
+
+// Wait blocks until the runner has stopped, & no longer reads the file
+func (r *Runner) Wait() {
+	<-r.done
+}
+
+// ClearResults removes the results & past results of every job, in memory & in the
+// results dir, & runs every job again at once, eg. after events were erased.
+// A run started before is discarded, as it may have read the events removed.
+func (r *Runner) ClearResults() error {
+	r.publishMu.Lock()
+	defer r.publishMu.Unlock()
+	r.cleared.Add(1)
+	r.results.Store(&map[string]*Result{})
+	r.history.Store(&map[string][]*Result{})
+	now := time.Now().UnixNano()
+	for _, job := range r.jobs {
+		job.nextRun.Store(now)
+	}
+	select {
+	case r.wake <- struct{}{}:
+	default:
+	}
+	if r.resultsDir == "" {
+		return nil
+	}
+	if err := os.RemoveAll(r.resultsDir); err != nil {
+		return fmt.Errorf("failed to remove results: %w", err)
+	}
+	if err := os.MkdirAll(r.resultsDir, 0755); err != nil {
+		return fmt.Errorf("failed to create results dir: %w", err)
+	}
+	return nil
+}
+
 // Jobs returns the jobs
 func (r *Runner) Jobs() map[string]*Job {
 	return r.jobs
 }
 
-// Results returns the results of a job
+// Results returns the result of a job in its last run
 func (r *Runner) Result(jobName string) (*Result, bool) {
-	result, exists := r.results[jobName]
+	results := r.results.Load()
+	if results == nil {
+		return nil, false
+	}
+	result, exists := (*results)[jobName]
 	return result, exists
 }
 
+// History returns the past results of a job, oldest first, including that of its last run
+func (r *Runner) History(jobName string) []*Result {
+	history := r.history.Load()
+	if history == nil {
+		return nil
+	}
+	return (*history)[jobName]
+}
+
+// ResultAt returns the past result of a job that was the last at t, to the second,
+// so that the Unix timestamp of a result gets it
+func (r *Runner) ResultAt(jobName string, t time.Time) (*Result, bool) {
+	history := r.History(jobName)
+	i := sort.Search(len(history), func(i int) bool {
+		return history[i].GeneratedAt.Truncate(time.Second).After(t)
+	})
+	if i == 0 {
+		return nil, false
+	}
+	return history[i-1], true
+}
+
 // CurrentReportEventCount returns the number of events read for the current report
 func (r *Runner) CurrentReportEventCount() uint32 {
-	return r.currentReportEventCount
+	return r.currentReportEventCount.Load()
 }
 
 // LastReportEventCount returns the number of events read for the last report
 func (r *Runner) LastReportEventCount() uint32 {
-	return r.lastReportEventCount
+	return r.lastReportEventCount.Load()
 }
 
 // LastReportDuration returns the duration of the last report
 func (r *Runner) LastReportDuration() time.Duration {
-	return r.lastReportDuration
+	return time.Duration(r.lastReportDuration.Load())
 }
 
-// LastReportTime returns the time of the last report
+// LastReportTime returns the time of the last report, zero before the first
 func (r *Runner) LastReportTime() time.Time {
-	return r.lastReportTime
+	return unixNanoTime(r.lastReportTime.Load())
+}
+
+// LastJobEventCounts returns the number of events sent to each job in its last run.
+// Jobs that return early, eg. on MinEvTime, receive fewer events than were read.
+func (r *Runner) LastJobEventCounts() map[string]uint32 {
+	counts := make(map[string]uint32, len(r.jobs))
+	for name, job := range r.jobs {
+		counts[name] = job.lastDelivered.Load()
+	}
+	return counts
 }
 
 // FileSize returns the size of the file
 func (r *Runner) FileSize() int64 {
-	return r.fileSize
-}
-
-// run generates a report for each job
-func (r *Runner) run(ctx context.Context) {
-	r.jobDone = make(chan *JobDone, len(r.jobs))
-	// TUNING: 2024-02-09
-	// buffer size equal to block size is optimal
-	r.events = make(chan *ev.Ev, r.blockSize)
-	for jobName, job := range r.jobs {
-		// TUNING: 2024-02-10
-		// job events chan buffer size 2 seems optimal,
-		// otherwise sendEventsCollectResults will block
-		job.events = make(chan *ev.Ev, 1)
+	return r.fileSize.Load()
+}
+
+// LastRun returns the time the job's last run ended, zero before the first
+func (j *Job) LastRun() time.Time {
+	return unixNanoTime(j.lastRun.Load())
+}
+
+// NextRun returns the time of the job's next run
+func (j *Job) NextRun() time.Time {
+	return unixNanoTime(j.nextRun.Load())
+}
+
+func unixNanoTime(t int64) time.Time {
+	if t == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, t)
+}
+
+// loadResults publishes the results of the jobs kept in the results dir,
+// so that they are served, as stale, until the jobs run
+func (r *Runner) loadResults() {
+	if err := os.MkdirAll(r.resultsDir, 0755); err != nil {
+		fmt.Printf("failed to create results dir: %v\n", err)
+		return
+	}
+	results := make(map[string]*Result, len(r.jobs))
+	history := make(map[string][]*Result, len(r.jobs))
+	for name, job := range r.jobs {
+		result, err := ReadResult(r.resultsDir, name)
+		if err != nil {
+			fmt.Println(err)
+			continue
+		}
+		if result != nil {
+			prepareResult(name, result)
+			results[name] = result
+		}
+		if job.History > 0 {
+			history[name], err = ReadHistory(r.resultsDir, name, job.History)
+			if err != nil {
+				fmt.Println(err)
+			}
+			// compressed when first served, as most are never
+			for _, result := range history[name] {
+				result.SetETag()
+			}
+		}
+	}
+	r.results.Store(&results)
+	r.history.Store(&history)
+	fmt.Printf("loaded %d results of %s from %s\n", len(results), r.name, r.resultsDir)
+}
+
+// prepareResult prepares a result before it is published, logging a failure,
+// as the result is then still served, uncompressed
+func prepareResult(jobName string, result *Result) {
+	if err := result.Prepare(); err != nil {
+		fmt.Printf("\nfailed to prepare result of %s: %v\n", jobName, err)
+	}
+}
+
+// schedule returns the schedule of a job
+func (r *Runner) schedule(job *Job) Schedule {
+	if job.Schedule == nil {
+		return Every(r.minReportInterval)
+	}
+	return job.Schedule
+}
+
+// dueJobs returns the jobs whose next run is not after now
+func (r *Runner) dueJobs(now time.Time) map[string]*Job {
+	jobs := make(map[string]*Job, len(r.jobs))
+	for name, job := range r.jobs {
+		if job.nextRun.Load() <= now.UnixNano() {
+			jobs[name] = job
+		}
+	}
+	return jobs
+}
+
+// nextRun returns the time of the next run of any job
+func (r *Runner) nextRun() time.Time {
+	if len(r.jobs) == 0 {
+		return time.Now().Add(r.minReportInterval)
+	}
+	next := int64(0)
+	for _, job := range r.jobs {
+		if t := job.nextRun.Load(); next == 0 || t < next {
+			next = t
+		}
+	}
+	return time.Unix(0, next)
+}
+
+// run generates a report for each of the jobs, from one scan of the file.
+// Its results are discarded if results were cleared since cleared was loaded.
+func (r *Runner) run(ctx context.Context, jobs map[string]*Job, cleared uint64) {
+	r.currentReportEventCount.Store(0)
+	r.jobDone = make(chan *JobDone, len(jobs))
+	// read ahead as many blocks as are decoded in parallel
+	r.blocks = make(chan []*ev.Ev, r.workerPoolSize)
+	now := time.Now()
+	finished := make([]chan struct{}, 0, len(jobs))
+	for jobName, job := range jobs {
+		job.windowFrom = 0
+		if job.Window > 0 {
+			job.windowFrom = uint32(max(now.Add(-job.Window).Unix(), 0))
+		}
+		job.blocks = make(chan []*ev.Ev, 1)
+		job.blocksClosed = false
+		job.finished = make(chan struct{})
+		job.delivered.Store(0)
+		finished = append(finished, job.finished)
 		go r.generateJobReport(job, jobName)
 	}
-	go r.readEventsFromFile()
-	r.sendEventsCollectResults(ctx)
+	// stop reading once every job has returned
+	jobsDone := make(chan struct{})
+	go func() {
+		for _, f := range finished {
+			<-f
+		}
+		close(jobsDone)
+	}()
+	readDone := make(chan struct{})
+	go func() {
+		r.readBlocksFromFile(ctx, jobs, now, jobsDone)
+		close(readDone)
+	}()
+	r.sendBlocksCollectResults(ctx, jobs, cleared)
+	<-readDone
 }
 
-// generateReport generates a report for a job
+// generateReport generates a report for a job, from blocks if it is a BlockReport,
+// or else from the events of the blocks, sent one by one
 func (r *Runner) generateJobReport(job *Job, jobName string) {
-	report, err := job.Report.Generate(job.events)
+	var report *Result
+	var err error
+	if br, ok := job.Report.(BlockReport); ok {
+		report, err = br.GenerateBlocks(job.blocks)
+	} else {
+		events := make(chan *ev.Ev, 1)
+		go sendBlockEvents(job.blocks, events, job.finished)
+		report, err = job.Report.Generate(events)
+	}
 	if err != nil {
 		panic(err)
 	}
+	// the job no longer reads events, eg. after breaking on MinEvTime
+	close(job.finished)
 	r.jobDone <- &JobDone{
 		Name:   jobName,
 		Result: report,
 	}
 }
 
-func (r *Runner) sendEventsCollectResults(ctx context.Context) {
-	workerPool := worker.NewPool(r.workerPoolSize)
-
-	runningJobs := make(map[string]*Job, len(r.jobs))
-
-	// Copy job references to manage individual job event channels safely
-	for name, job := range r.jobs {
-		runningJobs[name] = job
+// sendBlockEvents sends the events of blocks one by one, until
+// the blocks channel is closed or finished is, as the job returned
+func sendBlockEvents(blocks <-chan []*ev.Ev, events chan<- *ev.Ev, finished <-chan struct{}) {
+	defer close(events)
+	for evs := range blocks {
+		for _, e := range evs {
+			select {
+			case events <- e:
+			case <-finished:
+				return
+			}
+		}
 	}
+}
 
-	r.currentReportEventCount = 0
+// windowEvents returns the events of a block, newest first, in the window of the job,
+// & false once the block reaches the start of the window, so that older blocks are not
+func (job *Job) windowEvents(evs []*ev.Ev) ([]*ev.Ev, bool) {
+	if job.windowFrom == 0 || len(evs) == 0 || evs[len(evs)-1].Time >= job.windowFrom {
+		return evs, true
+	}
+	// the block is shared by all jobs, so it is sliced, not modified
+	n := sort.Search(len(evs), func(i int) bool {
+		return evs[i].Time < job.windowFrom
+	})
+	return evs[:n], false
+}
 
+// sendBlocksCollectResults sends each block to every job, in the order read,
+// until the job returns or its window ends, then collects the results.
+// Blocks are never dropped, so results are the same for the same events.
+func (r *Runner) sendBlocksCollectResults(ctx context.Context, jobs map[string]*Job, cleared uint64) {
 loop:
 	for {
 		select {
-		case e, ok := <-r.events:
+		case evs, ok := <-r.blocks:
 			if !ok {
-				// If the events channel is closed, it's time to cleanup and exit
+				// If the blocks channel is closed, it's time to cleanup and exit
 				break loop
 			}
-
-			// Dispatch a job to handle the event
-			workerPool.Dispatch(func() {
-				for _, job := range runningJobs {
-					// Before attempting to send, check if context has been cancelled
-					if ctx.Err() != nil {
-						return // Avoid sending on closed channel if shutdown is initiated
-					}
+			for _, job := range jobs {
+				if job.blocksClosed {
+					continue
+				}
+				select {
+				case <-job.finished:
+					continue // prefer skipping a returned job to filling its buffer
+				default:
+				}
+				jobEvs, inWindow := job.windowEvents(evs)
+				if len(jobEvs) > 0 {
 					select {
-					case job.events <- e:
-						// Event sent successfully
-					case <-time.After(time.Millisecond * 100):
-						// Optionally handle the timeout case here
+					case job.blocks <- jobEvs:
+						job.delivered.Add(uint32(len(jobEvs)))
+					case <-job.finished:
 					case <-ctx.Done():
-						// Shutdown signal received, exit the dispatched job
-						return
+						break loop
 					}
 				}
-			})
-
-			// Increment the event count
-			r.currentReportEventCount++
+				if !inWindow {
+					// older blocks are out of the window, so the job can return
+					close(job.blocks)
+					job.blocksClosed = true
+				}
+			}
 		case <-ctx.Done():
 			// Shutdown signal received, exit the loop
 			break loop
 		}
 	}
 
-	// Wait for all dispatched jobs to finish
-	workerPool.StopAndWait()
-
-	// Safely close all job event channels after all work is done
-	for _, job := range runningJobs {
-		close(job.events)
+	// Close all job block channels, so that running jobs return,
+	// including those of a cancelled run
+	for _, job := range jobs {
+		if !job.blocksClosed {
+			close(job.blocks)
+		}
 	}
 
-	// Collect results
-	done := 0
-	for {
-		j, ok := <-r.jobDone
-		if !ok {
-			fmt.Println("jobDone channel closed unexpectedly")
-			break
+	// Collect results, & publish them at once with those of the other jobs,
+	// unless the run was cancelled, as they would be partial,
+	// or results were cleared meanwhile
+	jobResults := make(map[string]*Result, len(jobs))
+	for done := 0; done < len(jobs); done++ {
+		j := <-r.jobDone
+		jobResults[j.Name] = j.Result
+	}
+	if ctx.Err() != nil {
+		return
+	}
+	r.publishMu.Lock()
+	defer r.publishMu.Unlock()
+	if r.cleared.Load() != cleared {
+		return
+	}
+	results := make(map[string]*Result, len(r.jobs))
+	if last := r.results.Load(); last != nil {
+		for name, result := range *last {
+			results[name] = result
 		}
-		r.results[j.Name] = j.Result
-		done++
-		if done >= len(r.jobs) {
-			break
+	}
+	for name, result := range jobResults {
+		results[name] = result
+	}
+	now := time.Now()
+	for name, job := range jobs {
+		results[name].GeneratedAt = now
+		results[name].EventCount = job.delivered.Load()
+		prepareResult(name, results[name])
+	}
+	r.results.Store(&results)
+	r.history.Store(r.addHistory(jobs, results))
+	for name, job := range jobs {
+		job.lastDelivered.Store(job.delivered.Load())
+		if r.resultsDir == "" {
+			continue
+		}
+		// results are published, so a failure only loses them on restart
+		if err := WriteResult(r.resultsDir, name, results[name]); err != nil {
+			fmt.Printf("\nfailed to keep result of %s: %v\n", name, err)
+		}
+		if job.History > 0 {
+			if err := WriteHistory(r.resultsDir, name, results[name], job.History); err != nil {
+				fmt.Printf("\nfailed to keep past result of %s: %v\n", name, err)
+			}
 		}
 	}
 
-	r.lastReportEventCount = r.currentReportEventCount
+	r.lastReportEventCount.Store(r.currentReportEventCount.Load())
+}
+
+// addHistory returns the past results with the results of the jobs added,
+// keeping the last History of each job
+func (r *Runner) addHistory(jobs map[string]*Job, results map[string]*Result) *map[string][]*Result {
+	history := make(map[string][]*Result, len(r.jobs))
+	if last := r.history.Load(); last != nil {
+		for name, past := range *last {
+			history[name] = past
+		}
+	}
+	for name, job := range jobs {
+		if job.History <= 0 {
+			continue
+		}
+		past := history[name]
+		// copied, as the last history may still be read
+		next := make([]*Result, 0, min(len(past)+1, job.History))
+		next = append(next, past[max(len(past)+1-job.History, 0):]...)
+		history[name] = append(next, results[name])
+	}
+	return &history
 }
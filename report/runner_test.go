@@ -0,0 +1,134 @@
+package report
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/swissinfo-ch/zoe/codec"
+	"github.com/swissinfo-ch/zoe/ev"
+)
+
+// writeTestBlocks writes the blocks to a new file, alternating layouts & codecs,
+// & returns their index entries
+func writeTestBlocks(t testing.TB, filename string, blocks ...*ev.Block) []IndexEntry {
+	t.Helper()
+	if err := os.WriteFile(filename, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	entries := make([]IndexEntry, 0, len(blocks))
+	for i, block := range blocks {
+		entries = append(entries, appendTestBlock(t, filename, block, i))
+	}
+	return entries
+}
+
+// appendTestBlock appends a block to a file, in the layout & codec chosen by i,
+// & returns its index entry
+func appendTestBlock(t testing.TB, filename string, block *ev.Block, i int) IndexEntry {
+	t.Helper()
+	file, err := os.OpenFile(filename, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	layout := ev.Layout(i % 2)
+	c := []codec.Codec{codec.Gzip, codec.Zstd, codec.Snappy, codec.None}[i%4]
+	encoded, suffix, err := EncodeBlock(block, layout, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := file.Write(append(encoded, suffix...)); err != nil {
+		t.Fatal(err)
+	}
+	return NewIndexEntry(info.Size(), len(encoded), block)
+}
+
+// testBlock returns a block of loads of the given users, a second apart from start
+func testBlock(start uint32, usrs ...uint32) *ev.Block {
+	block := &ev.Block{Evs: make([]*ev.Ev, 0, len(usrs))}
+	for i, usr := range usrs {
+		block.Evs = append(block.Evs, &ev.Ev{
+			Time:   start + uint32(i),
+			EvType: ev.EvType_LOAD,
+			Usr:    usr,
+			Cid:    usr % 3,
+		})
+	}
+	return block
+}
+
+// waitResult waits for a result of the job generated after t
+func waitResult(t *testing.T, r *Runner, jobName string, after time.Time) *Result {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if result, exists := r.Result(jobName); exists && result.GeneratedAt.After(after) {
+			return result
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("no result of %s after %v", jobName, after)
+	return nil
+}
+
+func TestClearResults(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "events")
+	now := uint32(time.Now().Unix())
+	writeTestBlocks(t, filename, testBlock(now-100, 1, 2, 3), testBlock(now-50, 1, 4))
+	r := NewRunner(&RunnerCfg{
+		Name:              "test",
+		Filename:          filename,
+		BlockSize:         10,
+		WorkerPoolSize:    2,
+		MinReportInterval: time.Hour,
+		ResultsDir:        ResultsDir(filename),
+		Jobs: map[string]*Job{
+			"subset": {
+				Report:  &Subset{Limit: 10, Filter: func(*ev.Ev) bool { return true }},
+				History: 3,
+			},
+		},
+	})
+	defer r.Wait()
+	defer r.Stop()
+	first := waitResult(t, r, "subset", time.Time{})
+	if first.EventCount != 5 {
+		t.Fatalf("first result has %d events, want 5", first.EventCount)
+	}
+
+	// erase the events of user 1
+	writeTestBlocks(t, filename, testBlock(now-100, 2, 3), testBlock(now-50, 4))
+	cleared := time.Now()
+	if err := r.ClearResults(); err != nil {
+		t.Fatal(err)
+	}
+	if result, exists := r.Result("subset"); exists && !result.GeneratedAt.After(cleared) {
+		t.Error("result of before the clear is still served")
+	}
+	for _, result := range r.History("subset") {
+		if !result.GeneratedAt.After(cleared) {
+			t.Error("past result of before the clear is still served")
+		}
+	}
+	next := waitResult(t, r, "subset", cleared)
+	if next.EventCount != 3 {
+		t.Errorf("result after the clear has %d events, want 3", next.EventCount)
+	}
+	// the runner is stopped before the results are read from disk
+	r.Stop()
+	r.Wait()
+	history, err := ReadHistory(r.resultsDir, "subset", 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history) != 1 || history[0].EventCount != 3 {
+		t.Errorf("results dir has %d past results, want only that after the clear", len(history))
+	}
+}
@@ -0,0 +1,42 @@
+package report
+
+import "time"
+
+// Schedule returns the time of the next run of a job, after a run started at last.
+// Schedules that return the same time for several jobs let them share a scan of the file.
+type Schedule interface {
+	Next(last time.Time) time.Time
+}
+
+// Every is a schedule running a job at each multiple of the interval,
+// so that jobs with intervals that are multiples of each other run together,
+// eg. a job run Every(time.Minute) runs with every 12th run of one run Every(5*time.Second).
+type Every time.Duration
+
+// Next returns the first multiple of the interval after last
+func (e Every) Next(last time.Time) time.Time {
+	if e <= 0 {
+		return last
+	}
+	return last.Truncate(time.Duration(e)).Add(time.Duration(e))
+}
+
+// Daily is a cron-like schedule running a job at times of day in UTC,
+// given as durations since midnight, eg. Daily{9 * time.Hour, 21 * time.Hour}.
+type Daily []time.Duration
+
+// Next returns the first time of day after last, the next day if none is left
+func (d Daily) Next(last time.Time) time.Time {
+	day := last.UTC().Truncate(24 * time.Hour)
+	next := day.Add(24 * time.Hour)
+	for i, t := range d {
+		at := day.Add(t)
+		if !at.After(last) {
+			at = at.Add(24 * time.Hour)
+		}
+		if i == 0 || at.Before(next) {
+			next = at
+		}
+	}
+	return next
+}
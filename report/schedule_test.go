@@ -0,0 +1,143 @@
+package report
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+	_ "time/tzdata" // for Europe/Zurich, wherever the tests run
+)
+
+// zurich is a zone with DST, which schedules ignore, as they are in UTC
+var zurich = func() *time.Location {
+	loc, err := time.LoadLocation("Europe/Zurich")
+	if err != nil {
+		panic(err)
+	}
+	return loc
+}()
+
+func utc(s string) time.Time {
+	t, err := time.Parse(time.RFC3339Nano, s)
+	if err != nil {
+		panic(err)
+	}
+	return t
+}
+
+func TestEvery(t *testing.T) {
+	tests := []struct {
+		name  string
+		every Every
+		last  time.Time
+		want  time.Time
+	}{
+		{"within an interval", Every(5 * time.Second), utc("2026-10-19T12:00:03.5Z"), utc("2026-10-19T12:00:05Z")},
+		{"at a multiple", Every(5 * time.Second), utc("2026-10-19T12:00:05Z"), utc("2026-10-19T12:00:10Z")},
+		{"a minute", Every(time.Minute), utc("2026-10-19T12:00:55Z"), utc("2026-10-19T12:01:00Z")},
+		{"across midnight", Every(time.Hour), utc("2026-10-19T23:59:59Z"), utc("2026-10-20T00:00:00Z")},
+		{"a day is a UTC day", Every(24 * time.Hour), time.Date(2026, 10, 19, 0, 30, 0, 0, zurich), utc("2026-10-19T00:00:00Z")},
+		{"into DST", Every(time.Hour), time.Date(2026, 3, 29, 1, 59, 59, 0, zurich), time.Date(2026, 3, 29, 3, 0, 0, 0, zurich)},
+		// 02:30 is once in CEST & once in CET on the last Sunday of October
+		{"out of DST", Every(time.Hour), utc("2026-10-25T00:30:00Z").In(zurich), utc("2026-10-25T01:00:00Z")},
+		{"out of DST, the second time", Every(time.Hour), utc("2026-10-25T01:30:00Z").In(zurich), utc("2026-10-25T02:00:00Z")},
+		{"zero", Every(0), utc("2026-10-19T12:00:03Z"), utc("2026-10-19T12:00:03Z")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.every.Next(tt.last); !got.Equal(tt.want) {
+				t.Errorf("Next(%v) = %v, want %v", tt.last, got, tt.want)
+			}
+		})
+	}
+}
+
+// TestEveryCoincide checks that jobs with intervals that are multiples of each other
+// are due at the same time
+func TestEveryCoincide(t *testing.T) {
+	last := utc("2026-10-19T12:00:00Z")
+	fast, slow := last, Every(time.Minute).Next(last)
+	for i := 0; i < 12; i++ {
+		fast = Every(5 * time.Second).Next(fast)
+	}
+	if !fast.Equal(slow) {
+		t.Errorf("12th run every 5s is at %v, the next every minute at %v", fast, slow)
+	}
+}
+
+func TestDaily(t *testing.T) {
+	tests := []struct {
+		name  string
+		daily Daily
+		last  time.Time
+		want  time.Time
+	}{
+		{"before the first", Daily{9 * time.Hour, 21 * time.Hour}, utc("2026-10-19T08:00:00Z"), utc("2026-10-19T09:00:00Z")},
+		{"at a time", Daily{9 * time.Hour, 21 * time.Hour}, utc("2026-10-19T09:00:00Z"), utc("2026-10-19T21:00:00Z")},
+		{"between", Daily{9 * time.Hour, 21 * time.Hour}, utc("2026-10-19T12:00:00Z"), utc("2026-10-19T21:00:00Z")},
+		{"passed today", Daily{9 * time.Hour, 21 * time.Hour}, utc("2026-10-19T22:00:00Z"), utc("2026-10-20T09:00:00Z")},
+		{"passed today, once a day", Daily{9 * time.Hour}, utc("2026-10-19T09:00:00.001Z"), utc("2026-10-20T09:00:00Z")},
+		{"unsorted", Daily{21 * time.Hour, 9 * time.Hour}, utc("2026-10-19T08:00:00Z"), utc("2026-10-19T09:00:00Z")},
+		{"midnight", Daily{0}, utc("2026-10-19T23:59:59Z"), utc("2026-10-20T00:00:00Z")},
+		{"at midnight", Daily{0}, utc("2026-10-20T00:00:00Z"), utc("2026-10-21T00:00:00Z")},
+		{"end of the month", Daily{9 * time.Hour}, utc("2026-10-31T10:00:00Z"), utc("2026-11-01T09:00:00Z")},
+		{"none", Daily{}, utc("2026-10-19T12:00:00Z"), utc("2026-10-20T00:00:00Z")},
+		// the UTC day, not the local one, which starts an hour earlier
+		{"local day after the UTC day", Daily{9 * time.Hour}, time.Date(2026, 10, 20, 0, 30, 0, 0, zurich), utc("2026-10-20T09:00:00Z")},
+		{"into DST", Daily{2 * time.Hour}, time.Date(2026, 3, 29, 1, 0, 0, 0, zurich), utc("2026-03-29T02:00:00Z")},
+		{"out of DST", Daily{1 * time.Hour}, utc("2026-10-25T00:30:00Z").In(zurich), utc("2026-10-25T01:00:00Z")},
+		{"out of DST, the second time", Daily{1 * time.Hour}, utc("2026-10-25T01:30:00Z").In(zurich), utc("2026-10-26T01:00:00Z")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tt.daily.Next(tt.last)
+			if !got.Equal(tt.want) {
+				t.Errorf("Next(%v) = %v, want %v", tt.last, got, tt.want)
+			}
+			if !got.After(tt.last) {
+				t.Errorf("Next(%v) = %v is not after it", tt.last, got)
+			}
+		})
+	}
+}
+
+func TestDueJobs(t *testing.T) {
+	now := utc("2026-10-19T12:00:00Z")
+	jobs := map[string]*Job{
+		"views": {}, "top": {}, "daily": {},
+	}
+	// views & top are due at the same time, as after a run every 5s & every minute
+	jobs["views"].nextRun.Store(now.UnixNano())
+	jobs["top"].nextRun.Store(now.UnixNano())
+	jobs["daily"].nextRun.Store(now.Add(9 * time.Hour).UnixNano())
+	r := &Runner{jobs: jobs, minReportInterval: time.Second}
+	if next := r.nextRun(); !next.Equal(now) {
+		t.Errorf("next run is at %v, want %v", next, now)
+	}
+	tests := []struct {
+		now  time.Time
+		want []string
+	}{
+		{now.Add(-time.Nanosecond), []string{}},
+		{now, []string{"top", "views"}},
+		{now.Add(time.Hour), []string{"top", "views"}},
+		{now.Add(9 * time.Hour), []string{"daily", "top", "views"}},
+	}
+	for _, tt := range tests {
+		due := r.dueJobs(tt.now)
+		names := make([]string, 0, len(due))
+		for name := range due {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		if !reflect.DeepEqual(names, tt.want) {
+			t.Errorf("due at %v: %v, want %v", tt.now, names, tt.want)
+		}
+	}
+
+	// without jobs, the runner waits the min report interval
+	r = &Runner{jobs: map[string]*Job{}, minReportInterval: time.Second}
+	if wait := time.Until(r.nextRun()); wait <= 0 || wait > time.Second {
+		t.Errorf("runner without jobs waits %v, want up to %v", wait, time.Second)
+	}
+}
@@ -0,0 +1,104 @@
+package report
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/swissinfo-ch/zoe/ev"
+)
+
+// Share is a report that returns the share of events per group,
+// eg. the share of events per consent level
+type Share struct {
+	GroupBy   func(*ev.Ev) string // groups events, eg. GroupByConsent
+	MinEvTime func() time.Time    // func that returns earliest time for events to be included in the report
+	Filter    func(*ev.Ev) bool   // optional, only events for which it returns true are counted
+	// columns read by Filter & GroupBy, all if zero
+	FilterColumns ev.Columns
+}
+
+// Columns returns the columns read by the report
+func (s *Share) Columns() ev.Columns {
+	return columns(ev.ColTime|ev.ColBot, true, s.FilterColumns)
+}
+
+// TimeRange returns the range of the events read by the report
+func (s *Share) TimeRange() (time.Time, time.Time) {
+	return s.MinEvTime(), time.Time{}
+}
+
+// GroupShare is the number of events in a group,
+// and their share of all events counted
+type GroupShare struct {
+	Count uint32  `json:"count"`
+	Share float64 `json:"share"`
+}
+
+// Generate returns a json representation of the share of events per group
+func (s *Share) Generate(events <-chan *ev.Ev) (*Result, error) {
+	sc := s.newCounter()
+	readEvents(events, sc.add)
+	return sc.result()
+}
+
+// GenerateBlocks is Generate for blocks of events
+func (s *Share) GenerateBlocks(blocks <-chan []*ev.Ev) (*Result, error) {
+	sc := s.newCounter()
+	readBlocks(blocks, sc.add)
+	return sc.result()
+}
+
+func (s *Share) newCounter() *shareCounter {
+	return &shareCounter{
+		s:         s,
+		minEvTime: uint32(s.MinEvTime().Unix()),
+		groups:    make(map[string]*GroupShare),
+	}
+}
+
+// shareCounter counts events per group
+type shareCounter struct {
+	s         *Share
+	minEvTime uint32
+	groups    map[string]*GroupShare
+	total     int
+}
+
+// add counts an event, returning false at the first event older than minEvTime
+func (sc *shareCounter) add(e *ev.Ev) bool {
+	if e.Time < sc.minEvTime {
+		// events are ordered by time, so we can stop here
+		return false
+	}
+	if e.Bot {
+		return true
+	}
+	if sc.s.Filter != nil && !sc.s.Filter(e) {
+		return true
+	}
+	group := sc.s.GroupBy(e)
+	gs, exists := sc.groups[group]
+	if !exists {
+		gs = &GroupShare{}
+		sc.groups[group] = gs
+	}
+	gs.Count++
+	sc.total++
+	return true
+}
+
+func (sc *shareCounter) result() (*Result, error) {
+	for _, gs := range sc.groups {
+		gs.Share = float64(gs.Count) / float64(sc.total)
+	}
+
+	data, err := json.Marshal(sc.groups)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Result{
+		Content:     data,
+		ContentType: "application/json",
+	}, nil
+}
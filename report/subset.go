@@ -2,6 +2,7 @@ package report
 
 import (
 	"encoding/json"
+	"net/url"
 
 	"github.com/swissinfo-ch/zoe/ev"
 )
@@ -16,17 +17,29 @@ type Subset struct {
 // Generate returns a json representation of the subset of events
 func (s *Subset) Generate(events <-chan *ev.Ev) (*Result, error) {
 	raw := make([]*ev.Ev, 0, s.Limit)
+	readEvents(events, s.collector(&raw))
+	return subsetResult(raw)
+}
+
+// GenerateBlocks is Generate for blocks of events
+func (s *Subset) GenerateBlocks(blocks <-chan []*ev.Ev) (*Result, error) {
+	raw := make([]*ev.Ev, 0, s.Limit)
+	readBlocks(blocks, s.collector(&raw))
+	return subsetResult(raw)
+}
 
-	// get the subset of events
-	for e := range events {
+// collector returns a func appending the events matching the filter to raw,
+// returning false once the limit is reached
+func (s *Subset) collector(raw *[]*ev.Ev) func(*ev.Ev) bool {
+	return func(e *ev.Ev) bool {
 		if s.Filter(e) {
-			raw = append(raw, e)
-			if len(raw) >= s.Limit {
-				break
-			}
+			*raw = append(*raw, e)
 		}
+		return len(*raw) < s.Limit
 	}
+}
 
+func subsetResult(raw []*ev.Ev) (*Result, error) {
 	data, err := json.Marshal(raw)
 	if err != nil {
 		return nil, err
@@ -35,5 +48,35 @@ func (s *Subset) Generate(events <-chan *ev.Ev) (*Result, error) {
 	return &Result{
 		Content:     data,
 		ContentType: "application/json",
+		Data:        raw,
 	}, nil
 }
+
+// Query selects events of a result with the cid & limit parameters, newest first
+func (s *Subset) Query(result *Result, q url.Values) (*Result, error) {
+	if err := checkParams(q, "cid", "limit"); err != nil {
+		return nil, err
+	}
+	cids, err := parseCids(q)
+	if err != nil {
+		return nil, err
+	}
+	limit, err := parseUintParam(q, "limit")
+	if err != nil {
+		return nil, err
+	}
+	evs, err := subsetData(result)
+	if err != nil {
+		return nil, err
+	}
+	selected := make([]*ev.Ev, 0)
+	for _, e := range evs {
+		if limit > 0 && len(selected) == int(limit) {
+			break
+		}
+		if cids == nil || cids[e.Cid] {
+			selected = append(selected, e)
+		}
+	}
+	return queryResult(result, selected)
+}
@@ -3,14 +3,30 @@ package report
 import (
 	"container/heap"
 	"encoding/json"
+	"net/url"
+	"sort"
 	"time"
 
 	"github.com/swissinfo-ch/zoe/ev"
 )
 
 type Top struct {
-	N         int              // number of top content ids to include in the report
-	MinEvTime func() time.Time // func that returns earliest time for events to be included in the report
+	N         int                 // number of top content ids to include in the report
+	MinEvTime func() time.Time    // func that returns earliest time for events to be included in the report
+	Filter    func(*ev.Ev) bool   // optional, only events for which it returns true are counted
+	GroupBy   func(*ev.Ev) string // optional, top content ids are selected per group, eg. GroupByDevice
+	// columns read by Filter & GroupBy, all if zero
+	FilterColumns ev.Columns
+}
+
+// Columns returns the columns read by the report
+func (t *Top) Columns() ev.Columns {
+	return columns(ev.ColEvType|ev.ColTime|ev.ColCid|ev.ColBot, t.Filter != nil || t.GroupBy != nil, t.FilterColumns)
+}
+
+// TimeRange returns the range of the events read by the report
+func (t *Top) TimeRange() (time.Time, time.Time) {
+	return t.MinEvTime(), time.Time{}
 }
 
 // Define a heap structure to use with container/heap
@@ -21,7 +37,7 @@ type Item struct {
 type ItemHeap []Item
 
 func (h ItemHeap) Len() int           { return len(h) }
-func (h ItemHeap) Less(i, j int) bool { return h[i].Views < h[j].Views } // Min-heap based on Views
+func (h ItemHeap) Less(i, j int) bool { return itemRankedBefore(h[j], h[i]) } // Min-heap based on rank
 func (h ItemHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
 
 func (h *ItemHeap) Push(x interface{}) {
@@ -36,68 +52,204 @@ func (h *ItemHeap) Pop() interface{} {
 	return item
 }
 
-// Generate returns a json representation of the top N content ids
+// Generate returns a json representation of the top N content ids,
+// or of the top N content ids per group if GroupBy is set
 func (t *Top) Generate(events <-chan *ev.Ev) (*Result, error) {
-	minEvTime := uint32(t.MinEvTime().Unix())
+	c := t.newCounter()
+	readEvents(events, c.add)
+	return t.result(c)
+}
 
-	h := &ItemHeap{}
-	heap.Init(h)
-	cidViews := make(map[uint32]uint32)
-	inHeap := make(map[uint32]bool)   // Tracks whether a Cid is currently in the heap
-	itemIndex := make(map[uint32]int) // Tracks the index of items in the heap
-
-	for e := range events {
-		if e.Time < minEvTime {
-			// events are ordered by time, so we can break here
-			break
-		}
-		if e.EvType != ev.EvType_LOAD {
-			continue
-		}
-		cidViews[e.Cid]++
-		if inHeap[e.Cid] {
-			// Update the item's views count in the heap.
-			index := itemIndex[e.Cid]
-			(*h)[index].Views = cidViews[e.Cid]
-			heap.Fix(h, index) // Reheapify after the update
-		} else if len(*h) < t.N {
-			// If the heap is not full, add the item directly.
-			heap.Push(h, Item{Cid: e.Cid, Views: cidViews[e.Cid]})
-			inHeap[e.Cid] = true
-			itemIndex[e.Cid] = len(*h) - 1 // Store the index of the newly added item
-		} else if cidViews[e.Cid] > (*h)[0].Views {
-			// If the item has more views than the smallest in the heap, replace the smallest.
-			removedItem := heap.Pop(h).(Item)
-			inHeap[removedItem.Cid] = false    // Mark the removed item as not in the heap
-			delete(itemIndex, removedItem.Cid) // Remove the index reference for the removed item
-
-			heap.Push(h, Item{Cid: e.Cid, Views: cidViews[e.Cid]})
-			inHeap[e.Cid] = true
-			itemIndex[e.Cid] = 0 // The pushed item takes the place of the popped item at the root
-		}
-	}
+// GenerateBlocks is Generate for blocks of events
+func (t *Top) GenerateBlocks(blocks <-chan []*ev.Ev) (*Result, error) {
+	c := t.newCounter()
+	readBlocks(blocks, c.add)
+	return t.result(c)
+}
 
-	// Convert the heap to a slice for final processing.
-	topN := make([]Item, h.Len())
-	for i := len(topN) - 1; i >= 0; i-- {
-		topN[i] = heap.Pop(h).(Item)
-		// inHeap[topN[i].Cid] = false // Technically unnecessary as we're done
+func (t *Top) newCounter() *viewCounter {
+	return &viewCounter{
+		minEvTime: uint32(t.MinEvTime().Unix()),
+		filter:    t.Filter,
+		groupBy:   t.GroupBy,
+		groups:    make(map[string]map[uint32]uint32),
 	}
+}
 
-	// Convert to map for final JSON output
-	resultMap := make(map[uint32]uint32)
-	for _, item := range topN {
-		resultMap[item.Cid] = item.Views
+func (t *Top) result(c *viewCounter) (*Result, error) {
+	// Select the top N of each group
+	topGroups := make(map[string]map[uint32]uint32, len(c.groups))
+	for group, cidViews := range c.groups {
+		topGroups[group] = TopN(cidViews, t.N)
 	}
 
-	data, err := json.Marshal(resultMap)
+	var structured any
+	if t.GroupBy != nil {
+		structured = topGroups
+	} else {
+		top := topGroups[""]
+		if top == nil {
+			top = make(map[uint32]uint32)
+		}
+		structured = top
+	}
+	data, err := json.Marshal(structured)
 	if err != nil {
 		return nil, err
 	}
 
+	return &Result{
+		Content:     data,
+		ContentType: "application/json",
+		Data:        structured,
+	}, nil
+}
+
+// Query selects content ids of a result with the cid, minViews, limit & sort parameters,
+// per group if GroupBy is set
+func (t *Top) Query(result *Result, q url.Values) (*Result, error) {
+	return queryCidViews(result, q, t.GroupBy != nil)
+}
+
+// RankChange is the change of rank of a content id between two results of Top.
+type RankChange struct {
+	Cid       uint32 `json:"cid"`
+	Rank      int    `json:"rank"`     // 1 for the most views, 0 if no longer in the top
+	LastRank  int    `json:"lastRank"` // rank in the older result, 0 if new in the top
+	Change    int    `json:"change"`   // positive when rising, 0 if new or no longer in the top
+	Views     uint32 `json:"views"`
+	LastViews uint32 `json:"lastViews"`
+}
+
+// Diff returns a json representation of the changes of rank from an older result to a newer,
+// ordered by rank, then by last rank for those no longer in the top,
+// or of the changes of rank per group if GroupBy is set
+func (t *Top) Diff(from, to *Result) (*Result, error) {
+	var data []byte
+	var err error
+	if t.GroupBy != nil {
+		var fromGroups, toGroups map[string]map[uint32]uint32
+		fromGroups, err = groupedCidViewsData(from)
+		if err != nil {
+			return nil, err
+		}
+		toGroups, err = groupedCidViewsData(to)
+		if err != nil {
+			return nil, err
+		}
+		changes := make(map[string][]RankChange, len(toGroups))
+		for group := range fromGroups {
+			changes[group] = nil
+		}
+		for group := range toGroups {
+			changes[group] = nil
+		}
+		for group := range changes {
+			changes[group] = diffRanks(fromGroups[group], toGroups[group])
+		}
+		data, err = json.Marshal(changes)
+	} else {
+		var fromTop, toTop map[uint32]uint32
+		fromTop, err = cidViewsData(from)
+		if err != nil {
+			return nil, err
+		}
+		toTop, err = cidViewsData(to)
+		if err != nil {
+			return nil, err
+		}
+		data, err = json.Marshal(diffRanks(fromTop, toTop))
+	}
+	if err != nil {
+		return nil, err
+	}
 	return &Result{
 		Content:     data,
 		ContentType: "application/json",
 	}, nil
+}
+
+// diffRanks returns the changes of rank from one top to another
+func diffRanks(from, to map[uint32]uint32) []RankChange {
+	fromRanks := rankCids(from)
+	lastRanks := make(map[uint32]int, len(fromRanks))
+	for i, cid := range fromRanks {
+		lastRanks[cid] = i + 1
+	}
+	changes := make([]RankChange, 0, len(to))
+	for i, cid := range rankCids(to) {
+		c := RankChange{
+			Cid:   cid,
+			Rank:  i + 1,
+			Views: to[cid],
+		}
+		if lastRank, exists := lastRanks[cid]; exists {
+			c.LastRank = lastRank
+			c.Change = lastRank - c.Rank
+			c.LastViews = from[cid]
+		}
+		changes = append(changes, c)
+	}
+	for i, cid := range fromRanks {
+		if _, exists := to[cid]; !exists {
+			changes = append(changes, RankChange{
+				Cid:       cid,
+				LastRank:  i + 1,
+				LastViews: from[cid],
+			})
+		}
+	}
+	return changes
+}
+
+// rankCids returns the content ids by views, most first, then by cid
+func rankCids(top map[uint32]uint32) []uint32 {
+	cids := make([]uint32, 0, len(top))
+	for cid := range top {
+		cids = append(cids, cid)
+	}
+	sort.Slice(cids, func(i, j int) bool {
+		return rankedBefore(top, cids[i], cids[j])
+	})
+	return cids
+}
+
+// rankedBefore returns true if content id a ranks before b
+func rankedBefore(top map[uint32]uint32, a, b uint32) bool {
+	if top[a] != top[b] {
+		return top[a] > top[b]
+	}
+	return a < b
+}
+
+// itemRankedBefore returns true if item a ranks before b, as rankedBefore
+func itemRankedBefore(a, b Item) bool {
+	if a.Views != b.Views {
+		return a.Views > b.Views
+	}
+	return a.Cid < b.Cid
+}
 
+// TopN returns the n content ids with the most views, ties by cid,
+// so that the same views give the same top whatever the order of the map
+func TopN(cidViews map[uint32]uint32, n int) map[uint32]uint32 {
+	h := &ItemHeap{}
+	heap.Init(h)
+	for cid, views := range cidViews {
+		if h.Len() < n {
+			// If the heap is not full, add the item directly.
+			heap.Push(h, Item{Cid: cid, Views: views})
+		} else if item := (Item{Cid: cid, Views: views}); itemRankedBefore(item, (*h)[0]) {
+			// If the item ranks before the last in the heap, replace the last.
+			(*h)[0] = item
+			heap.Fix(h, 0)
+		}
+	}
+
+	// Convert to map for final JSON output
+	top := make(map[uint32]uint32, h.Len())
+	for _, item := range *h {
+		top[item.Cid] = item.Views
+	}
+	return top
 }
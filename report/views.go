@@ -2,6 +2,7 @@ package report
 
 import (
 	"encoding/json"
+	"net/url"
 	"time"
 
 	"github.com/swissinfo-ch/zoe/ev"
@@ -10,35 +11,70 @@ import (
 // Views implements the Report interface
 // It generates a json representation of the views (loads) per content id
 type Views struct {
-	Cutoff        int              // minimum number of views to be included in the report
-	EstimatedSize int              // estimated size of the map
-	MinEvTime     func() time.Time // func that returns earliest time for events to be included in the report
+	Cutoff        int                 // minimum number of views to be included in the report
+	EstimatedSize int                 // estimated size of the map
+	MinEvTime     func() time.Time    // func that returns earliest time for events to be included in the report
+	Filter        func(*ev.Ev) bool   // optional, only events for which it returns true are counted
+	GroupBy       func(*ev.Ev) string // optional, views are counted per group, eg. GroupByReferrer
+	FilterColumns ev.Columns          // columns read by Filter & GroupBy, all if zero
 }
 
-// Generate returns a json representation of the views per content id
+// Columns returns the columns read by the report
+func (v *Views) Columns() ev.Columns {
+	return columns(ev.ColEvType|ev.ColTime|ev.ColCid|ev.ColBot, v.Filter != nil || v.GroupBy != nil, v.FilterColumns)
+}
+
+// TimeRange returns the range of the events read by the report
+func (v *Views) TimeRange() (time.Time, time.Time) {
+	return v.MinEvTime(), time.Time{}
+}
+
+// Generate returns a json representation of the views per content id,
+// or of the views per content id per group if GroupBy is set
 func (v *Views) Generate(events <-chan *ev.Ev) (*Result, error) {
-	minEvTime := uint32(v.MinEvTime().Unix())
-	cidViews := make(map[uint32]uint32, v.EstimatedSize)
-
-	// range over events and count views per content id
-	for e := range events {
-		if e.Time < minEvTime {
-			// events are ordered by time, so we can break here
-			break
-		}
-		if e.EvType == ev.EvType_LOAD {
-			cidViews[e.Cid]++
-		}
+	c := v.newCounter()
+	readEvents(events, c.add)
+	return v.result(c)
+}
+
+// GenerateBlocks is Generate for blocks of events
+func (v *Views) GenerateBlocks(blocks <-chan []*ev.Ev) (*Result, error) {
+	c := v.newCounter()
+	readBlocks(blocks, c.add)
+	return v.result(c)
+}
+
+func (v *Views) newCounter() *viewCounter {
+	return &viewCounter{
+		minEvTime:     uint32(v.MinEvTime().Unix()),
+		filter:        v.Filter,
+		groupBy:       v.GroupBy,
+		estimatedSize: v.EstimatedSize,
+		groups:        make(map[string]map[uint32]uint32),
 	}
+}
 
+func (v *Views) result(c *viewCounter) (*Result, error) {
 	// remove content ids with less than v.Cutoff views
-	for cid, views := range cidViews {
-		if views < uint32(v.Cutoff) {
-			delete(cidViews, cid)
+	for _, cidViews := range c.groups {
+		for cid, views := range cidViews {
+			if views < uint32(v.Cutoff) {
+				delete(cidViews, cid)
+			}
 		}
 	}
 
-	data, err := json.Marshal(cidViews)
+	var structured any
+	if v.GroupBy != nil {
+		structured = c.groups
+	} else {
+		cidViews := c.groups[""]
+		if cidViews == nil {
+			cidViews = make(map[uint32]uint32)
+		}
+		structured = cidViews
+	}
+	data, err := json.Marshal(structured)
 	if err != nil {
 		return nil, err
 	}
@@ -46,5 +82,46 @@ func (v *Views) Generate(events <-chan *ev.Ev) (*Result, error) {
 	return &Result{
 		Content:     data,
 		ContentType: "application/json",
+		Data:        structured,
 	}, nil
 }
+
+// Query selects views of a result with the cid, minViews, limit & sort parameters,
+// per group if GroupBy is set
+func (v *Views) Query(result *Result, q url.Values) (*Result, error) {
+	return queryCidViews(result, q, v.GroupBy != nil)
+}
+
+// viewCounter counts the views (loads) per content id per group, for Views & Top
+type viewCounter struct {
+	minEvTime     uint32
+	filter        func(*ev.Ev) bool
+	groupBy       func(*ev.Ev) string
+	estimatedSize int
+	groups        map[string]map[uint32]uint32
+}
+
+// add counts an event, returning false at the first event older than minEvTime
+func (c *viewCounter) add(e *ev.Ev) bool {
+	if e.Time < c.minEvTime {
+		// events are ordered by time, so we can stop here
+		return false
+	}
+	if e.EvType != ev.EvType_LOAD || e.Bot {
+		return true
+	}
+	if c.filter != nil && !c.filter(e) {
+		return true
+	}
+	group := ""
+	if c.groupBy != nil {
+		group = c.groupBy(e)
+	}
+	cidViews, exists := c.groups[group]
+	if !exists {
+		cidViews = make(map[uint32]uint32, c.estimatedSize)
+		c.groups[group] = cidViews
+	}
+	cidViews[e.Cid]++
+	return true
+}
@@ -0,0 +1,122 @@
+package rollup
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/swissinfo-ch/zoe/ev"
+	"github.com/swissinfo-ch/zoe/report"
+)
+
+// Report is a report generated from the rollup instead of raw events.
+// Windows are rounded to whole hours.
+type Report interface {
+	Generate(s *Store) (*report.Result, error)
+}
+
+// Views implements the Report interface
+// It generates a json representation of the views (loads) per content id,
+// in the same shape as report.Views
+type Views struct {
+	Cutoff int           // minimum number of views to be included in the report
+	Window time.Duration // events younger than Window are counted
+}
+
+// Generate returns a json representation of the views per content id
+func (v *Views) Generate(s *Store) (*report.Result, error) {
+	cidViews := loadsPerCid(s, v.Window)
+	for cid, views := range cidViews {
+		if views < uint32(v.Cutoff) {
+			delete(cidViews, cid)
+		}
+	}
+	return jsonResult(cidViews)
+}
+
+// Top implements the Report interface
+// It generates a json representation of the top N content ids,
+// in the same shape as report.Top
+type Top struct {
+	N      int           // number of top content ids to include in the report
+	Window time.Duration // events younger than Window are counted
+}
+
+// Generate returns a json representation of the top N content ids
+func (t *Top) Generate(s *Store) (*report.Result, error) {
+	return jsonResult(report.TopN(loadsPerCid(s, t.Window), t.N))
+}
+
+// TimeSeries implements the Report interface
+// It generates a json representation of the totals of an event type per hour,
+// oldest first, including hours without events
+type TimeSeries struct {
+	EvType ev.EvType
+	Window time.Duration // hours younger than Window are included
+	Cids   []uint32      // optional, only events of these content ids are counted
+}
+
+// Point is the totals of an hour of a TimeSeries.
+type Point struct {
+	Hour        string  `json:"hour"` // RFC3339
+	Count       uint32  `json:"count"`
+	PageSeconds uint64  `json:"pageSeconds"`
+	Scrolled    float64 `json:"scrolled"`
+}
+
+// Generate returns a json representation of the totals per hour
+func (t *TimeSeries) Generate(s *Store) (*report.Result, error) {
+	var cids map[uint32]bool
+	if len(t.Cids) > 0 {
+		cids = make(map[uint32]bool, len(t.Cids))
+		for _, cid := range t.Cids {
+			cids[cid] = true
+		}
+	}
+	to := time.Now()
+	from := to.Add(-t.Window).Truncate(time.Hour)
+	hours := make(map[uint32]Cell)
+	s.Query(from, to, func(k Key, c Cell) {
+		if k.EvType != t.EvType || (cids != nil && !cids[k.Cid]) {
+			return
+		}
+		h := hours[k.Hour]
+		h.Count += c.Count
+		h.PageSeconds += c.PageSeconds
+		h.Scrolled += c.Scrolled
+		hours[k.Hour] = h
+	})
+	points := make([]Point, 0, int(t.Window/time.Hour)+1)
+	for h := from; h.Before(to); h = h.Add(time.Hour) {
+		c := hours[uint32(h.Unix())]
+		points = append(points, Point{
+			Hour:        h.UTC().Format(time.RFC3339),
+			Count:       c.Count,
+			PageSeconds: c.PageSeconds,
+			Scrolled:    c.Scrolled,
+		})
+	}
+	return jsonResult(points)
+}
+
+// loadsPerCid returns the number of loads per content id of the window.
+func loadsPerCid(s *Store, window time.Duration) map[uint32]uint32 {
+	to := time.Now()
+	cidViews := make(map[uint32]uint32)
+	s.Query(to.Add(-window), to, func(k Key, c Cell) {
+		if k.EvType == ev.EvType_LOAD {
+			cidViews[k.Cid] += c.Count
+		}
+	})
+	return cidViews
+}
+
+func jsonResult(v any) (*report.Result, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return &report.Result{
+		Content:     data,
+		ContentType: "application/json",
+	}, nil
+}
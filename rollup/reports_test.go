@@ -0,0 +1,88 @@
+package rollup
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/swissinfo-ch/zoe/ev"
+	"github.com/swissinfo-ch/zoe/report"
+)
+
+// TestReportsMatchRunner checks that the rollup reports have the results
+// of the equivalent reports of the runner, from the same events.
+func TestReportsMatchRunner(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "events")
+	blocks := testBlocks(uint32(time.Now().Add(-5*time.Hour).Unix()), 8)
+	appendTestBlocks(t, filename, blocks...)
+	s := openTestStore(t, Dir(filename))
+	if err := s.Rebuild(filename, &sync.Mutex{}); err != nil {
+		t.Fatal(err)
+	}
+
+	window := 30 * 24 * time.Hour
+	minEvTime := func() time.Time {
+		return time.Now().Add(-window)
+	}
+	r := report.NewRunner(&report.RunnerCfg{
+		Name:              "test",
+		Filename:          filename,
+		BlockSize:         30,
+		WorkerPoolSize:    2,
+		MinReportInterval: time.Hour,
+		Jobs: map[string]*report.Job{
+			"views": {Report: &report.Views{Cutoff: 3, MinEvTime: minEvTime}},
+			"top":   {Report: &report.Top{N: 4, MinEvTime: minEvTime}},
+		},
+	})
+	defer r.Wait()
+	defer r.Stop()
+	rollupReports := map[string]Report{
+		"views": &Views{Cutoff: 3, Window: window},
+		"top":   &Top{N: 4, Window: window},
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for name, rep := range rollupReports {
+		want, exists := r.Result(name)
+		for ; !exists && time.Now().Before(deadline); want, exists = r.Result(name) {
+			time.Sleep(time.Millisecond)
+		}
+		if !exists {
+			t.Fatalf("no result of %s", name)
+		}
+		got, err := rep.Generate(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got.Content) != string(want.Content) {
+			t.Errorf("rollup %s is %s, want %s", name, got.Content, want.Content)
+		}
+	}
+
+	// the time series counts the same loads, per hour
+	series, err := (&TimeSeries{EvType: ev.EvType_LOAD, Window: 6 * time.Hour}).Generate(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	points := make([]Point, 0)
+	if err := json.Unmarshal(series.Content, &points); err != nil {
+		t.Fatal(err)
+	}
+	loads, want := uint32(0), uint32(0)
+	for _, p := range points {
+		loads += p.Count
+	}
+	for _, block := range blocks {
+		for _, e := range block.Evs {
+			if e.EvType == ev.EvType_LOAD && !e.Bot {
+				want++
+			}
+		}
+	}
+	if len(points) != 7 || loads != want {
+		t.Errorf("time series has %d loads in %d hours, want %d in 7", loads, len(points), want)
+	}
+}
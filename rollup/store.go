@@ -0,0 +1,634 @@
+package rollup
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"maps"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/swissinfo-ch/zoe/ev"
+	"github.com/swissinfo-ch/zoe/report"
+)
+
+const (
+	day        = 24 * 60 * 60
+	hour       = 60 * 60
+	version    = 2
+	recordSize = 4 + 4 + 1 + 4 + 4 + 8 + 8
+	dayLayout  = "2006-01-02"
+	// logHeaderSize is the end offset, record count & checksum of a log entry
+	logHeaderSize = 8 + 4 + 4
+	// maxLogSize is the size of the log above which its days are compacted
+	maxLogSize = 8 << 20
+	logName    = "log"
+)
+
+// ErrUnknownEnd is returned by CatchUp when the store does not know
+// the end of the events it covers, eg. when written by a previous version.
+var ErrUnknownEnd = errors.New("rollup does not cover a known end of the events file")
+
+// Key identifies a cell of the cube.
+type Key struct {
+	Hour       uint32 // Unix time of the start of the hour
+	Cid        uint32
+	EvType     ev.EvType
+	CustomType uint32 // id of the custom event type, if EvType is CUSTOM
+}
+
+// Cell holds the totals of the events of a key.
+type Cell struct {
+	Count       uint32
+	PageSeconds uint64  // sum of PageSeconds
+	Scrolled    float64 // sum of Scrolled
+}
+
+// Store is a cube of event totals by hour, cid & event type, excluding bots.
+// It is kept in memory & persisted to a directory, with a file per UTC day.
+// The totals of each block are appended to a log, which is compacted into
+// the day files in the background once it grows, so that adding a block
+// never rewrites a day. Day files & log entries hold the end of the events
+// file they cover, so the store catches up on the blocks after it at startup.
+type Store struct {
+	dir        string
+	mu         sync.RWMutex
+	days       map[uint32]map[Key]Cell // cells by day number since the epoch
+	dayEnds    map[uint32]int64        // end of the events file covered by each day file
+	dirty      map[uint32]bool         // days with cells in the log only
+	end        int64                   // end of the events file covered, -1 if unknown
+	compactMu  sync.Mutex              // held while compacting or rebuilding
+	compacting atomic.Bool
+}
+
+// Open opens or creates a store in dir, loading its days & replaying its log.
+func Open(dir string) (*Store, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create rollup dir: %w", err)
+	}
+	s := &Store{
+		dir:     dir,
+		days:    make(map[uint32]map[Key]Cell),
+		dayEnds: make(map[uint32]int64),
+		dirty:   make(map[uint32]bool),
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read rollup dir: %w", err)
+	}
+	for _, entry := range entries {
+		t, err := time.Parse(dayLayout, entry.Name())
+		if err != nil {
+			continue // eg. a temporary file or the log
+		}
+		d := uint32(t.Unix() / day)
+		cells, end, err := readDay(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		s.days[d] = cells
+		s.dayEnds[d] = end
+		if end < 0 {
+			s.end = -1
+		} else if s.end >= 0 {
+			s.end = max(s.end, end)
+		}
+	}
+	if err := s.replayLog(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// End returns the end of the events file covered by the store, -1 if unknown.
+func (s *Store) End() int64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.end
+}
+
+// AddBlock adds the events of a block, which ends at offset end of the events file,
+// & appends their totals to the log. The log is compacted in the background once it grows.
+func (s *Store) AddBlock(block *ev.Block, end int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delta := make(map[uint32]map[Key]Cell)
+	for _, e := range block.Evs {
+		add(delta, e)
+	}
+	merge(s.days, delta)
+	for d := range delta {
+		s.dirty[d] = true
+	}
+	if s.end >= 0 {
+		s.end = end
+	}
+	size, err := s.appendLog(delta, end)
+	if err != nil {
+		return err
+	}
+	if size > maxLogSize && s.compacting.CompareAndSwap(false, true) {
+		go func() {
+			defer s.compacting.Store(false)
+			if err := s.Compact(); err != nil {
+				fmt.Printf("\nfailed to compact rollup %s: %v\n", s.dir, err)
+			}
+		}()
+	}
+	return nil
+}
+
+// CatchUp adds the blocks of an events file after the end covered by the store,
+// eg. those written while the rollup was disabled or lost from the log in a crash.
+// It returns ErrUnknownEnd if the end is unknown or is not a block end of the file,
+// as when the file was replaced, in which case the store must be rebuilt.
+// The writer must not add blocks meanwhile.
+func (s *Store) CatchUp(filename string) (int, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return 0, fmt.Errorf("failed to open file for reading: %w", err)
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return 0, fmt.Errorf("failed to stat file: %w", err)
+	}
+	size := info.Size()
+	end := s.End()
+	if end < 0 || end > size {
+		return 0, ErrUnknownEnd
+	}
+	if end > 0 {
+		// the block before the end must be valid, or else the end is not a block end
+		raw, err := report.NewBlockRangeReader(file, 0, end).Next()
+		if err == nil {
+			_, err = raw.Decode()
+		}
+		if err != nil {
+			return 0, fmt.Errorf("%w: %w", ErrUnknownEnd, err)
+		}
+	}
+	if end == size {
+		return 0, nil
+	}
+	days := make(map[uint32]map[Key]Cell)
+	n, err := addBlocks(days, file, end, size)
+	if err != nil {
+		return 0, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	merge(s.days, days)
+	for d := range days {
+		s.dirty[d] = true
+	}
+	s.end = size
+	if _, err := s.appendLog(days, size); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// Compact writes the days with cells in the log only to their files, & removes
+// their entries from the log. The store's lock is only held to copy the days
+// & to replace the log, so that blocks are added meanwhile.
+func (s *Store) Compact() error {
+	s.compactMu.Lock()
+	defer s.compactMu.Unlock()
+	s.mu.Lock()
+	days := make(map[uint32]map[Key]Cell, len(s.dirty))
+	for d := range s.dirty {
+		days[d] = maps.Clone(s.days[d])
+	}
+	s.dirty = make(map[uint32]bool)
+	end := s.end
+	info, err := os.Stat(s.logFilename())
+	s.mu.Unlock()
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to stat rollup log: %w", err)
+	}
+	compacted := info.Size()
+
+	// entries of days not written yet are replayed, as the end of their file is older
+	for d, cells := range days {
+		if err := s.writeDay(d, cells, end); err != nil {
+			s.redirty(days)
+			return err
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for d := range days {
+		s.dayEnds[d] = end
+	}
+	// keep the entries appended meanwhile
+	return s.trimLog(compacted)
+}
+
+// redirty marks days as having cells in the log only again, after a failed compaction.
+func (s *Store) redirty(days map[uint32]map[Key]Cell) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for d := range days {
+		s.dirty[d] = true
+	}
+}
+
+// Rebuild reconstructs the store from the blocks of an events file.
+// The file is read without the lock, which is then held to read the blocks
+// appended meanwhile & to swap the days, so that the writer, adding blocks
+// while holding the lock, is not blocked for the whole scan.
+func (s *Store) Rebuild(filename string, lock sync.Locker) error {
+	s.compactMu.Lock()
+	defer s.compactMu.Unlock()
+	file, err := os.Open(filename)
+	if err != nil {
+		return fmt.Errorf("failed to open file for reading: %w", err)
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to stat file: %w", err)
+	}
+	size := info.Size()
+	scanned := info
+	days := make(map[uint32]map[Key]Cell)
+	if _, err := addBlocks(days, file, 0, size); err != nil {
+		return err
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+	// the file may have been replaced, eg. by an erasure, so read it again
+	file2, err := os.Open(filename)
+	if err != nil {
+		return fmt.Errorf("failed to open file for reading: %w", err)
+	}
+	defer file2.Close()
+	info, err = file2.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to stat file: %w", err)
+	}
+	if os.SameFile(info, scanned) {
+		_, err = addBlocks(days, file2, size, info.Size())
+	} else {
+		days = make(map[uint32]map[Key]Cell)
+		_, err = addBlocks(days, file2, 0, info.Size())
+	}
+	if err != nil {
+		return err
+	}
+	end := info.Size()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for d := range s.days {
+		if _, ok := days[d]; !ok {
+			if err := os.Remove(s.dayFilename(d)); err != nil && !errors.Is(err, os.ErrNotExist) {
+				return fmt.Errorf("failed to remove rollup day: %w", err)
+			}
+		}
+	}
+	s.days = days
+	s.dayEnds = make(map[uint32]int64, len(days))
+	s.dirty = make(map[uint32]bool)
+	s.end = end
+	for d, cells := range days {
+		if err := s.writeDay(d, cells, end); err != nil {
+			return err
+		}
+		s.dayEnds[d] = end
+	}
+	if err := os.Remove(s.logFilename()); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to remove rollup log: %w", err)
+	}
+	return nil
+}
+
+// Query calls fn for each cell of the hours in [from, to).
+func (s *Store) Query(from, to time.Time, fn func(Key, Cell)) {
+	fromUnix, toUnix := uint32(max(from.Unix(), 0)), uint32(max(to.Unix(), 0))
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for d := fromUnix / day; d <= toUnix/day; d++ {
+		for k, c := range s.days[d] {
+			if k.Hour >= fromUnix-fromUnix%hour && k.Hour < toUnix {
+				fn(k, c)
+			}
+		}
+	}
+}
+
+// Cells returns the number of cells in the store.
+func (s *Store) Cells() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	n := 0
+	for _, cells := range s.days {
+		n += len(cells)
+	}
+	return n
+}
+
+// add adds an event to its cell, unless it is a bot.
+func add(days map[uint32]map[Key]Cell, e *ev.Ev) {
+	if e.Bot {
+		return
+	}
+	addCell(days, Key{
+		Hour:       e.Time - e.Time%hour,
+		Cid:        e.Cid,
+		EvType:     e.EvType,
+		CustomType: e.GetCustomType(),
+	}, Cell{
+		Count:       1,
+		PageSeconds: uint64(e.GetPageSeconds()),
+		Scrolled:    float64(e.GetScrolled()),
+	})
+}
+
+// addCell adds the totals of a cell to the cell of its key.
+func addCell(days map[uint32]map[Key]Cell, k Key, c Cell) {
+	d := k.Hour / day
+	cells, ok := days[d]
+	if !ok {
+		cells = make(map[Key]Cell)
+		days[d] = cells
+	}
+	sum := cells[k]
+	sum.Count += c.Count
+	sum.PageSeconds += c.PageSeconds
+	sum.Scrolled += c.Scrolled
+	cells[k] = sum
+}
+
+// merge adds the cells of delta to days.
+func merge(days, delta map[uint32]map[Key]Cell) {
+	for _, cells := range delta {
+		for k, c := range cells {
+			addCell(days, k, c)
+		}
+	}
+}
+
+// addBlocks adds the events of the blocks between start & end of a file,
+// returning the number of blocks.
+func addBlocks(days map[uint32]map[Key]Cell, file io.ReaderAt, start, end int64) (int, error) {
+	n := 0
+	br := report.NewBlockRangeReader(file, start, end)
+	for {
+		raw, err := br.Next()
+		if err == io.EOF {
+			return n, nil
+		}
+		var block *ev.Block
+		if err == nil {
+			block, err = raw.Decode()
+		}
+		if err != nil {
+			return n, err
+		}
+		for _, e := range block.Evs {
+			add(days, e)
+		}
+		n++
+	}
+}
+
+func (s *Store) dayFilename(d uint32) string {
+	return filepath.Join(s.dir, time.Unix(int64(d)*day, 0).UTC().Format(dayLayout))
+}
+
+func (s *Store) logFilename() string {
+	return filepath.Join(s.dir, logName)
+}
+
+// sortedKeys returns the keys of cells in order, so that files of the same cells are identical.
+func sortedKeys(cells map[Key]Cell) []Key {
+	keys := make([]Key, 0, len(cells))
+	for k := range cells {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := keys[i], keys[j]
+		if a.Hour != b.Hour {
+			return a.Hour < b.Hour
+		}
+		if a.Cid != b.Cid {
+			return a.Cid < b.Cid
+		}
+		if a.EvType != b.EvType {
+			return a.EvType < b.EvType
+		}
+		return a.CustomType < b.CustomType
+	})
+	return keys
+}
+
+func putRecord(record []byte, k Key, c Cell) {
+	binary.BigEndian.PutUint32(record[0:], k.Hour)
+	binary.BigEndian.PutUint32(record[4:], k.Cid)
+	record[8] = byte(k.EvType)
+	binary.BigEndian.PutUint32(record[9:], k.CustomType)
+	binary.BigEndian.PutUint32(record[13:], c.Count)
+	binary.BigEndian.PutUint64(record[17:], c.PageSeconds)
+	binary.BigEndian.PutUint64(record[25:], math.Float64bits(c.Scrolled))
+}
+
+func parseRecord(record []byte) (Key, Cell) {
+	return Key{
+		Hour:       binary.BigEndian.Uint32(record[0:]),
+		Cid:        binary.BigEndian.Uint32(record[4:]),
+		EvType:     ev.EvType(record[8]),
+		CustomType: binary.BigEndian.Uint32(record[9:]),
+	}, Cell{
+		Count:       binary.BigEndian.Uint32(record[13:]),
+		PageSeconds: binary.BigEndian.Uint64(record[17:]),
+		Scrolled:    math.Float64frombits(binary.BigEndian.Uint64(record[25:])),
+	}
+}
+
+// writeDay writes the cells of a day, covering the events file up to end,
+// to a temporary file that replaces its file.
+func (s *Store) writeDay(d uint32, cells map[Key]Cell, end int64) error {
+	filename := s.dayFilename(d)
+	tmpFilename := filename + ".tmp"
+	file, err := os.Create(tmpFilename)
+	if err != nil {
+		return fmt.Errorf("failed to create rollup day: %w", err)
+	}
+	defer os.Remove(tmpFilename) // no-op once renamed
+	defer file.Close()
+	w := bufio.NewWriter(file)
+	w.WriteByte(version)
+	w.Write(binary.BigEndian.AppendUint64(nil, uint64(end)))
+	record := make([]byte, recordSize)
+	for _, k := range sortedKeys(cells) {
+		putRecord(record, k, cells[k])
+		w.Write(record)
+	}
+	if err := w.Flush(); err != nil {
+		return fmt.Errorf("failed to write rollup day: %w", err)
+	}
+	if err := file.Sync(); err != nil {
+		return fmt.Errorf("failed to sync rollup day: %w", err)
+	}
+	if err := os.Rename(tmpFilename, filename); err != nil {
+		return fmt.Errorf("failed to replace rollup day: %w", err)
+	}
+	return nil
+}
+
+// readDay reads the cells of a day file & the end of the events file it covers,
+// -1 for files of version 1, which did not record it.
+func readDay(filename string) (map[Key]Cell, int64, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to read rollup day: %w", err)
+	}
+	end := int64(-1)
+	switch {
+	case len(data) > 0 && data[0] == 1:
+		data = data[1:]
+	case len(data) >= 9 && data[0] == version:
+		end = int64(binary.BigEndian.Uint64(data[1:]))
+		data = data[9:]
+	default:
+		return nil, 0, fmt.Errorf("invalid rollup day %s, rebuild the rollup", filename)
+	}
+	if len(data)%recordSize != 0 {
+		return nil, 0, fmt.Errorf("invalid rollup day %s, rebuild the rollup", filename)
+	}
+	cells := make(map[Key]Cell, len(data)/recordSize)
+	for record := data; len(record) > 0; record = record[recordSize:] {
+		k, c := parseRecord(record)
+		cells[k] = c
+	}
+	return cells, end, nil
+}
+
+// appendLog appends the totals of the blocks up to end to the log, returning its size.
+// The log is not synced, as entries lost in a crash are caught up from the events file.
+// It is opened for each entry, so that a log replaced by a compaction is picked up.
+func (s *Store) appendLog(delta map[uint32]map[Key]Cell, end int64) (int64, error) {
+	n := 0
+	for _, cells := range delta {
+		n += len(cells)
+	}
+	entry := make([]byte, logHeaderSize, logHeaderSize+n*recordSize)
+	binary.BigEndian.PutUint64(entry[0:], uint64(end))
+	binary.BigEndian.PutUint32(entry[8:], uint32(n))
+	record := make([]byte, recordSize)
+	for _, cells := range delta {
+		for k, c := range cells {
+			putRecord(record, k, c)
+			entry = append(entry, record...)
+		}
+	}
+	binary.BigEndian.PutUint32(entry[12:], crc32.ChecksumIEEE(entry[logHeaderSize:]))
+	file, err := os.OpenFile(s.logFilename(), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return 0, fmt.Errorf("failed to open rollup log: %w", err)
+	}
+	defer file.Close()
+	if _, err := file.Write(entry); err != nil {
+		return 0, fmt.Errorf("failed to append to rollup log: %w", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		return 0, fmt.Errorf("failed to stat rollup log: %w", err)
+	}
+	return info.Size(), nil
+}
+
+// readLog calls fn with the end & the records of each valid entry of the log,
+// returning the offset after the last valid one. A partly written last entry is ignored.
+func (s *Store) readLog(fn func(end int64, records []byte)) (int64, error) {
+	data, err := os.ReadFile(s.logFilename())
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to read rollup log: %w", err)
+	}
+	offset := int64(0)
+	for offset+logHeaderSize <= int64(len(data)) {
+		header := data[offset : offset+logHeaderSize]
+		size := int64(binary.BigEndian.Uint32(header[8:])) * recordSize
+		if offset+logHeaderSize+size > int64(len(data)) {
+			break
+		}
+		records := data[offset+logHeaderSize : offset+logHeaderSize+size]
+		if crc32.ChecksumIEEE(records) != binary.BigEndian.Uint32(header[12:]) {
+			break
+		}
+		fn(int64(binary.BigEndian.Uint64(header[0:])), records)
+		offset += logHeaderSize + size
+	}
+	return offset, nil
+}
+
+// replayLog adds the entries of the log not yet in the files of their days,
+// & truncates a partly written last entry, so that the next entries follow the valid ones.
+func (s *Store) replayLog() error {
+	valid, err := s.readLog(func(end int64, records []byte) {
+		if s.end >= 0 {
+			s.end = max(s.end, end)
+		}
+		for ; len(records) > 0; records = records[recordSize:] {
+			k, c := parseRecord(records)
+			d := k.Hour / day
+			if dayEnd, ok := s.dayEnds[d]; ok && dayEnd >= end {
+				continue
+			}
+			addCell(s.days, k, c)
+			s.dirty[d] = true
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return s.trimLogTo(valid)
+}
+
+// trimLogTo truncates a partly written last entry of the log.
+func (s *Store) trimLogTo(valid int64) error {
+	err := os.Truncate(s.logFilename(), valid)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to truncate rollup log: %w", err)
+	}
+	return nil
+}
+
+// trimLog replaces the log with its entries after offset, appended during a compaction.
+func (s *Store) trimLog(offset int64) error {
+	data, err := os.ReadFile(s.logFilename())
+	if err != nil {
+		return fmt.Errorf("failed to read rollup log: %w", err)
+	}
+	filename := s.logFilename()
+	tmpFilename := filename + ".tmp"
+	if err := os.WriteFile(tmpFilename, data[min(offset, int64(len(data))):], 0644); err != nil {
+		return fmt.Errorf("failed to write rollup log: %w", err)
+	}
+	if err := os.Rename(tmpFilename, filename); err != nil {
+		return fmt.Errorf("failed to replace rollup log: %w", err)
+	}
+	return nil
+}
+
+// Dir returns the rollup dir of an events file.
+func Dir(filename string) string {
+	return filename + ".rollup"
+}
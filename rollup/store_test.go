@@ -0,0 +1,420 @@
+package rollup
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/swissinfo-ch/zoe/codec"
+	"github.com/swissinfo-ch/zoe/ev"
+	"github.com/swissinfo-ch/zoe/report"
+)
+
+// midnight is the start of a UTC day, so that test blocks span two days
+const midnight = 19676 * day
+
+// testBlocks returns n blocks of 30 events a minute apart from start,
+// of several cids & types, with bots
+func testBlocks(start uint32, n int) []*ev.Block {
+	blocks := make([]*ev.Block, 0, n)
+	for i := 0; i < n; i++ {
+		block := &ev.Block{}
+		for j := 0; j < 30; j++ {
+			k := i*30 + j
+			pageSeconds := uint32(k % 50)
+			scrolled := float32(k%4) / 4 // sums are exact, whatever the order
+			e := &ev.Ev{
+				Time:   start + uint32(k*60),
+				EvType: []ev.EvType{ev.EvType_LOAD, ev.EvType_TIME, ev.EvType_UNLOAD}[k%3],
+				Cid:    uint32(k % 7),
+				Bot:    k%11 == 0,
+			}
+			switch e.EvType {
+			case ev.EvType_TIME:
+				e.PageSeconds = &pageSeconds
+			case ev.EvType_UNLOAD:
+				e.Scrolled = &scrolled
+			}
+			block.Evs = append(block.Evs, e)
+		}
+		blocks = append(blocks, block)
+	}
+	return blocks
+}
+
+// appendTestBlocks appends blocks to an events file, returning the end of each
+func appendTestBlocks(t *testing.T, filename string, blocks ...*ev.Block) []int64 {
+	t.Helper()
+	file, err := os.OpenFile(filename, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	end := info.Size()
+	ends := make([]int64, 0, len(blocks))
+	for i, block := range blocks {
+		encoded, suffix, err := report.EncodeBlock(block, ev.Layout(i%2), codec.Zstd)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := file.Write(append(encoded, suffix...)); err != nil {
+			t.Fatal(err)
+		}
+		end += int64(len(encoded) + len(suffix))
+		ends = append(ends, end)
+	}
+	return ends
+}
+
+// addTestBlocks adds blocks to a store, as the writer does after appending them
+func addTestBlocks(t *testing.T, s *Store, blocks []*ev.Block, ends []int64) {
+	t.Helper()
+	for i, block := range blocks {
+		if err := s.AddBlock(block, ends[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// cellsOf returns all cells of a store
+func cellsOf(s *Store) map[Key]Cell {
+	cells := make(map[Key]Cell)
+	s.Query(time.Unix(midnight-2*day, 0), time.Unix(midnight+2*day, 0), func(k Key, c Cell) {
+		cells[k] = c
+	})
+	return cells
+}
+
+// cellsOfBlocks returns the cells of the events of blocks
+func cellsOfBlocks(blocks []*ev.Block) map[Key]Cell {
+	days := make(map[uint32]map[Key]Cell)
+	for _, block := range blocks {
+		for _, e := range block.Evs {
+			add(days, e)
+		}
+	}
+	cells := make(map[Key]Cell)
+	for _, dayCells := range days {
+		for k, c := range dayCells {
+			cells[k] = c
+		}
+	}
+	return cells
+}
+
+func openTestStore(t *testing.T, dir string) *Store {
+	t.Helper()
+	s, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func checkCells(t *testing.T, s *Store, blocks []*ev.Block) {
+	t.Helper()
+	got, want := cellsOf(s), cellsOfBlocks(blocks)
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("store has %d cells, want %d of %d blocks", len(got), len(want), len(blocks))
+	}
+}
+
+func logSize(t *testing.T, dir string) int64 {
+	t.Helper()
+	info, err := os.Stat(filepath.Join(dir, logName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return info.Size()
+}
+
+// TestStoreLog reopens a store whose blocks are only in the log.
+func TestStoreLog(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "events")
+	blocks := testBlocks(midnight-2*hour, 8)
+	ends := appendTestBlocks(t, filename, blocks...)
+	s := openTestStore(t, Dir(filename))
+	addTestBlocks(t, s, blocks, ends)
+	checkCells(t, s, blocks)
+	if s.End() != ends[7] {
+		t.Errorf("store ends at %d, want %d", s.End(), ends[7])
+	}
+
+	reopened := openTestStore(t, Dir(filename))
+	checkCells(t, reopened, blocks)
+	if reopened.End() != ends[7] {
+		t.Errorf("reopened store ends at %d, want %d", reopened.End(), ends[7])
+	}
+	if n, err := reopened.CatchUp(filename); n != 0 || err != nil {
+		t.Errorf("caught up %d blocks of a store up to date: %v", n, err)
+	}
+}
+
+// TestStoreDamagedLog reopens stores whose last log entry was partly written or corrupted,
+// & catches up on the block lost from the events file.
+func TestStoreDamagedLog(t *testing.T) {
+	tests := []struct {
+		name   string
+		damage func(data []byte, last int) []byte
+	}{
+		{"torn header", func(data []byte, last int) []byte { return data[:last+5] }},
+		{"torn records", func(data []byte, last int) []byte { return data[:len(data)-3] }},
+		{"corrupt records", func(data []byte, last int) []byte {
+			data[len(data)-10] ^= 0xff
+			return data
+		}},
+		{"corrupt count", func(data []byte, last int) []byte {
+			data[last+11] ^= 0x01
+			return data
+		}},
+		{"corrupt checksum", func(data []byte, last int) []byte {
+			data[last+13] ^= 0xff
+			return data
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			filename := filepath.Join(dir, "events")
+			blocks := testBlocks(midnight-2*hour, 6)
+			ends := appendTestBlocks(t, filename, blocks[:4]...)
+			s := openTestStore(t, Dir(filename))
+			addTestBlocks(t, s, blocks[:3], ends[:3])
+			last := logSize(t, Dir(filename))
+			addTestBlocks(t, s, blocks[3:4], ends[3:4])
+
+			logFilename := filepath.Join(Dir(filename), logName)
+			data, err := os.ReadFile(logFilename)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(logFilename, tt.damage(data, int(last)), 0644); err != nil {
+				t.Fatal(err)
+			}
+			reopened := openTestStore(t, Dir(filename))
+			checkCells(t, reopened, blocks[:3])
+			if reopened.End() != ends[2] {
+				t.Errorf("reopened store ends at %d, want %d", reopened.End(), ends[2])
+			}
+			if size := logSize(t, Dir(filename)); size != last {
+				t.Errorf("log was not truncated to its valid entries, size %d, want %d", size, last)
+			}
+
+			n, err := reopened.CatchUp(filename)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n != 1 {
+				t.Errorf("caught up %d blocks, want 1", n)
+			}
+			checkCells(t, reopened, blocks[:4])
+			// entries appended after the truncation are replayed
+			ends = append(ends[:4], appendTestBlocks(t, filename, blocks[4:]...)...)
+			addTestBlocks(t, reopened, blocks[4:], ends[4:])
+			checkCells(t, openTestStore(t, Dir(filename)), blocks)
+		})
+	}
+}
+
+// TestStoreCompact compacts a log spanning two days, & reopens the store
+// with entries appended after the compaction.
+func TestStoreCompact(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "events")
+	blocks := testBlocks(midnight-2*hour, 10)
+	ends := appendTestBlocks(t, filename, blocks...)
+	s := openTestStore(t, Dir(filename))
+	addTestBlocks(t, s, blocks[:6], ends[:6])
+	if err := s.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	if size := logSize(t, Dir(filename)); size != 0 {
+		t.Errorf("log has %d bytes after a compaction", size)
+	}
+	for _, d := range []uint32{midnight/day - 1, midnight / day} {
+		cells, end, err := readDay(s.dayFilename(d))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if end != ends[5] || len(cells) == 0 {
+			t.Errorf("day %d has %d cells up to %d, want up to %d", d, len(cells), end, ends[5])
+		}
+	}
+	checkCells(t, openTestStore(t, Dir(filename)), blocks[:6])
+
+	// the later blocks are in the second day, the first is not written again
+	addTestBlocks(t, s, blocks[6:], ends[6:])
+	checkCells(t, openTestStore(t, Dir(filename)), blocks)
+	if err := s.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	if _, end, err := readDay(s.dayFilename(midnight/day - 1)); err != nil || end != ends[5] {
+		t.Errorf("first day was written again, up to %d: %v", end, err)
+	}
+	reopened := openTestStore(t, Dir(filename))
+	checkCells(t, reopened, blocks)
+	if reopened.End() != ends[9] {
+		t.Errorf("reopened store ends at %d, want %d", reopened.End(), ends[9])
+	}
+}
+
+// TestStoreCompactConcurrent compacts while blocks are added, so that
+// entries appended during a compaction are kept, & none counted twice.
+func TestStoreCompactConcurrent(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "events")
+	blocks := testBlocks(midnight-12*hour, 48)
+	ends := appendTestBlocks(t, filename, blocks...)
+	s := openTestStore(t, Dir(filename))
+	done := make(chan struct{})
+	wg := sync.WaitGroup{}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			if err := s.Compact(); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	addTestBlocks(t, s, blocks, ends)
+	close(done)
+	wg.Wait()
+	checkCells(t, s, blocks)
+	checkCells(t, openTestStore(t, Dir(filename)), blocks)
+}
+
+func TestStoreCatchUp(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "events")
+	blocks := testBlocks(midnight-2*hour, 8)
+	ends := appendTestBlocks(t, filename, blocks...)
+	s := openTestStore(t, Dir(filename))
+	addTestBlocks(t, s, blocks[:3], ends[:3])
+	if err := s.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	// written while the rollup was disabled
+	n, err := s.CatchUp(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 5 || s.End() != ends[7] {
+		t.Errorf("caught up %d blocks to %d, want 5 to %d", n, s.End(), ends[7])
+	}
+	checkCells(t, s, blocks)
+	reopened := openTestStore(t, Dir(filename))
+	checkCells(t, reopened, blocks)
+	if n, err := reopened.CatchUp(filename); n != 0 || err != nil {
+		t.Errorf("caught up %d blocks of a store up to date: %v", n, err)
+	}
+}
+
+func TestStoreCatchUpUnknownEnd(t *testing.T) {
+	tests := []struct {
+		name  string
+		setup func(t *testing.T, filename string, s *Store)
+	}{
+		{"version 1", func(t *testing.T, filename string, s *Store) {
+			if err := os.WriteFile(s.dayFilename(midnight/day), []byte{1}, 0644); err != nil {
+				t.Fatal(err)
+			}
+		}},
+		{"file shorter", func(t *testing.T, filename string, s *Store) {
+			if err := os.Remove(filename); err != nil {
+				t.Fatal(err)
+			}
+			appendTestBlocks(t, filename, testBlocks(midnight-2*hour, 1)...)
+		}},
+		{"file replaced", func(t *testing.T, filename string, s *Store) {
+			if err := os.Remove(filename); err != nil {
+				t.Fatal(err)
+			}
+			// larger blocks, so that the end is within a block
+			blocks := testBlocks(midnight, 4)
+			for _, block := range blocks {
+				block.Evs = append(block.Evs, block.Evs...)
+			}
+			appendTestBlocks(t, filename, blocks...)
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			filename := filepath.Join(dir, "events")
+			blocks := testBlocks(midnight-2*hour, 4)
+			ends := appendTestBlocks(t, filename, blocks...)
+			s := openTestStore(t, Dir(filename))
+			addTestBlocks(t, s, blocks[:2], ends[:2])
+			if err := s.Compact(); err != nil {
+				t.Fatal(err)
+			}
+			tt.setup(t, filename, s)
+			reopened := openTestStore(t, Dir(filename))
+			if _, err := reopened.CatchUp(filename); !errors.Is(err, ErrUnknownEnd) {
+				t.Fatalf("got error %v, want %v", err, ErrUnknownEnd)
+			}
+			if err := reopened.Rebuild(filename, &sync.Mutex{}); err != nil {
+				t.Fatal(err)
+			}
+			info, err := os.Stat(filename)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if reopened.End() != info.Size() {
+				t.Errorf("rebuilt store ends at %d, want %d", reopened.End(), info.Size())
+			}
+			if n, err := reopened.CatchUp(filename); n != 0 || err != nil {
+				t.Errorf("caught up %d blocks of a rebuilt store: %v", n, err)
+			}
+		})
+	}
+}
+
+// TestStoreRebuild rebuilds a store after events were removed from the file,
+// so that days without events are removed, & the log with them.
+func TestStoreRebuild(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "events")
+	blocks := testBlocks(midnight-2*hour, 8)
+	ends := appendTestBlocks(t, filename, blocks...)
+	s := openTestStore(t, Dir(filename))
+	addTestBlocks(t, s, blocks[:4], ends[:4])
+	if err := s.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	addTestBlocks(t, s, blocks[4:], ends[4:])
+
+	// the first day is erased
+	if err := os.Remove(filename); err != nil {
+		t.Fatal(err)
+	}
+	kept := blocks[4:]
+	appendTestBlocks(t, filename, kept...)
+	if err := s.Rebuild(filename, &sync.Mutex{}); err != nil {
+		t.Fatal(err)
+	}
+	checkCells(t, s, kept)
+	if _, err := os.Stat(s.dayFilename(midnight/day - 1)); !os.IsNotExist(err) {
+		t.Errorf("day without events was not removed: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(Dir(filename), logName)); !os.IsNotExist(err) {
+		t.Errorf("log was not removed: %v", err)
+	}
+	checkCells(t, openTestStore(t, Dir(filename)), kept)
+}